@@ -1,59 +1,177 @@
 package kvpaxos
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
 	"math/big"
-	"net/rpc"
 	"time"
+	"transport"
 )
-import "fmt"
 
+//
+// a Clerk has a session with the service, which it registers on
+// first use and which numbers its ops 1, 2, ... so the servers can
+// execute each exactly once. a session the servers expired (see
+// SessionTimeout) is registered again, and a Get or Scan is simply
+// retried in the new one. any other op is only retried if no
+// earlier attempt at it can have taken effect; otherwise it fails
+// with ErrSessionLost, since the servers no longer remember whether
+// it did. one op at a time per Clerk.
+//
+// a Clerk sticks with the last server that answered, until that
+// one fails to or sends it to the leader, and waits longer and
+// longer between attempts while none gets anywhere.
+//
+// each op comes in two forms: one that keeps trying forever, short
+// of ErrSessionLost, and one whose name ends in Ctx that gives up
+// with ctx.Err() once ctx is done, and reports a missing key as
+// ErrNotFound. an op that gives up may still take effect.
+//
 type Clerk struct {
 	servers []string
+	pool    *transport.Pool
 	// You will have to modify this struct.
-	id int64
+	busy    chan struct{} // holds a token while an op runs
+	id      int64         // session; 0 until registered
+	seq     int64         // of the last op sent
+	leader  int           // index in servers of the one to try first
+	backoff time.Duration // before the next attempt; 0 after a success
 }
 
-func MakeClerk(servers []string) *Clerk {
+// what the Ctx ops return for a missing key.
+var ErrNotFound = errors.New("kvpaxos: no such key")
+
+// what the Ctx ops that change the data return if their session
+// expired after they were sent: they may or may not have happened.
+var ErrSessionLost = errors.New("kvpaxos: session expired; outcome unknown")
+
+// how long one attempt at one server may take. it must be longer
+// than a server takes to give up on an op (opTimeout) or to answer
+// a Watch with nothing (watchTimeout).
+const attemptTimeout = 2 * time.Second
+
+// bounds on the wait between failed attempts.
+const (
+	minBackoff = 10 * time.Millisecond
+	maxBackoff = 500 * time.Millisecond
+)
+
+func MakeClerk(servers []string, t transport.Transport) *Clerk {
 	ck := new(Clerk)
 	ck.servers = servers
+	ck.pool = transport.NewPool(t, attemptTimeout)
 	// You'll have to add code here.
-	ck.id = nrand()
-
+	ck.busy = make(chan struct{}, 1)
 	return ck
 }
 
 //
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be a pointer
-// to a reply structure.
+// wait for the Clerk's op in progress, if any, to finish.
 //
-// the return value is true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// the reply's contents are only valid if call() returned true.
-//
-// you should assume that call() will time out and return an
-// error after a while if it doesn't get a reply from the server.
+func (ck *Clerk) lock(ctx context.Context) error {
+	select {
+	case ck.busy <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ck *Clerk) unlock() {
+	<-ck.busy
+}
+
 //
-// please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
+// make one attempt at an RPC. if it doesn't get an answer, pick
+// the server to try next, wait, and return false; the caller should
+// try again with a fresh reply, unless ctx is done.
+// caller must hold the lock.
 //
-func call(srv string, rpcname string,
-	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
-	if errx != nil {
+func (ck *Clerk) call(ctx context.Context, name string, args interface{}, reply redirector) bool {
+	if ck.pool.CallContext(ctx, ck.servers[ck.leader], name, args, reply) {
+		err, leader := reply.redirect()
+		if err != ErrNotLeader && err != ErrTimeout {
+			ck.backoff = 0
+			return true
+		}
+		if i := indexOf(ck.servers, leader); err == ErrNotLeader && i >= 0 && i != ck.leader {
+			ck.leader = i
+			ck.wait(ctx)
+			return false
+		}
+	}
+	if ctx.Err() != nil {
+		// the server isn't to blame.
 		return false
 	}
-	defer c.Close()
+	// down, cut off from the majority, or doesn't know who leads.
+	ck.leader = (ck.leader + 1) % len(ck.servers)
+	ck.wait(ctx)
+	return false
+}
+
+//
+// sleep for between half and all of the backoff, so clients that
+// failed together don't all retry together, and double it. stops
+// early if ctx is done.
+// caller must hold the lock.
+//
+func (ck *Clerk) wait(ctx context.Context) {
+	if ck.backoff < minBackoff {
+		ck.backoff = minBackoff
+	}
+	half := int64(ck.backoff / 2)
+	timer := time.NewTimer(time.Duration(half + nrand()%(half+1)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	ck.backoff *= 2
+	if ck.backoff > maxBackoff {
+		ck.backoff = maxBackoff
+	}
+}
+
+func indexOf(servers []string, srv string) int {
+	for i, s := range servers {
+		if s == srv {
+			return i
+		}
+	}
+	return -1
+}
 
-	err := c.Call(rpcname, args, reply)
-	if err == nil {
-		return true
+//
+// get a new session from the log.
+// caller must hold the lock.
+//
+func (ck *Clerk) register(ctx context.Context) error {
+	args := &RegisterArgs{Nonce: nrand()}
+	for ctx.Err() == nil {
+		reply := RegisterReply{}
+		if ck.call(ctx, "KVPaxos.RegisterClient", args, &reply) && reply.Err == "" {
+			ck.id = reply.ClientId
+			ck.seq = 0
+			return nil
+		}
 	}
+	return ctx.Err()
+}
 
-	fmt.Println(err)
-	return false
+//
+// the session and sequence number for the next op.
+// caller must hold the lock.
+//
+func (ck *Clerk) next(ctx context.Context) (int64, int64, error) {
+	if ck.id == 0 {
+		if err := ck.register(ctx); err != nil {
+			return 0, 0, err
+		}
+	}
+	ck.seq++
+	return ck.id, ck.seq, nil
 }
 
 //
@@ -63,54 +181,171 @@ func call(srv string, rpcname string,
 //
 func (ck *Clerk) Get(key string) string {
 	// You will have to modify this function.
-	numOfServers := len(ck.servers)
-	i := 0
-	args := &GetArgs{
-		Key:       key,
-		Timestamp: time.Now().UnixNano(),
-		ClientId:  ck.id,
+	v, _ := ck.GetCtx(context.Background(), key)
+	return v
+}
+
+func (ck *Clerk) GetCtx(ctx context.Context, key string) (string, error) {
+	if err := ck.lock(ctx); err != nil {
+		return "", err
 	}
+	defer ck.unlock()
+	args := &GetArgs{Key: key}
+	var err error
 	for {
+		if args.ClientId == 0 {
+			if args.ClientId, args.Seq, err = ck.next(ctx); err != nil {
+				return "", err
+			}
+		}
 		reply := GetReply{}
-		if !call(ck.servers[i], "KVPaxos.Get", args, &reply) {
-			i = (i + 1) % numOfServers
+		if !ck.call(ctx, "KVPaxos.Get", args, &reply) {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
 			continue
 		}
-		if len(reply.Err) > 0 {
-			return ""
+		if reply.Err == ErrSessionExpired {
+			ck.id, args.ClientId = 0, 0
+			continue
+		}
+		if reply.Err == ErrNoKey {
+			return "", ErrNotFound
 		}
-		return reply.Value
+		return reply.Value, nil
 	}
 }
 
 //
-// set the value for a key.
-// keeps trying until it succeeds.
+// send a Put RPC until some server executes it, ctx is done, or
+// the session is lost.
 //
-func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
-	// You will have to modify this function.
-	numOfServers := len(ck.servers)
-	i := 0
-	args := &PutArgs{
-		Key:       key,
-		Value:     value,
-		DoHash:    dohash,
-		Timestamp: time.Now().UnixNano(),
-		ClientId:  ck.id,
+func (ck *Clerk) write(ctx context.Context, args *PutArgs) (PutReply, error) {
+	if err := ck.lock(ctx); err != nil {
+		return PutReply{}, err
 	}
+	defer ck.unlock()
+	var err error
+	sent := false // whether an attempt may have taken effect
 	for {
+		if args.ClientId == 0 {
+			if args.ClientId, args.Seq, err = ck.next(ctx); err != nil {
+				return PutReply{}, err
+			}
+		}
 		reply := PutReply{}
-		if !call(ck.servers[i], "KVPaxos.Put", args, &reply) {
-			i = (i + 1) % numOfServers
+		if !ck.call(ctx, "KVPaxos.Put", args, &reply) {
+			if ctx.Err() != nil {
+				return PutReply{}, ctx.Err()
+			}
+			sent = true
+			continue
+		}
+		if reply.Err == ErrSessionExpired {
+			// the servers forgot us, so whether an earlier attempt
+			// happened is forgotten too.
+			ck.id, args.ClientId = 0, 0
+			if sent {
+				return reply, ErrSessionLost
+			}
+			continue
+		}
+		return reply, nil
+	}
+}
+
+//
+// up to limit keys >= start and < end, with their values, in key
+// order; an empty end means no bound. the keys under a prefix are
+// Scan(prefix, PrefixEnd(prefix), limit). next is "" at the end,
+// and otherwise the start for the next page.
+//
+func (ck *Clerk) Scan(start string, end string, limit int) ([]KeyValue, string) {
+	kvs, next, _ := ck.ScanCtx(context.Background(), start, end, limit)
+	return kvs, next
+}
+
+func (ck *Clerk) ScanCtx(ctx context.Context, start string, end string, limit int) ([]KeyValue, string, error) {
+	if err := ck.lock(ctx); err != nil {
+		return nil, "", err
+	}
+	defer ck.unlock()
+	args := &ScanArgs{Start: start, End: end, Limit: limit}
+	var err error
+	for {
+		if args.ClientId == 0 {
+			if args.ClientId, args.Seq, err = ck.next(ctx); err != nil {
+				return nil, "", err
+			}
+		}
+		reply := ScanReply{}
+		if !ck.call(ctx, "KVPaxos.Scan", args, &reply) {
+			if ctx.Err() != nil {
+				return nil, "", ctx.Err()
+			}
 			continue
 		}
-		if len(reply.Err) > 0 {
-			return ""
+		if reply.Err == ErrSessionExpired {
+			ck.id, args.ClientId = 0, 0
+			continue
 		}
-		return reply.PreviousValue
+		return reply.Pairs, reply.Next, nil
 	}
 }
 
+//
+// stream the changes to key, or to every key under prefix key, in
+// paxos instances >= fromSeq (-1 for changes from now on), until
+// ctx is done. a client that stops can pick up where it left off
+// with one more than the last Event's Seq. if the servers have
+// dropped some of the changes, an Event with Lost set takes their
+// place. Watch doesn't hold up the Clerk's other calls.
+//
+func (ck *Clerk) Watch(ctx context.Context, key string, prefix bool, fromSeq int) <-chan Event {
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		args := &WatchArgs{Key: key, Prefix: prefix, FromSeq: fromSeq}
+		for i := 0; ctx.Err() == nil; {
+			reply := WatchReply{}
+			if !ck.pool.CallContext(ctx, ck.servers[i], "KVPaxos.Watch", args, &reply) {
+				i = (i + 1) % len(ck.servers)
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			if reply.Err == ErrCompacted {
+				reply.Events = []Event{{Seq: reply.Next, Lost: true}}
+			}
+			for _, e := range reply.Events {
+				select {
+				case out <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+			args.FromSeq = reply.Next
+		}
+	}()
+	return out
+}
+
+//
+// set the value for a key.
+// keeps trying until it succeeds.
+//
+func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
+	// You will have to modify this function.
+	reply, _ := ck.write(context.Background(), &PutArgs{
+		Key:    key,
+		Value:  value,
+		DoHash: dohash,
+	})
+	if len(reply.Err) > 0 {
+		return ""
+	}
+	return reply.PreviousValue
+}
+
 func (ck *Clerk) Put(key string, value string) {
 	ck.PutExt(key, value, false)
 }
@@ -119,6 +354,198 @@ func (ck *Clerk) PutHash(key string, value string) string {
 	return v
 }
 
+func (ck *Clerk) PutCtx(ctx context.Context, key string, value string) error {
+	_, err := ck.write(ctx, &PutArgs{Key: key, Value: value})
+	return err
+}
+
+func (ck *Clerk) PutHashCtx(ctx context.Context, key string, value string) (string, error) {
+	reply, err := ck.write(ctx, &PutArgs{Key: key, Value: value, DoHash: true})
+	return reply.PreviousValue, err
+}
+
+//
+// set the value for a key, which expires after ttl: Gets then find
+// ErrNoKey. Appends and CASes keep the expiry; a Put removes it.
+//
+func (ck *Clerk) PutWithTTL(key string, value string, ttl time.Duration) {
+	ck.PutWithTTLCtx(context.Background(), key, value, ttl)
+}
+
+func (ck *Clerk) PutWithTTLCtx(ctx context.Context, key string, value string, ttl time.Duration) error {
+	_, err := ck.write(ctx, &PutArgs{Key: key, Value: value, TTL: ttl})
+	return err
+}
+
+//
+// add suffix to the end of key's value; a missing key is "".
+//
+func (ck *Clerk) Append(key string, suffix string) {
+	ck.AppendCtx(context.Background(), key, suffix)
+}
+
+func (ck *Clerk) AppendCtx(ctx context.Context, key string, suffix string) error {
+	_, err := ck.write(ctx, &PutArgs{Key: key, Value: suffix, Type: APPEND})
+	return err
+}
+
+//
+// remove key; Gets then find ErrNoKey, as if it had never been Put.
+//
+func (ck *Clerk) Delete(key string) {
+	ck.DeleteCtx(context.Background(), key)
+}
+
+// returns ErrNotFound if key was already missing.
+func (ck *Clerk) DeleteCtx(ctx context.Context, key string) error {
+	reply, err := ck.write(ctx, &PutArgs{Key: key, Type: DELETE})
+	if err == nil && reply.Err == ErrNoKey {
+		err = ErrNotFound
+	}
+	return err
+}
+
+//
+// set key to value if it is now expected; a missing key is "".
+// returns whether it did.
+//
+func (ck *Clerk) CAS(key string, expected string, value string) bool {
+	ok, _ := ck.CASCtx(context.Background(), key, expected, value)
+	return ok
+}
+
+func (ck *Clerk) CASCtx(ctx context.Context, key string, expected string, value string) (bool, error) {
+	reply, err := ck.write(ctx, &PutArgs{Key: key, Value: value, Expected: expected, Type: CAS})
+	return err == nil && reply.Err == "", err
+}
+
+//
+// run ops as one atomic step, if every cond holds; see txn.go.
+// returns what each op found, and whether the conds held.
+//
+func (ck *Clerk) Txn(ops []TxnOp, conds []Cond) ([]TxnResult, bool) {
+	results, ok, _ := ck.TxnCtx(context.Background(), ops, conds)
+	return results, ok
+}
+
+func (ck *Clerk) TxnCtx(ctx context.Context, ops []TxnOp, conds []Cond) ([]TxnResult, bool, error) {
+	if err := ck.lock(ctx); err != nil {
+		return nil, false, err
+	}
+	defer ck.unlock()
+	args := &TxnArgs{Ops: ops, Conds: conds}
+	var err error
+	sent := false
+	for {
+		if args.ClientId == 0 {
+			if args.ClientId, args.Seq, err = ck.next(ctx); err != nil {
+				return nil, false, err
+			}
+		}
+		reply := TxnReply{}
+		if !ck.call(ctx, "KVPaxos.Txn", args, &reply) {
+			if ctx.Err() != nil {
+				return nil, false, ctx.Err()
+			}
+			sent = true
+			continue
+		}
+		if reply.Err == ErrSessionExpired {
+			ck.id, args.ClientId = 0, 0
+			if sent {
+				return nil, false, ErrSessionLost
+			}
+			continue
+		}
+		return reply.Results, reply.Err == "", nil
+	}
+}
+
+//
+// keep an idle session from expiring.
+//
+func (ck *Clerk) KeepAlive() {
+	ck.KeepAliveCtx(context.Background())
+}
+
+func (ck *Clerk) KeepAliveCtx(ctx context.Context) error {
+	if err := ck.lock(ctx); err != nil {
+		return err
+	}
+	defer ck.unlock()
+	if ck.id == 0 {
+		return nil
+	}
+	args := &SessionArgs{ck.id}
+	for {
+		reply := SessionReply{}
+		if ck.call(ctx, "KVPaxos.KeepAlive", args, &reply) {
+			if reply.Err == ErrSessionExpired {
+				ck.id = 0
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+//
+// end the session, so the servers can forget it now rather
+// than when it expires. the Clerk registers again if used.
+//
+func (ck *Clerk) Close() {
+	ck.CloseCtx(context.Background())
+}
+
+func (ck *Clerk) CloseCtx(ctx context.Context) error {
+	if err := ck.lock(ctx); err != nil {
+		return err
+	}
+	defer ck.unlock()
+	if ck.id == 0 {
+		return nil
+	}
+	args := &SessionArgs{ck.id}
+	for {
+		reply := SessionReply{}
+		if ck.call(ctx, "KVPaxos.CloseSession", args, &reply) {
+			ck.id = 0
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+//
+// replace the set of servers with servers; see KVPaxos.Reconfigure.
+// the Clerk goes on using the servers it was made with, so make new
+// Clerks with the new set.
+//
+func (ck *Clerk) Reconfigure(servers []string) {
+	ck.ReconfigureCtx(context.Background(), servers)
+}
+
+func (ck *Clerk) ReconfigureCtx(ctx context.Context, servers []string) error {
+	if err := ck.lock(ctx); err != nil {
+		return err
+	}
+	defer ck.unlock()
+	args := &ReconfigureArgs{servers}
+	for {
+		reply := ReconfigureReply{}
+		if ck.call(ctx, "KVPaxos.Reconfigure", args, &reply) {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
 func nrand() int64 {
 	max := big.NewInt(int64(1) << 62)
 	bigx, _ := rand.Int(rand.Reader, max)
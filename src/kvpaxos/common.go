@@ -1,11 +1,23 @@
 package kvpaxos
 
 import "hash/fnv"
+import "time"
 
 const (
 	OK              = "OK"
 	ErrNoKey        = "ErrNoKey"
 	OutdatedRequest = "OutdatedRequest"
+	// the client's session expired or was closed; register again.
+	ErrSessionExpired = "ErrSessionExpired"
+	// a CAS found some other value, or a Txn condition didn't hold.
+	ErrMismatch = "ErrMismatch"
+	ErrBadOp    = "ErrBadOp"
+	// a Watch asked for changes older than the server remembers.
+	ErrCompacted = "ErrCompacted"
+	// the server couldn't get the op applied in time; try the one
+	// in the reply's Leader, or for ErrTimeout some other one.
+	ErrNotLeader = "ErrNotLeader"
+	ErrTimeout   = "ErrTimeout"
 )
 
 type Err string
@@ -15,30 +27,182 @@ type PutArgs struct {
 	Key    string
 	Value  string
 	DoHash bool // For PutHash
+
+	Type     string        // APPEND, DELETE or CAS; "" for Put and PutHash
+	Expected string        // For CAS
+	TTL      time.Duration // For Put; 0 for no expiry
 	// You'll have to add definitions here.
 	// Field names must start with capital letters,
 	// otherwise RPC will break.
-	Timestamp int64
-	ClientId  int64
+	Seq      int64 // 1, 2, ... within the session
+	ClientId int64 // the session
 }
 
 type PutReply struct {
 	Err           Err
 	PreviousValue string // For PutHash
+	Leader        string // the server the replier thinks leads, or ""
 }
 
 type GetArgs struct {
 	Key string
 	// You'll have to add definitions here.
-	Timestamp int64
-	ClientId  int64
+	Seq      int64
+	ClientId int64
 }
 
 type GetReply struct {
-	Err   Err
+	Err    Err
+	Value  string
+	Leader string // the server the replier thinks leads, or ""
+}
+
+// one step of a Txn: a GET, PUT, APPEND or DELETE.
+type TxnOp struct {
+	Type  string
+	Key   string
 	Value string
 }
 
+// kinds of Cond.
+const (
+	IfEquals  = "EQUALS"  // the key's value is Value
+	IfAbsent  = "ABSENT"  // the key is missing
+	IfVersion = "VERSION" // the key's version is Version; 0 if missing
+)
+
+type Cond struct {
+	Type    string
+	Key     string
+	Value   string
+	Version int64
+}
+
+// what one TxnOp found. only GETs fill in Value and Version.
+type TxnResult struct {
+	Err     Err
+	Value   string
+	Version int64
+}
+
+type TxnArgs struct {
+	Ops      []TxnOp
+	Conds    []Cond
+	Seq      int64
+	ClientId int64
+}
+
+type TxnReply struct {
+	Err     Err // ErrMismatch if a Cond didn't hold
+	Results []TxnResult
+	Leader  string // the server the replier thinks leads, or ""
+}
+
+// the most pairs one Scan returns.
+const MaxScan = 1000
+
+type KeyValue struct {
+	Key     string
+	Value   string
+	Version int64
+}
+
+type ScanArgs struct {
+	Start    string // or the Next from the previous page
+	End      string // "" for no bound
+	Limit    int    // at most MaxScan
+	Seq      int64
+	ClientId int64
+}
+
+type ScanReply struct {
+	Err    Err
+	Pairs  []KeyValue
+	Next   string // "" if there are no more
+	Leader string // the server the replier thinks leads, or ""
+}
+
+//
+// the End for a Scan of every key that starts with prefix.
+//
+func PrefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	// every byte is 0xff; no bound.
+	return ""
+}
+
+// a change to a key, made by the ops in paxos instance Seq.
+type Event struct {
+	Seq     int
+	Key     string
+	Value   string
+	Version int64
+	Deleted bool
+	// instead of a change: the changes between the last Event and
+	// Seq are lost, and the watcher should re-read what it cares about.
+	Lost bool
+}
+
+type WatchArgs struct {
+	Key     string
+	Prefix  bool // watch every key that starts with Key
+	FromSeq int  // changes in instances >= FromSeq; -1 for new ones only
+}
+
+type WatchReply struct {
+	Err    Err // ErrCompacted if FromSeq is too old
+	Events []Event
+	Next   int // FromSeq for the next Watch
+}
+
+type RegisterArgs struct {
+	Nonce int64 // tells this registration's reply from others'
+}
+
+type RegisterReply struct {
+	Err      Err
+	ClientId int64
+	Leader   string // the server the replier thinks leads, or ""
+}
+
+// for KeepAlive and CloseSession.
+type SessionArgs struct {
+	ClientId int64
+}
+
+type SessionReply struct {
+	Err    Err
+	Leader string // the server the replier thinks leads, or ""
+}
+
+type ReconfigureArgs struct {
+	Servers []string // the new set; a new server's index in it is its me
+}
+
+type ReconfigureReply struct {
+	Err    Err
+	Leader string // the server the replier thinks leads, or ""
+}
+
+// a reply that may send the client to another server.
+type redirector interface {
+	redirect() (Err, string)
+}
+
+func (r *PutReply) redirect() (Err, string)         { return r.Err, r.Leader }
+func (r *GetReply) redirect() (Err, string)         { return r.Err, r.Leader }
+func (r *TxnReply) redirect() (Err, string)         { return r.Err, r.Leader }
+func (r *ScanReply) redirect() (Err, string)        { return r.Err, r.Leader }
+func (r *RegisterReply) redirect() (Err, string)    { return r.Err, r.Leader }
+func (r *SessionReply) redirect() (Err, string)     { return r.Err, r.Leader }
+func (r *ReconfigureReply) redirect() (Err, string) { return r.Err, r.Leader }
+
 func hash(s string) uint32 {
 	h := fnv.New32a()
 	h.Write([]byte(s))
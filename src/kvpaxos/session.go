@@ -0,0 +1,142 @@
+package kvpaxos
+
+//
+// client sessions.
+//
+// a client registers through the log and gets a session ID, the
+// same at every server. it numbers its ops in the session 1, 2, ...,
+// and each server remembers only the last op of each session and its
+// result, enough to execute every op exactly once.
+//
+// sessions expire by the log's clock, not the servers': each Batch
+// carries its proposer's time, the log's time is the latest of those
+// applied, and a session that no op or KeepAlive has touched for
+// SessionTimeout of log time is dropped by every server at the same
+// point in the log. an op in an expired session gets
+// ErrSessionExpired, and the client has to register again. lease
+// reads (see leaseRead) skip the log, so they only do that while
+// the session has plenty of time left.
+//
+
+import "strconv"
+import "time"
+
+// how long a session may sit idle, in log time. every server
+// must use the same value.
+var SessionTimeout = time.Minute
+
+type Session struct {
+	lastSeq    int64  // of the last op executed
+	reply      result // of that op
+	lastActive int64  // log time of the last op or KeepAlive
+}
+
+// a Session, in a Snapshot.
+type SnapshotSession struct {
+	LastSeq    int64
+	Err        Err
+	Value      string
+	Reads      []TxnResult
+	Pairs      []KeyValue
+	LastActive int64
+}
+
+func (kv *KVPaxos) RegisterClient(args *RegisterArgs, reply *RegisterReply) error {
+	r, ok := kv.submit(Op{Type: REGISTER, Seq: args.Nonce})
+	if !ok {
+		return errKilled
+	}
+	reply.Err = r.err
+	reply.Leader = kv.px.Leader()
+	reply.ClientId, _ = strconv.ParseInt(r.value, 10, 64)
+	return nil
+}
+
+func (kv *KVPaxos) KeepAlive(args *SessionArgs, reply *SessionReply) error {
+	r, ok := kv.submit(Op{Type: KEEPALIVE, ClientID: args.ClientId})
+	if !ok {
+		return errKilled
+	}
+	reply.Err = r.err
+	reply.Leader = kv.px.Leader()
+	return nil
+}
+
+func (kv *KVPaxos) CloseSession(args *SessionArgs, reply *SessionReply) error {
+	r, ok := kv.submit(Op{Type: CLOSE, ClientID: args.ClientId})
+	if !ok {
+		return errKilled
+	}
+	reply.Err = r.err
+	reply.Leader = kv.px.Leader()
+	return nil
+}
+
+//
+// if op is one its session has already executed, the result.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) executed(op Op) (result, bool) {
+	s, ok := kv.sessions[op.ClientID]
+	if !ok || op.Seq == 0 || op.Seq > s.lastSeq {
+		return result{}, false
+	}
+	if op.Seq == s.lastSeq {
+		return s.reply, true
+	}
+	return result{err: OutdatedRequest}, true
+}
+
+//
+// whether a lease read in session id may skip the log. such a read
+// doesn't count as activity, so once half of SessionTimeout has
+// passed on our clock since the session was last active, its reads
+// go through the log again, and keep it from expiring.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) sessionFresh(id int64) bool {
+	s, ok := kv.sessions[id]
+	return ok && time.Now().UnixNano()-s.lastActive < SessionTimeout.Nanoseconds()/2
+}
+
+//
+// apply a REGISTER, KEEPALIVE or CLOSE from the log.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) applySession(op Op) (Err, string) {
+	switch op.Type {
+	case REGISTER:
+		// a client that retries gets a second session; the first
+		// one expires.
+		kv.nextSession++
+		kv.sessions[kv.nextSession] = &Session{lastActive: kv.logTime}
+		return "", strconv.FormatInt(kv.nextSession, 10)
+	case KEEPALIVE:
+		s, ok := kv.sessions[op.ClientID]
+		if !ok {
+			return ErrSessionExpired, ""
+		}
+		s.lastActive = kv.logTime
+	case CLOSE:
+		delete(kv.sessions, op.ClientID)
+	}
+	return "", ""
+}
+
+//
+// move the log's clock up to t, if that's later, and drop the
+// sessions that have been idle too long.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) advanceClock(t int64) {
+	if t <= kv.logTime {
+		return
+	}
+	kv.logTime = t
+	kv.db.now = t
+	for id, s := range kv.sessions {
+		if kv.logTime-s.lastActive > SessionTimeout.Nanoseconds() {
+			delete(kv.sessions, id)
+		}
+	}
+}
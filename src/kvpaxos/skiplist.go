@@ -0,0 +1,109 @@
+package kvpaxos
+
+//
+// a skiplist of Entries, ordered by key.
+//
+// each node is on level 0 and, with probability 1/4 for each level
+// above, on higher ones too; a search runs along the top level and
+// drops a level whenever the next key is too big, so finding a key,
+// or the first key >= some string, takes O(log n) steps.
+//
+
+import "math/rand"
+
+const maxLevel = 16
+
+type node struct {
+	key   string
+	entry Entry
+	next  []*node // next[i] is the next node on level i
+}
+
+type skiplist struct {
+	head  node // a sentinel before every key
+	level int  // levels in use
+	n     int
+}
+
+func makeSkiplist() *skiplist {
+	l := &skiplist{level: 1}
+	l.head.next = make([]*node, maxLevel)
+	return l
+}
+
+func randomLevel() int {
+	level := 1
+	for level < maxLevel && rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+//
+// the last node on each level with a key < key, in prev if it's
+// not nil, and the first node with a key >= key.
+//
+func (l *skiplist) search(key string, prev []*node) *node {
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if prev != nil {
+			prev[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (l *skiplist) get(key string) (Entry, bool) {
+	x := l.search(key, nil)
+	if x == nil || x.key != key {
+		return Entry{}, false
+	}
+	return x.entry, true
+}
+
+func (l *skiplist) set(key string, e Entry) {
+	prev := make([]*node, maxLevel)
+	x := l.search(key, prev)
+	if x != nil && x.key == key {
+		x.entry = e
+		return
+	}
+	level := randomLevel()
+	for i := l.level; i < level; i++ {
+		prev[i] = &l.head
+	}
+	if level > l.level {
+		l.level = level
+	}
+	x = &node{key, e, make([]*node, level)}
+	for i := 0; i < level; i++ {
+		x.next[i] = prev[i].next[i]
+		prev[i].next[i] = x
+	}
+	l.n++
+}
+
+// returns false if key wasn't there.
+func (l *skiplist) remove(key string) bool {
+	prev := make([]*node, maxLevel)
+	x := l.search(key, prev)
+	if x == nil || x.key != key {
+		return false
+	}
+	for i := 0; i < len(x.next); i++ {
+		prev[i].next[i] = x.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.n--
+	return true
+}
+
+// the first node with a key >= key, or nil.
+func (l *skiplist) seek(key string) *node {
+	return l.search(key, nil)
+}
@@ -0,0 +1,148 @@
+package kvpaxos
+
+//
+// the key/value data, kept in key order (see skiplist.go) so that
+// it can be scanned.
+//
+// every key carries a version: how many writes the store had
+// applied when the key was last written. versions only grow, so a
+// key that is deleted and written again doesn't get an old version
+// back. a missing key has version 0.
+//
+// a key may also carry an expiry time. the store hides a key from
+// get() and scan() once now reaches its expiry, but only an
+// expire() takes it out (see ttl.go).
+//
+
+import "sort"
+
+type Entry struct {
+	Value   string
+	Version int64
+	Expires int64 // in unix nanoseconds; 0 for never
+}
+
+// whether e has expired by now.
+func (e Entry) expired(now int64) bool {
+	return e.Expires != 0 && e.Expires <= now
+}
+
+type store struct {
+	index   *skiplist
+	rev     int64            // writes applied so far
+	changes []Event          // writes since the last take(); Seq not set
+	ttl     map[string]int64 // every key with an expiry, and when
+	now     int64            // keys that expire by now are hidden
+}
+
+func makeStore() *store {
+	return &store{index: makeSkiplist(), ttl: make(map[string]int64)}
+}
+
+// a store holding data, as from a Snapshot.
+func storeOf(data map[string]Entry, rev int64) *store {
+	st := &store{index: makeSkiplist(), rev: rev, ttl: make(map[string]int64)}
+	for k, e := range data {
+		st.index.set(k, e)
+		if e.Expires != 0 {
+			st.ttl[k] = e.Expires
+		}
+	}
+	return st
+}
+
+// every key, for a Snapshot.
+func (st *store) all() map[string]Entry {
+	data := make(map[string]Entry, st.index.n)
+	for x := st.index.seek(""); x != nil; x = x.next[0] {
+		data[x.key] = x.entry
+	}
+	return data
+}
+
+func (st *store) get(key string) (Entry, bool) {
+	e, ok := st.index.get(key)
+	if !ok || e.expired(st.now) {
+		return Entry{}, false
+	}
+	return e, true
+}
+
+// expires is 0 for a key that should stay.
+func (st *store) put(key string, value string, expires int64) {
+	st.rev++
+	st.index.set(key, Entry{value, st.rev, expires})
+	if expires != 0 {
+		st.ttl[key] = expires
+	} else {
+		delete(st.ttl, key)
+	}
+	st.changes = append(st.changes, Event{Key: key, Value: value, Version: st.rev})
+}
+
+// returns false if key was missing.
+func (st *store) remove(key string) bool {
+	if _, ok := st.get(key); !ok {
+		return false
+	}
+	st.index.remove(key)
+	delete(st.ttl, key)
+	st.rev++
+	st.changes = append(st.changes, Event{Key: key, Version: st.rev, Deleted: true})
+	return true
+}
+
+// remove every key that expires by until.
+func (st *store) expire(until int64) {
+	var keys []string
+	for key, t := range st.ttl {
+		if t <= until {
+			keys = append(keys, key)
+		}
+	}
+	// in the same order, and so with the same versions, everywhere.
+	sort.Strings(keys)
+	for _, key := range keys {
+		st.index.remove(key)
+		delete(st.ttl, key)
+		st.rev++
+		st.changes = append(st.changes, Event{Key: key, Version: st.rev, Deleted: true})
+	}
+}
+
+// the earliest expiry of any key, or 0 if none has one.
+func (st *store) nextExpiry() int64 {
+	next := int64(0)
+	for _, t := range st.ttl {
+		if next == 0 || t < next {
+			next = t
+		}
+	}
+	return next
+}
+
+// the writes since the last call.
+func (st *store) take() []Event {
+	changes := st.changes
+	st.changes = nil
+	return changes
+}
+
+//
+// up to limit keys >= start and < end, in order; an empty end
+// means no bound. if there are more, next is where to start
+// for them, and otherwise "".
+//
+func (st *store) scan(start string, end string, limit int) ([]KeyValue, string) {
+	var kvs []KeyValue
+	for x := st.index.seek(start); x != nil && (end == "" || x.key < end); x = x.next[0] {
+		if x.entry.expired(st.now) {
+			continue
+		}
+		if len(kvs) == limit {
+			return kvs, x.key
+		}
+		kvs = append(kvs, KeyValue{x.key, x.entry.Value, x.entry.Version})
+	}
+	return kvs, ""
+}
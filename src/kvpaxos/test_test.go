@@ -1,6 +1,7 @@
 package kvpaxos
 
 import (
+  "context"
   "fmt"
   "math/rand"
   "runtime"
@@ -9,6 +10,8 @@ import (
 )
 import "strconv"
 import "os"
+import "paxos"
+import "transport"
 
 func check(t *testing.T, ck *Clerk, key string, value string) {
   v := ck.Get(key)
@@ -55,13 +58,13 @@ func TestBasic(t *testing.T) {
     kvh[i] = port("basic", i)
   }
   for i := 0; i < nservers; i++ {
-    kva[i] = StartServer(kvh, i)
+    kva[i] = StartServer(kvh, i, transport.Unix{})
   }
 
-  ck := MakeClerk(kvh)
+  ck := MakeClerk(kvh, transport.Unix{})
   var cka [nservers]*Clerk
   for i := 0; i < nservers; i++ {
-    cka[i] = MakeClerk([]string{kvh[i]})
+    cka[i] = MakeClerk([]string{kvh[i]}, transport.Unix{})
   }
 
   fmt.Printf("Test: Basic put/puthash/get ...\n")
@@ -93,7 +96,7 @@ func TestBasic(t *testing.T) {
       go func(me int) {
         defer func() { ca[me] <- true }()
         ci := (rand.Int() % nservers)
-        myck := MakeClerk([]string{kvh[ci]})
+        myck := MakeClerk([]string{kvh[ci]}, transport.Unix{})
         if (rand.Int() % 1000) < 500 {
           myck.Put("b", strconv.Itoa(rand.Int()))
         } else {
@@ -130,12 +133,12 @@ func TestDone(t *testing.T) {
     kvh[i] = port("done", i)
   }
   for i := 0; i < nservers; i++ {
-    kva[i] = StartServer(kvh, i)
+    kva[i] = StartServer(kvh, i, transport.Unix{})
   }
-  ck := MakeClerk(kvh)
+  ck := MakeClerk(kvh, transport.Unix{})
   var cka [nservers]*Clerk
   for pi := 0; pi < nservers; pi++ {
-    cka[pi] = MakeClerk([]string{kvh[pi]})
+    cka[pi] = MakeClerk([]string{kvh[pi]}, transport.Unix{})
   }
 
   fmt.Printf("Test: server frees Paxos log memory...\n")
@@ -250,13 +253,13 @@ func TestPartition(t *testing.T) {
         kvh[j] = pp(tag, i, j)
       }
     }
-    kva[i] = StartServer(kvh, i)
+    kva[i] = StartServer(kvh, i, transport.Unix{})
   }
   defer part(t, tag, nservers, []int{}, []int{}, []int{})
 
   var cka [nservers]*Clerk
   for i := 0; i < nservers; i++ {
-    cka[i] = MakeClerk([]string{port(tag, i)})
+    cka[i] = MakeClerk([]string{port(tag, i)}, transport.Unix{})
   }
 
   fmt.Printf("Test: No partition ...\n")
@@ -348,14 +351,14 @@ func TestUnreliable(t *testing.T) {
     kvh[i] = port("un", i)
   }
   for i := 0; i < nservers; i++ {
-    kva[i] = StartServer(kvh, i)
+    kva[i] = StartServer(kvh, i, transport.Unix{})
     kva[i].unreliable = true
   }
 
-  ck := MakeClerk(kvh)
+  ck := MakeClerk(kvh, transport.Unix{})
   var cka [nservers]*Clerk
   for i := 0; i < nservers; i++ {
-    cka[i] = MakeClerk([]string{kvh[i]})
+    cka[i] = MakeClerk([]string{kvh[i]}, transport.Unix{})
   }
 
   fmt.Printf("Test: Basic put/get, unreliable ...\n")
@@ -387,7 +390,7 @@ func TestUnreliable(t *testing.T) {
           j := rand.Intn(i+1)
           sa[i], sa[j] = sa[j], sa[i]
         }
-        myck := MakeClerk(sa)
+        myck := MakeClerk(sa, transport.Unix{})
         key := strconv.Itoa(me)
         pv := myck.Get(key)
         ov := myck.PutHash(key, "0")
@@ -440,7 +443,7 @@ func TestUnreliable(t *testing.T) {
           j := rand.Intn(i+1)
           sa[i], sa[j] = sa[j], sa[i]
         }
-        myck := MakeClerk(sa)
+        myck := MakeClerk(sa, transport.Unix{})
         if (rand.Int() % 1000) < 500 {
           myck.Put("b", strconv.Itoa(rand.Int()))
         } else {
@@ -489,14 +492,14 @@ func TestHole(t *testing.T) {
         kvh[j] = pp(tag, i, j)
       }
     }
-    kva[i] = StartServer(kvh, i)
+    kva[i] = StartServer(kvh, i, transport.Unix{})
   }
   defer part(t, tag, nservers, []int{}, []int{}, []int{})
 
   for iters := 0; iters < 5; iters++ {
     part(t, tag, nservers, []int{0,1,2,3,4}, []int{}, []int{})
 
-    ck2 := MakeClerk([]string{port(tag, 2)})
+    ck2 := MakeClerk([]string{port(tag, 2)}, transport.Unix{})
     ck2.Put("q", "q")
 
     done := false
@@ -509,7 +512,7 @@ func TestHole(t *testing.T) {
         defer func() { ca[cli] <- ok }()
         var cka [nservers]*Clerk
         for i := 0; i < nservers; i++ {
-          cka[i] = MakeClerk([]string{port(tag, i)})
+          cka[i] = MakeClerk([]string{port(tag, i)}, transport.Unix{})
         }
         key := strconv.Itoa(cli)
         last := ""
@@ -583,7 +586,7 @@ func TestManyPartition(t *testing.T) {
         kvh[j] = pp(tag, i, j)
       }
     }
-    kva[i] = StartServer(kvh, i)
+    kva[i] = StartServer(kvh, i, transport.Unix{})
     kva[i].unreliable = true
   }
   defer part(t, tag, nservers, []int{}, []int{}, []int{})
@@ -629,7 +632,7 @@ func TestManyPartition(t *testing.T) {
         j := rand.Intn(i+1)
         sa[i], sa[j] = sa[j], sa[i]
       }
-      myck := MakeClerk(sa)
+      myck := MakeClerk(sa, transport.Unix{})
       key := strconv.Itoa(cli)
       last := ""
       myck.Put(key, last)
@@ -683,3 +686,898 @@ func TestManyPartition(t *testing.T) {
 
 
 
+
+func TestFailover(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "failover"
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  defer cleanup(kva)
+  defer cleanpp(tag, nservers)
+
+  for i := 0; i < nservers; i++ {
+    var kvh []string = make([]string, nservers)
+    for j := 0; j < nservers; j++ {
+      if j == i {
+        kvh[j] = port(tag, i)
+      } else {
+        kvh[j] = pp(tag, i, j)
+      }
+    }
+    kva[i] = StartServer(kvh, i, transport.Unix{})
+  }
+  defer part(t, tag, nservers, []int{}, []int{}, []int{})
+
+  var kvh []string = make([]string, nservers)
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port(tag, i)
+  }
+  ck := MakeClerk(kvh, transport.Unix{})
+
+  fmt.Printf("Test: Clerk leaves a server cut off from the majority ...\n")
+
+  part(t, tag, nservers, []int{0,1,2}, []int{}, []int{})
+  ck.Put("a", "1")
+
+  part(t, tag, nservers, []int{0}, []int{1,2}, []int{})
+  done := make(chan bool)
+  go func() {
+    ck.Put("a", "2")
+    done <- true
+  }()
+  select {
+  case <-done:
+  case <-time.After(10 * time.Second):
+    t.Fatalf("Put stuck at the minority server")
+  }
+  if ck.leader == 0 {
+    t.Fatalf("Clerk went back to the minority server")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Clerk sticks with a server that answers ...\n")
+
+  leader := ck.leader
+  for i := 0; i < 10; i++ {
+    ck.Put("a", strconv.Itoa(i))
+    check(t, ck, "a", strconv.Itoa(i))
+  }
+  if ck.leader != leader {
+    t.Fatalf("Clerk moved from server %v to %v", leader, ck.leader)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestReconfigure(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers + 1)
+  var kvh []string = make([]string, nservers + 1)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers + 1; i++ {
+    kvh[i] = port("reconfig", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh[:nservers], i, transport.Unix{})
+  }
+
+  fmt.Printf("Test: Replace a dead server ...\n")
+
+  ck := MakeClerk(kvh[:nservers], transport.Unix{})
+  ck.Put("a", "1")
+
+  kva[2].kill()
+  kva[2] = nil
+  newh := []string{kvh[0], kvh[1], kvh[3]}
+  ck.Reconfigure(newh)
+  kva[3] = StartServer(newh, 2, transport.Unix{})
+
+  // get the change into effect.
+  ck1 := MakeClerk(newh, transport.Unix{})
+  for i := 0; i < 2 * paxos.Alpha; i++ {
+    ck1.Put("k" + strconv.Itoa(i), strconv.Itoa(i))
+  }
+
+  // the old set has no majority left, but the new one does.
+  kva[1].kill()
+  kva[1] = nil
+  ck2 := MakeClerk([]string{kvh[3]}, transport.Unix{})
+  done := make(chan bool)
+  go func() {
+    ck2.Put("b", "2")
+    done <- true
+  }()
+  select {
+  case <-done:
+  case <-time.After(10 * time.Second):
+    t.Fatalf("Put stuck after the dead server was replaced")
+  }
+  check(t, ck2, "a", "1")
+  check(t, ck2, "b", "2")
+  for i := 0; i < 2 * paxos.Alpha; i++ {
+    check(t, ck2, "k" + strconv.Itoa(i), strconv.Itoa(i))
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestLeaseRead(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("lease", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, transport.Unix{})
+  }
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{kvh[i]}, transport.Unix{})
+  }
+
+  fmt.Printf("Test: Leader serves Gets without log entries ...\n")
+
+  cka[0].Put("a", "x")
+  leader := -1
+  for i := 0; i < nservers; i++ {
+    if _, ok := kva[i].px.LeaseRead(); ok {
+      leader = i
+    }
+  }
+  if leader < 0 {
+    t.Fatalf("no server holds a lease")
+  }
+
+  max := kva[leader].px.Max()
+  for i := 0; i < 20; i++ {
+    check(t, cka[leader], "a", "x")
+  }
+  if kva[leader].px.Max() != max {
+    t.Fatalf("Gets at the leader used log entries %v..%v", max + 1, kva[leader].px.Max())
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Leader's Gets see Puts made elsewhere ...\n")
+
+  other := (leader + 1) % nservers
+  for i := 0; i < 20; i++ {
+    v := strconv.Itoa(i)
+    cka[other].Put("a", v)
+    check(t, cka[leader], "a", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Lease reads keep the session alive ...\n")
+
+  defer func(d time.Duration) { SessionTimeout = d }(SessionTimeout)
+  SessionTimeout = 500 * time.Millisecond
+
+  cka[leader].Put("b", "x")
+  id := cka[leader].id
+  for start := time.Now(); time.Since(start) < 3 * SessionTimeout; {
+    check(t, cka[leader], "b", "x")
+    time.Sleep(10 * time.Millisecond)
+  }
+  cka[leader].Put("b", "y")
+  if cka[leader].id != id {
+    t.Fatalf("a session that only read expired")
+  }
+  check(t, cka[leader], "b", "y")
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestBatching(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("batch", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, transport.Unix{})
+  }
+
+  fmt.Printf("Test: Concurrent Puts share instances ...\n")
+
+  const nclients = 100
+  var ca [nclients]chan bool
+  for i := 0; i < nclients; i++ {
+    ca[i] = make(chan bool)
+    go func(me int) {
+      ck := MakeClerk([]string{kvh[me % nservers]}, transport.Unix{})
+      ck.Put(strconv.Itoa(me), strconv.Itoa(me))
+      ca[me] <- true
+    }(i)
+  }
+  for i := 0; i < nclients; i++ {
+    <- ca[i]
+  }
+
+  if n := kva[0].px.Max(); n >= nclients / 2 {
+    t.Fatalf("%v Puts took %v instances", nclients, n)
+  }
+  ck := MakeClerk(kvh, transport.Unix{})
+  for i := 0; i < nclients; i++ {
+    check(t, ck, strconv.Itoa(i), strconv.Itoa(i))
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSessions(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("session", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, transport.Unix{})
+  }
+
+  nsessions := func(i int) int {
+    kva[i].mu.Lock()
+    defer kva[i].mu.Unlock()
+    return len(kva[i].sessions)
+  }
+
+  fmt.Printf("Test: Each op executes once in its session ...\n")
+
+  ck := MakeClerk(kvh, transport.Unix{})
+  ck.Put("a", "x")
+  args := &PutArgs{Key: "a", Value: "y", DoHash: true}
+  ck.lock(context.Background())
+  args.ClientId, args.Seq, _ = ck.next(context.Background())
+  ck.unlock()
+  var r1, r2 PutReply
+  kva[0].Put(args, &r1)
+  kva[1].Put(args, &r2)
+  // each server names the leader it knows of; only a hint.
+  r1.Leader, r2.Leader = "", ""
+  if r1.Err != "" || r1.PreviousValue != "x" || r2 != r1 {
+    t.Fatalf("a repeated PutHash returned %v and %v", r1, r2)
+  }
+  check(t, ck, "a", NextValue("x", "y"))
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Closed sessions are forgotten ...\n")
+
+  for i := 0; i < 20; i++ {
+    ck1 := MakeClerk(kvh, transport.Unix{})
+    ck1.Put("b", strconv.Itoa(i))
+    ck1.Close()
+  }
+  ck.Put("c", "x")
+  if n := nsessions(0); n != 1 {
+    t.Fatalf("%v sessions left, expected 1", n)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Idle sessions expire by log time ...\n")
+
+  defer func(d time.Duration) { SessionTimeout = d }(SessionTimeout)
+  SessionTimeout = 500 * time.Millisecond
+
+  idle := MakeClerk(kvh, transport.Unix{})
+  idle.Put("d", "1")
+  busy := MakeClerk(kvh, transport.Unix{})
+  kept := MakeClerk(kvh, transport.Unix{})
+  kept.Put("e", "1")
+  for i := 0; i < 10; i++ {
+    busy.Put("f", strconv.Itoa(i))
+    kept.KeepAlive()
+    time.Sleep(100 * time.Millisecond)
+  }
+  for i := 0; i < nservers; i++ {
+    // once server i has applied this, it has applied the above.
+    MakeClerk([]string{kvh[i]}, transport.Unix{}).Put("g", "x")
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i].mu.Lock()
+    _, idleOk := kva[i].sessions[idle.id]
+    _, keptOk := kva[i].sessions[kept.id]
+    kva[i].mu.Unlock()
+    if idleOk || !keptOk {
+      t.Fatalf("server %v: idle session kept %v, kept session kept %v", i, idleOk, keptOk)
+    }
+  }
+
+  // the idle clerk just gets a new session.
+  old := idle.id
+  idle.Put("d", "2")
+  if idle.id == old {
+    t.Fatalf("expired session still in use")
+  }
+  check(t, idle, "d", "2")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Writes that may have happened aren't repeated ...\n")
+
+  // the first server never answers, so an attempt there may
+  // have taken effect for all the Clerk knows.
+  lost := MakeClerk(append([]string{port("session", nservers)}, kvh...), transport.Unix{})
+  lost.Put("h", "1")
+  for i := 0; i < 10; i++ {
+    busy.Put("f", strconv.Itoa(i))
+    time.Sleep(100 * time.Millisecond)
+  }
+  lost.leader = 0
+  if _, err := lost.PutHashCtx(context.Background(), "h", "2"); err != ErrSessionLost {
+    t.Fatalf("PutHash in an expired session returned %v, expected ErrSessionLost", err)
+  }
+  check(t, lost, "h", "1")
+
+  // but a Get just tries again.
+  for i := 0; i < 10; i++ {
+    busy.Put("f", strconv.Itoa(i))
+    time.Sleep(100 * time.Millisecond)
+  }
+  lost.leader = 0
+  check(t, lost, "h", "1")
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestOps(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("ops", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, transport.Unix{})
+  }
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{kvh[i]}, transport.Unix{})
+  }
+
+  fmt.Printf("Test: Append, Delete and CAS ...\n")
+
+  cka[0].Append("a", "x")
+  cka[1].Append("a", "y")
+  check(t, cka[2], "a", "xy")
+
+  cka[0].Delete("a")
+  check(t, cka[1], "a", "")
+  args := &GetArgs{Key: "a"}
+  cka[2].lock(context.Background())
+  args.ClientId, args.Seq, _ = cka[2].next(context.Background())
+  cka[2].unlock()
+  reply := GetReply{}
+  kva[2].Get(args, &reply)
+  if reply.Err != ErrNoKey {
+    t.Fatalf("Get after Delete returned %v, expected ErrNoKey", reply.Err)
+  }
+
+  if !cka[0].CAS("a", "", "1") {
+    t.Fatalf("CAS on a missing key failed")
+  }
+  if cka[1].CAS("a", "0", "2") {
+    t.Fatalf("CAS with the wrong value succeeded")
+  }
+  if !cka[2].CAS("a", "1", "2") {
+    t.Fatalf("CAS with the right value failed")
+  }
+  check(t, cka[0], "a", "2")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent CAS increments ...\n")
+
+  const nclients = 5
+  const nincr = 10
+  var ca [nclients]chan bool
+  for i := 0; i < nclients; i++ {
+    ca[i] = make(chan bool)
+    go func(me int) {
+      ck := MakeClerk(kvh, transport.Unix{})
+      for n := 0; n < nincr; {
+        v := ck.Get("n")
+        x, _ := strconv.Atoi(v)
+        if ck.CAS("n", v, strconv.Itoa(x + 1)) {
+          n++
+        }
+      }
+      ca[me] <- true
+    }(i)
+  }
+  for i := 0; i < nclients; i++ {
+    <- ca[i]
+  }
+  check(t, cka[0], "n", strconv.Itoa(nclients * nincr))
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestTxn(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("txn", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, transport.Unix{})
+  }
+  ck := MakeClerk(kvh, transport.Unix{})
+
+  fmt.Printf("Test: Txn applies all writes or none ...\n")
+
+  res, ok := ck.Txn([]TxnOp{{PUT, "a", "1"}, {PUT, "b", "2"}, {GET, "a", ""}},
+    []Cond{{Type: IfAbsent, Key: "a"}})
+  if !ok || res[2].Value != "1" {
+    t.Fatalf("Txn returned %v %v", res, ok)
+  }
+
+  res, ok = ck.Txn([]TxnOp{{PUT, "a", "x"}, {DELETE, "b", ""}, {GET, "b", ""}},
+    []Cond{{Type: IfEquals, Key: "a", Value: "1"}, {Type: IfAbsent, Key: "b"}})
+  if ok || res[2].Value != "2" {
+    t.Fatalf("Txn with a failed Cond returned %v %v", res, ok)
+  }
+  check(t, ck, "a", "1")
+  check(t, ck, "b", "2")
+
+  res, _ = ck.Txn([]TxnOp{{GET, "a", ""}, {GET, "c", ""}}, nil)
+  if res[0].Version == 0 || res[1].Err != ErrNoKey || res[1].Version != 0 {
+    t.Fatalf("Txn reads returned %v", res)
+  }
+  _, ok = ck.Txn([]TxnOp{{APPEND, "a", "1"}}, []Cond{{Type: IfVersion, Key: "a", Version: res[0].Version}})
+  if !ok {
+    t.Fatalf("Txn with the right version failed")
+  }
+  _, ok = ck.Txn([]TxnOp{{APPEND, "a", "1"}}, []Cond{{Type: IfVersion, Key: "a", Version: res[0].Version}})
+  if ok {
+    t.Fatalf("Txn with an old version succeeded")
+  }
+  check(t, ck, "a", "11")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent transfers keep the total ...\n")
+
+  const nclients = 5
+  const ntransfers = 10
+  ck.Put("x", "100")
+  ck.Put("y", "100")
+  var ca [nclients]chan bool
+  for i := 0; i < nclients; i++ {
+    ca[i] = make(chan bool)
+    go func(me int) {
+      myck := MakeClerk([]string{kvh[me % nservers]}, transport.Unix{})
+      from, to := "x", "y"
+      if me % 2 == 1 {
+        from, to = to, from
+      }
+      for n := 0; n < ntransfers; {
+        res, _ := myck.Txn([]TxnOp{{GET, from, ""}, {GET, to, ""}}, nil)
+        a, _ := strconv.Atoi(res[0].Value)
+        b, _ := strconv.Atoi(res[1].Value)
+        _, ok := myck.Txn([]TxnOp{{PUT, from, strconv.Itoa(a - 1)}, {PUT, to, strconv.Itoa(b + 1)}},
+          []Cond{{Type: IfVersion, Key: from, Version: res[0].Version},
+            {Type: IfVersion, Key: to, Version: res[1].Version}})
+        if ok {
+          n++
+        }
+      }
+      ca[me] <- true
+    }(i)
+  }
+  for i := 0; i < nclients; i++ {
+    <- ca[i]
+  }
+  x, _ := strconv.Atoi(ck.Get("x"))
+  y, _ := strconv.Atoi(ck.Get("y"))
+  // three clients moved x to y, and two moved it back.
+  if x + y != 200 || x != 100 - ntransfers {
+    t.Fatalf("x %v y %v after transfers", x, y)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestScan(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("scan", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, transport.Unix{})
+  }
+  ck := MakeClerk(kvh, transport.Unix{})
+
+  fmt.Printf("Test: Scan a prefix in pages ...\n")
+
+  const nkeys = 50
+  for _, i := range rand.Perm(nkeys) {
+    ck.Put(fmt.Sprintf("t1/%03d", i), strconv.Itoa(i))
+  }
+  ck.Put("t0/x", "x")
+  ck.Put("t2/x", "x")
+  ck.Delete("t1/007")
+
+  var got []KeyValue
+  start := "t1/"
+  for pages := 0; start != ""; pages++ {
+    if pages > nkeys {
+      t.Fatalf("Scan never ends")
+    }
+    var kvs []KeyValue
+    kvs, start = ck.Scan(start, PrefixEnd("t1/"), 7)
+    if len(kvs) > 7 {
+      t.Fatalf("Scan returned %v pairs, limit was 7", len(kvs))
+    }
+    got = append(got, kvs...)
+  }
+  i := 0
+  for _, kv := range got {
+    if i == 7 {
+      i++
+    }
+    if kv.Key != fmt.Sprintf("t1/%03d", i) || kv.Value != strconv.Itoa(i) {
+      t.Fatalf("Scan returned %v, expected t1/%03d", kv, i)
+    }
+    i++
+  }
+  if i != nkeys {
+    t.Fatalf("Scan returned %v keys, expected %v", len(got), nkeys - 1)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Scan sees the latest Put at every server ...\n")
+
+  for i := 0; i < nservers; i++ {
+    myck := MakeClerk([]string{kvh[i]}, transport.Unix{})
+    ck.Put("t1/999", strconv.Itoa(i))
+    kvs, _ := myck.Scan("t1/999", "", 1)
+    if len(kvs) != 1 || kvs[0].Value != strconv.Itoa(i) {
+      t.Fatalf("server %v: Scan returned %v", i, kvs)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestWatch(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("watch", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, transport.Unix{})
+  }
+  ck := MakeClerk(kvh, transport.Unix{})
+
+  next := func(events <-chan Event) Event {
+    select {
+    case e := <-events:
+      return e
+    case <-time.After(5 * time.Second):
+      t.Fatalf("no Event from Watch")
+    }
+    return Event{}
+  }
+
+  fmt.Printf("Test: Watch a prefix ...\n")
+
+  ctx, cancel := context.WithCancel(context.Background())
+  events := ck.Watch(ctx, "w/", true, -1)
+  time.Sleep(100 * time.Millisecond)
+
+  ck.Put("w/a", "1")
+  ck.Put("x", "1")
+  ck.Append("w/a", "2")
+  ck.Delete("w/a")
+  ck.Txn([]TxnOp{{PUT, "w/b", "3"}, {PUT, "y", "3"}}, nil)
+
+  expected := []Event{
+    {Key: "w/a", Value: "1"},
+    {Key: "w/a", Value: "12"},
+    {Key: "w/a", Deleted: true},
+    {Key: "w/b", Value: "3"},
+  }
+  var got []Event
+  for i, x := range expected {
+    e := next(events)
+    if e.Key != x.Key || e.Value != x.Value || e.Deleted != x.Deleted {
+      t.Fatalf("Watch sent %v, expected %v", e, x)
+    }
+    if i > 0 && e.Seq <= got[i-1].Seq {
+      t.Fatalf("Watch sent seq %v after %v", e.Seq, got[i-1].Seq)
+    }
+    got = append(got, e)
+  }
+  cancel()
+  for range events {
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Watch resumes at another server ...\n")
+
+  for i := 0; i < nservers; i++ {
+    myck := MakeClerk([]string{kvh[i]}, transport.Unix{})
+    ctx, cancel := context.WithCancel(context.Background())
+    events := myck.Watch(ctx, "w/a", false, got[1].Seq + 1)
+    e := next(events)
+    if e.Seq != got[2].Seq || !e.Deleted {
+      t.Fatalf("server %v: Watch sent %v, expected %v", i, e, got[2])
+    }
+    cancel()
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Watch reports changes a server forgot ...\n")
+
+  kva[0].mu.Lock()
+  kva[0].forgetHistory(kva[0].committedSeq + 1)
+  kva[0].mu.Unlock()
+
+  myck := MakeClerk([]string{kvh[0]}, transport.Unix{})
+  ctx, cancel = context.WithCancel(context.Background())
+  defer cancel()
+  events = myck.Watch(ctx, "w/", true, 0)
+  if e := next(events); !e.Lost {
+    t.Fatalf("Watch sent %v, expected a Lost Event", e)
+  }
+  ck.Put("w/c", "4")
+  if e := next(events); e.Key != "w/c" || e.Value != "4" {
+    t.Fatalf("Watch sent %v after the Lost Event", e)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestTTL(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("ttl", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, transport.Unix{})
+  }
+  ck := MakeClerk(kvh, transport.Unix{})
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{kvh[i]}, transport.Unix{})
+  }
+
+  fmt.Printf("Test: keys expire after their TTL ...\n")
+
+  ck.PutWithTTL("a", "x", 500 * time.Millisecond)
+  ck.Append("a", "y")
+  ck.PutWithTTL("b", "x", 500 * time.Millisecond)
+  ck.Put("b", "y")
+  ck.Put("c", "z")
+  for i := 0; i < nservers; i++ {
+    check(t, cka[i], "a", "xy")
+  }
+
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  events := ck.Watch(ctx, "a", false, -1)
+
+  time.Sleep(600 * time.Millisecond)
+  for i := 0; i < nservers; i++ {
+    check(t, cka[i], "a", "")
+    check(t, cka[i], "b", "y")
+    check(t, cka[i], "c", "z")
+  }
+  if ck.CAS("a", "xy", "w") {
+    t.Fatalf("CAS matched an expired key")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: every server removes expired keys at the same seq ...\n")
+
+  var e Event
+  select {
+  case e = <-events:
+  case <-time.After(5 * time.Second):
+    t.Fatalf("no Event for the expired key")
+  }
+  if e.Key != "a" || !e.Deleted {
+    t.Fatalf("Watch sent %v, expected a's deletion", e)
+  }
+  for i := 0; i < nservers; i++ {
+    for iters := 0; ; iters++ {
+      kva[i].mu.Lock()
+      _, there := kva[i].db.index.get("a")
+      done := kva[i].committedSeq >= e.Seq
+      kva[i].mu.Unlock()
+      if done {
+        if there {
+          t.Fatalf("server %v still has the expired key", i)
+        }
+        break
+      }
+      if iters > 50 {
+        t.Fatalf("server %v never got to seq %v", i, e.Seq)
+      }
+      time.Sleep(100 * time.Millisecond)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestContext(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("ctx", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, transport.Unix{})
+  }
+  ck := MakeClerk(kvh, transport.Unix{})
+  bg := context.Background()
+
+  fmt.Printf("Test: Ctx calls report missing keys ...\n")
+
+  if _, err := ck.GetCtx(bg, "a"); err != ErrNotFound {
+    t.Fatalf("GetCtx of a missing key returned %v", err)
+  }
+  if err := ck.PutCtx(bg, "a", "x"); err != nil {
+    t.Fatalf("PutCtx returned %v", err)
+  }
+  if v, err := ck.GetCtx(bg, "a"); v != "x" || err != nil {
+    t.Fatalf("GetCtx returned %v, %v", v, err)
+  }
+  if err := ck.DeleteCtx(bg, "a"); err != nil {
+    t.Fatalf("DeleteCtx returned %v", err)
+  }
+  if err := ck.DeleteCtx(bg, "a"); err != ErrNotFound {
+    t.Fatalf("DeleteCtx of a missing key returned %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Ctx calls give up at the deadline ...\n")
+
+  nobody := MakeClerk([]string{port("ctx-nobody", 0)}, transport.Unix{})
+  ctx, cancel := context.WithTimeout(bg, 200 * time.Millisecond)
+  defer cancel()
+  t0 := time.Now()
+  if _, err := nobody.GetCtx(ctx, "a"); err != context.DeadlineExceeded {
+    t.Fatalf("GetCtx with no servers returned %v", err)
+  }
+  if d := time.Since(t0); d > time.Second {
+    t.Fatalf("GetCtx took %v, deadline was 200ms", d)
+  }
+
+  // the last server can't get anything agreed on.
+  kva[1].kill()
+  kva[2].kill()
+  lone := MakeClerk(kvh[:1], transport.Unix{})
+
+  t0 = time.Now()
+  ctx1, cancel1 := context.WithTimeout(bg, 1500 * time.Millisecond)
+  defer cancel1()
+  done := make(chan error)
+  go func() {
+    done <- lone.PutCtx(ctx1, "a", "y")
+  }()
+  time.Sleep(100 * time.Millisecond)
+  ctx2, cancel2 := context.WithTimeout(bg, 200 * time.Millisecond)
+  defer cancel2()
+  if _, err := lone.GetCtx(ctx2, "a"); err != context.DeadlineExceeded {
+    t.Fatalf("GetCtx behind a stuck op returned %v", err)
+  }
+  if err := <-done; err != context.DeadlineExceeded {
+    t.Fatalf("PutCtx without a majority returned %v", err)
+  }
+  if d := time.Since(t0); d > 3 * time.Second {
+    t.Fatalf("PutCtx took %v, deadline was 1.5s", d)
+  }
+
+  ctx3, cancel3 := context.WithCancel(bg)
+  go func() {
+    time.Sleep(100 * time.Millisecond)
+    cancel3()
+  }()
+  if err := lone.AppendCtx(ctx3, "a", "z"); err != context.Canceled {
+    t.Fatalf("cancelled AppendCtx returned %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSkiplist(t *testing.T) {
+  fmt.Printf("Test: Skiplist agrees with a map ...\n")
+
+  l := makeSkiplist()
+  m := make(map[string]int64)
+  for i := 0; i < 5000; i++ {
+    k := strconv.Itoa(rand.Int() % 500)
+    if rand.Int() % 3 == 0 {
+      _, ok := m[k]
+      if l.remove(k) != ok {
+        t.Fatalf("remove(%v) disagrees with the map", k)
+      }
+      delete(m, k)
+    } else {
+      l.set(k, Entry{Value: k, Version: int64(i)})
+      m[k] = int64(i)
+    }
+  }
+  if l.n != len(m) {
+    t.Fatalf("skiplist has %v keys, map %v", l.n, len(m))
+  }
+  prev := ""
+  n := 0
+  for x := l.seek(""); x != nil; x = x.next[0] {
+    if n > 0 && x.key <= prev {
+      t.Fatalf("%v after %v", x.key, prev)
+    }
+    if e, ok := l.get(x.key); !ok || e.Version != m[x.key] {
+      t.Fatalf("get(%v) returned %v, expected %v", x.key, e, m[x.key])
+    }
+    prev = x.key
+    n++
+  }
+  if n != len(m) {
+    t.Fatalf("walked %v keys, expected %v", n, len(m))
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
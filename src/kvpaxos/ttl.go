@@ -0,0 +1,44 @@
+package kvpaxos
+
+//
+// keys that expire.
+//
+// a key Put with a TTL expires at the log's time (see session.go)
+// when the Put is applied, plus the TTL, so every server gives it
+// the same expiry. ops from the log treat the key as missing once
+// the log's time passes that, and Gets and Scans as soon as the
+// server's own clock does. but the key stays in the store until
+// the leader sees it has expired and proposes an EXPIRE op, which
+// takes out every key that expires by the leader's clock at the
+// same point in the log at every server.
+//
+
+import "time"
+
+// how often the leader looks for expired keys.
+const expireInterval = 100 * time.Millisecond
+
+func (kv *KVPaxos) expirer() {
+	for !kv.dead {
+		time.Sleep(expireInterval)
+		now := time.Now().UnixNano()
+		kv.mu.Lock()
+		next := kv.db.nextExpiry()
+		kv.mu.Unlock()
+		if next != 0 && next <= now && kv.px.IsLeader() {
+			kv.submit(Op{Type: EXPIRE, Until: now})
+		}
+	}
+}
+
+//
+// the expiry for a key written now with a TTL of ttl nanoseconds,
+// or 0 if ttl is 0.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) expiry(ttl int64) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return kv.logTime + ttl
+}
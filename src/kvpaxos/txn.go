@@ -0,0 +1,78 @@
+package kvpaxos
+
+//
+// multi-key transactions.
+//
+// a Txn is one Op, so it goes into the log whole and every server
+// applies it at the same point, between the same other ops. that
+// makes it atomic and isolated without any locks. if every Cond
+// holds, its ops are applied in order, so a GET sees the writes
+// before it; if any Cond fails, only the GETs run, none of the
+// writes, and the reply says ErrMismatch.
+//
+
+func (kv *KVPaxos) Txn(args *TxnArgs, reply *TxnReply) error {
+	for _, t := range args.Ops {
+		switch t.Type {
+		case GET, PUT, APPEND, DELETE:
+		default:
+			reply.Err = ErrBadOp
+			return nil
+		}
+	}
+	op := Op{
+		Seq:      args.Seq,
+		ClientID: args.ClientId,
+		Type:     TXN,
+		Txn:      args.Ops,
+		Conds:    args.Conds,
+	}
+	r, ok := kv.submit(op)
+	if !ok {
+		return errKilled
+	}
+	reply.Err = r.err
+	reply.Leader = kv.px.Leader()
+	reply.Results = r.reads
+	return nil
+}
+
+// caller must hold kv.mu.
+func (kv *KVPaxos) holds(c Cond) bool {
+	e, ok := kv.db.get(c.Key)
+	switch c.Type {
+	case IfEquals:
+		return ok && e.Value == c.Value
+	case IfAbsent:
+		return !ok
+	case IfVersion:
+		return e.Version == c.Version
+	}
+	return false
+}
+
+//
+// apply a TXN from the log.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) executeTxn(op Op) (Err, []TxnResult) {
+	var err Err
+	for _, c := range op.Conds {
+		if !kv.holds(c) {
+			err = ErrMismatch
+		}
+	}
+	results := make([]TxnResult, len(op.Txn))
+	for i, t := range op.Txn {
+		if t.Type == GET {
+			e, ok := kv.db.get(t.Key)
+			if !ok {
+				results[i].Err = ErrNoKey
+			}
+			results[i].Value, results[i].Version = e.Value, e.Version
+		} else if err == "" {
+			results[i].Err, _ = kv.executeLog(Op{Type: t.Type, Key: t.Key, Value: t.Value})
+		}
+	}
+	return err, results
+}
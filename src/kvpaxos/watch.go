@@ -0,0 +1,123 @@
+package kvpaxos
+
+//
+// watching keys for changes.
+//
+// as it applies each instance, a server adds the changes the
+// instance made to a history of the last maxHistory bytes or so. a Watch
+// RPC is a long poll: it returns the matching changes in instances
+// >= FromSeq as soon as there are any, or none after watchTimeout,
+// and in either case the FromSeq to ask for next time. every server
+// applies the same instances, so a client can take Next from one
+// server to any other; a server that's behind waits until it has
+// caught up. a server that has dropped the changes asked for (or
+// got past them with a snapshot) says ErrCompacted.
+//
+
+import "strings"
+import "time"
+
+// roughly how many bytes of keys and values a server remembers.
+const maxHistory = 1 << 20
+
+// how long a Watch RPC waits for a change.
+const watchTimeout = 1 * time.Second
+
+func (kv *KVPaxos) Watch(args *WatchArgs, reply *WatchReply) error {
+	expired := false
+	timer := time.AfterFunc(watchTimeout, func() {
+		kv.mu.Lock()
+		expired = true
+		kv.changed.Broadcast()
+		kv.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	from := args.FromSeq
+	if from < 0 {
+		from = kv.committedSeq + 1
+	}
+	for !kv.dead {
+		if from < kv.historyFrom {
+			reply.Err = ErrCompacted
+			reply.Next = kv.committedSeq + 1
+			return nil
+		}
+		reply.Events = kv.changesSince(from, args.Key, args.Prefix)
+		if len(reply.Events) > 0 || expired {
+			reply.Next = from
+			if kv.committedSeq+1 > from {
+				reply.Next = kv.committedSeq + 1
+			}
+			return nil
+		}
+		kv.changed.Wait()
+	}
+	return errKilled
+}
+
+//
+// the changes in history to key, or to keys under prefix key,
+// in instances >= from.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) changesSince(from int, key string, prefix bool) []Event {
+	var events []Event
+	// history is in seq order; find the first change >= from.
+	lo, hi := 0, len(kv.history)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if kv.history[mid].Seq < from {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	for _, e := range kv.history[lo:] {
+		if e.Key == key || (prefix && strings.HasPrefix(e.Key, key)) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+//
+// add the changes instance seq made to the history, and drop the
+// oldest half once it gets too big.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) record(seq int) {
+	for _, e := range kv.db.take() {
+		e.Seq = seq
+		kv.history = append(kv.history, e)
+		kv.historySize += len(e.Key) + len(e.Value)
+	}
+	if kv.historySize <= maxHistory {
+		return
+	}
+	// keep all of an instance's changes or none.
+	cut := 0
+	for cut < len(kv.history) &&
+		(kv.historySize > maxHistory/2 || kv.history[cut].Seq == kv.history[cut-1].Seq) {
+		kv.historySize -= len(kv.history[cut].Key) + len(kv.history[cut].Value)
+		cut++
+	}
+	kv.historyFrom = seq + 1
+	if cut < len(kv.history) {
+		kv.historyFrom = kv.history[cut].Seq
+	}
+	kv.history = append([]Event(nil), kv.history[cut:]...)
+}
+
+//
+// we no longer know what changed before instance from.
+// caller must hold kv.mu.
+//
+func (kv *KVPaxos) forgetHistory(from int) {
+	kv.db.take()
+	kv.history = nil
+	kv.historySize = 0
+	kv.historyFrom = from
+}
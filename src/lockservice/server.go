@@ -5,9 +5,9 @@ import "net/rpc"
 import "log"
 import "sync"
 import "fmt"
-import "os"
 import "io"
 import "time"
+import "transport"
 
 type LockServer struct {
   mu sync.Mutex
@@ -85,7 +85,8 @@ func (dc DeafConn) Read(p []byte) (n int, err error) {
   return dc.c.Read(p)
 }
 
-func StartServer(primary string, backup string, am_primary bool) *LockServer {
+func StartServer(primary string, backup string, am_primary bool,
+                 t transport.Transport) *LockServer {
   ls := new(LockServer)
   ls.backup = backup
   ls.am_primary = am_primary
@@ -106,9 +107,7 @@ func StartServer(primary string, backup string, am_primary bool) *LockServer {
   rpcs.Register(ls)
 
   // prepare to receive connections from clients.
-  // change "unix" to "tcp" to use over a network.
-  os.Remove(me) // only needed for "unix"
-  l, e := net.Listen("unix", me);
+  l, e := t.Listen(me);
   if e != nil {
     log.Fatal("listen error: ", e);
   }
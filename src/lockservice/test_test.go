@@ -7,6 +7,7 @@ import "os"
 import "strconv"
 import "time"
 import "fmt"
+import "transport"
 
 func tl(t *testing.T, ck *Clerk, lockname string, expected bool) {
   x := ck.Lock(lockname)
@@ -43,10 +44,10 @@ func TestBasic(t *testing.T) {
 
   phost := port("p")
   bhost := port("b")
-  p := StartServer(phost, bhost, true)  // primary
-  b := StartServer(phost, bhost, false) // backup
+  p := StartServer(phost, bhost, true, transport.Unix{})  // primary
+  b := StartServer(phost, bhost, false, transport.Unix{}) // backup
 
-  ck := MakeClerk(phost, bhost)
+  ck := MakeClerk(phost, bhost, transport.Unix{})
 
   tl(t, ck, "a", true)
   tu(t, ck, "a", true)
@@ -73,10 +74,10 @@ func TestPrimaryFail1(t *testing.T) {
 
   phost := port("p")
   bhost := port("b")
-  p := StartServer(phost, bhost, true)  // primary
-  b := StartServer(phost, bhost, false) // backup
+  p := StartServer(phost, bhost, true, transport.Unix{})  // primary
+  b := StartServer(phost, bhost, false, transport.Unix{}) // backup
 
-  ck := MakeClerk(phost, bhost)
+  ck := MakeClerk(phost, bhost, transport.Unix{})
 
   tl(t, ck, "a", true)
 
@@ -112,11 +113,11 @@ func TestPrimaryFail2(t *testing.T) {
 
   phost := port("p")
   bhost := port("b")
-  p := StartServer(phost, bhost, true)  // primary
-  b := StartServer(phost, bhost, false) // backup
+  p := StartServer(phost, bhost, true, transport.Unix{})  // primary
+  b := StartServer(phost, bhost, false, transport.Unix{}) // backup
 
-  ck1 := MakeClerk(phost, bhost)
-  ck2 := MakeClerk(phost, bhost)
+  ck1 := MakeClerk(phost, bhost, transport.Unix{})
+  ck2 := MakeClerk(phost, bhost, transport.Unix{})
 
   tl(t, ck1, "a", true)
   tl(t, ck1, "b", true)
@@ -138,10 +139,10 @@ func TestPrimaryFail3(t *testing.T) {
 
   phost := port("p")
   bhost := port("b")
-  p := StartServer(phost, bhost, true)  // primary
-  b := StartServer(phost, bhost, false) // backup
+  p := StartServer(phost, bhost, true, transport.Unix{})  // primary
+  b := StartServer(phost, bhost, false, transport.Unix{}) // backup
 
-  ck1 := MakeClerk(phost, bhost)
+  ck1 := MakeClerk(phost, bhost, transport.Unix{})
 
   tl(t, ck1, "a", true)
   tl(t, ck1, "b", true)
@@ -160,11 +161,11 @@ func TestPrimaryFail4(t *testing.T) {
 
   phost := port("p")
   bhost := port("b")
-  p := StartServer(phost, bhost, true)  // primary
-  b := StartServer(phost, bhost, false) // backup
+  p := StartServer(phost, bhost, true, transport.Unix{})  // primary
+  b := StartServer(phost, bhost, false, transport.Unix{}) // backup
 
-  ck1 := MakeClerk(phost, bhost)
-  ck2 := MakeClerk(phost, bhost)
+  ck1 := MakeClerk(phost, bhost, transport.Unix{})
+  ck2 := MakeClerk(phost, bhost, transport.Unix{})
 
   tl(t, ck1, "a", true)
   tl(t, ck1, "b", true)
@@ -183,11 +184,11 @@ func TestPrimaryFail5(t *testing.T) {
 
   phost := port("p")
   bhost := port("b")
-  p := StartServer(phost, bhost, true)  // primary
-  b := StartServer(phost, bhost, false) // backup
+  p := StartServer(phost, bhost, true, transport.Unix{})  // primary
+  b := StartServer(phost, bhost, false, transport.Unix{}) // backup
 
-  ck1 := MakeClerk(phost, bhost)
-  ck2 := MakeClerk(phost, bhost)
+  ck1 := MakeClerk(phost, bhost, transport.Unix{})
+  ck2 := MakeClerk(phost, bhost, transport.Unix{})
 
   tl(t, ck1, "a", true)
   tl(t, ck1, "b", true)
@@ -208,11 +209,11 @@ func TestPrimaryFail6(t *testing.T) {
 
   phost := port("p")
   bhost := port("b")
-  p := StartServer(phost, bhost, true)  // primary
-  b := StartServer(phost, bhost, false) // backup
+  p := StartServer(phost, bhost, true, transport.Unix{})  // primary
+  b := StartServer(phost, bhost, false, transport.Unix{}) // backup
 
-  ck1 := MakeClerk(phost, bhost)
-  ck2 := MakeClerk(phost, bhost)
+  ck1 := MakeClerk(phost, bhost, transport.Unix{})
+  ck2 := MakeClerk(phost, bhost, transport.Unix{})
 
   tl(t, ck1, "a", true)
   tu(t, ck1, "a", true)
@@ -234,11 +235,11 @@ func TestPrimaryFail7(t *testing.T) {
 
   phost := port("p")
   bhost := port("b")
-  p := StartServer(phost, bhost, true)  // primary
-  b := StartServer(phost, bhost, false) // backup
+  p := StartServer(phost, bhost, true, transport.Unix{})  // primary
+  b := StartServer(phost, bhost, false, transport.Unix{}) // backup
 
-  ck1 := MakeClerk(phost, bhost)
-  ck2 := MakeClerk(phost, bhost)
+  ck1 := MakeClerk(phost, bhost, transport.Unix{})
+  ck2 := MakeClerk(phost, bhost, transport.Unix{})
 
   tl(t, ck1, "a", true)
   tu(t, ck1, "a", true)
@@ -274,11 +275,11 @@ func TestPrimaryFail8(t *testing.T) {
 
   phost := port("p")
   bhost := port("b")
-  p := StartServer(phost, bhost, true)  // primary
-  b := StartServer(phost, bhost, false) // backup
+  p := StartServer(phost, bhost, true, transport.Unix{})  // primary
+  b := StartServer(phost, bhost, false, transport.Unix{}) // backup
 
-  ck1 := MakeClerk(phost, bhost)
-  ck2 := MakeClerk(phost, bhost)
+  ck1 := MakeClerk(phost, bhost, transport.Unix{})
+  ck2 := MakeClerk(phost, bhost, transport.Unix{})
 
   tl(t, ck1, "a", true)
   tu(t, ck1, "a", true)
@@ -312,10 +313,10 @@ func TestBackupFail(t *testing.T) {
 
   phost := port("p")
   bhost := port("b")
-  p := StartServer(phost, bhost, true)  // primary
-  b := StartServer(phost, bhost, false) // backup
+  p := StartServer(phost, bhost, true, transport.Unix{})  // primary
+  b := StartServer(phost, bhost, false, transport.Unix{}) // backup
 
-  ck := MakeClerk(phost, bhost)
+  ck := MakeClerk(phost, bhost, transport.Unix{})
 
   tl(t, ck, "a", true)
 
@@ -351,8 +352,8 @@ func TestMany(t *testing.T) {
 
   phost := port("p")
   bhost := port("b")
-  p := StartServer(phost, bhost, true)  // primary
-  b := StartServer(phost, bhost, false) // backup
+  p := StartServer(phost, bhost, true, transport.Unix{})  // primary
+  b := StartServer(phost, bhost, false, transport.Unix{}) // backup
 
   const nclients = 2
   const nlocks = 10
@@ -362,7 +363,7 @@ func TestMany(t *testing.T) {
 
   for xi := 0; xi < nclients; xi++ {
     go func(i int){
-      ck := MakeClerk(phost, bhost)
+      ck := MakeClerk(phost, bhost, transport.Unix{})
       rr := rand.New(rand.NewSource(int64(os.Getpid()+i)))
       for done == false {
         locknum := (rr.Int() % nlocks)
@@ -385,7 +386,7 @@ func TestMany(t *testing.T) {
   time.Sleep(2 * time.Second)
   done = true
   time.Sleep(time.Second)
-  ck := MakeClerk(phost, bhost)
+  ck := MakeClerk(phost, bhost, transport.Unix{})
   for xi := 0; xi < nclients; xi++ {
     if acks[xi] == false {
       t.Fatal("one client didn't complete")
@@ -409,8 +410,8 @@ func TestConcurrentCounts(t *testing.T) {
 
   phost := port("p")
   bhost := port("b")
-  p := StartServer(phost, bhost, true)  // primary
-  b := StartServer(phost, bhost, false) // backup
+  p := StartServer(phost, bhost, true, transport.Unix{})  // primary
+  b := StartServer(phost, bhost, false, transport.Unix{}) // backup
 
   const nclients = 2
   const nlocks = 1
@@ -421,7 +422,7 @@ func TestConcurrentCounts(t *testing.T) {
 
   for xi := 0; xi < nclients; xi++ {
     go func(i int){
-      ck := MakeClerk(phost, bhost)
+      ck := MakeClerk(phost, bhost, transport.Unix{})
       rr := rand.New(rand.NewSource(int64(os.Getpid()+i)))
       for done == false {
         locknum := rr.Int() % nlocks
@@ -451,7 +452,7 @@ func TestConcurrentCounts(t *testing.T) {
       t.Fatal("one client didn't complete")
     }
   }
-  ck := MakeClerk(phost, bhost)
+  ck := MakeClerk(phost, bhost, transport.Unix{})
   for locknum := 0; locknum < nlocks; locknum++ {
     nl := 0
     nu := 0
@@ -6,6 +6,7 @@ package main
 
 import "lockservice"
 import "os"
+import "transport"
 import "fmt"
 
 func usage() {
@@ -15,7 +16,7 @@ func usage() {
 
 func main() {
   if len(os.Args) == 5 {
-    ck := lockservice.MakeClerk(os.Args[2], os.Args[3])
+    ck := lockservice.MakeClerk(os.Args[2], os.Args[3], transport.Unix{})
     var ok bool
     if os.Args[1] == "-l" {
       ok = ck.Lock(os.Args[4])
@@ -14,13 +14,14 @@ package main
 import "time"
 import "lockservice"
 import "os"
+import "transport"
 import "fmt"
 
 func main() {
   if len(os.Args) == 4 && os.Args[1] == "-p" {
-    lockservice.StartServer(os.Args[2], os.Args[3], true)
+    lockservice.StartServer(os.Args[2], os.Args[3], true, transport.Unix{})
   } else if len(os.Args) == 4 && os.Args[1] == "-b" {
-    lockservice.StartServer(os.Args[2], os.Args[3], false)
+    lockservice.StartServer(os.Args[2], os.Args[3], false, transport.Unix{})
   } else {
     fmt.Printf("Usage: lockd -p|-b primaryport backupport\n")
     os.Exit(1)
@@ -20,6 +20,7 @@ package main
 
 import "pbservice"
 import "os"
+import "transport"
 import "fmt"
 
 func usage() {
@@ -31,12 +32,12 @@ func usage() {
 func main() {
   if len(os.Args) == 3 {
     // get
-    ck := pbservice.MakeClerk(os.Args[1], "")
+    ck := pbservice.MakeClerk(os.Args[1], "", transport.Unix{})
     v := ck.Get(os.Args[2])
     fmt.Printf("%v\n", v)
   } else if len(os.Args) == 4 {
     // put
-    ck := pbservice.MakeClerk(os.Args[1], "")
+    ck := pbservice.MakeClerk(os.Args[1], "", transport.Unix{})
     ck.Put(os.Args[2], os.Args[3])
   } else {
     usage()
@@ -7,6 +7,7 @@ package main
 import "time"
 import "pbservice"
 import "os"
+import "transport"
 import "fmt"
 
 func main() {
@@ -15,7 +16,7 @@ func main() {
     os.Exit(1)
   }
 
-  pbservice.StartServer(os.Args[1], os.Args[2])
+  pbservice.StartServer(os.Args[1], os.Args[2], transport.Unix{})
 
   for { time.Sleep(100 * time.Second) }
 }
@@ -7,6 +7,7 @@ package main
 import "time"
 import "viewservice"
 import "os"
+import "transport"
 import "fmt"
 
 func main() {
@@ -15,7 +16,7 @@ func main() {
     os.Exit(1)
   }
 
-  viewservice.StartServer(os.Args[1])
+  viewservice.StartServer(os.Args[1], transport.Unix{})
 
   for { time.Sleep(100 * time.Second) }
 }
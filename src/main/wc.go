@@ -1,6 +1,7 @@
 package main
 
 import "os"
+import "transport"
 import "fmt"
 import "mapreduce"
 import "container/list"
@@ -51,11 +52,11 @@ func main() {
     if os.Args[3] == "sequential" {
       mapreduce.RunSingle(5, 3, os.Args[2], Map, Reduce)
     } else {
-      mr := mapreduce.MakeMapReduce(5, 3, os.Args[2], os.Args[3])    
+      mr := mapreduce.MakeMapReduce(5, 3, os.Args[2], os.Args[3], transport.Unix{})    
       // Wait until MR is done
       <- mr.DoneChannel
     }
   } else {
-    mapreduce.RunWorker(os.Args[2], os.Args[3], Map, Reduce, 100)
+    mapreduce.RunWorker(os.Args[2], os.Args[3], Map, Reduce, 100, transport.Unix{})
   }
 }
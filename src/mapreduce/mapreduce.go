@@ -11,6 +11,7 @@ import "net/rpc"
 import "net"
 import "bufio"
 import "hash/fnv"
+import "transport"
 
 // import "os/exec"
 
@@ -58,6 +59,7 @@ type MapReduce struct {
   DoneChannel chan bool
   alive bool
   l net.Listener
+  t transport.Transport
   stats *list.List
 
   // Map of registered workers that you need to keep up to date
@@ -82,8 +84,9 @@ func InitMapReduce(nmap int, nreduce int,
 }
 
 func MakeMapReduce(nmap int, nreduce int,
-                   file string, master string) *MapReduce {
+                   file string, master string, t transport.Transport) *MapReduce {
   mr := InitMapReduce(nmap, nreduce, file, master)
+  mr.t = t
   mr.StartRegistrationServer()
   go mr.Run()
   return mr
@@ -106,8 +109,7 @@ func (mr *MapReduce) Shutdown(args *ShutdownArgs, res *ShutdownReply) error {
 func (mr *MapReduce) StartRegistrationServer() {
   rpcs := rpc.NewServer()
   rpcs.Register(mr)
-  os.Remove(mr.MasterAddress)   // only needed for "unix"
-  l, e := net.Listen("unix", mr.MasterAddress)
+  l, e := mr.t.Listen(mr.MasterAddress)
   if e != nil {
     log.Fatal("RegstrationServer", mr.MasterAddress, " error: ", e)
   }
@@ -360,7 +362,7 @@ func RunSingle(nMap int, nReduce int, file string,
 func (mr *MapReduce) CleanupRegistration() {
   args := &ShutdownArgs{}
   var reply ShutdownReply
-  ok := call(mr.MasterAddress, "MapReduce.Shutdown", args, &reply)
+  ok := transport.Call(mr.t, mr.MasterAddress, "MapReduce.Shutdown", args, &reply)
   if ok == false {
     fmt.Printf("Cleanup: RPC %s error\n", mr.MasterAddress)
   }
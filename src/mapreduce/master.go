@@ -1,6 +1,7 @@
 package mapreduce
 import "container/list"
 import "fmt"
+import "transport"
 
 type WorkerInfo struct {
   address string
@@ -16,7 +17,7 @@ func (mr *MapReduce) KillWorkers() *list.List {
     DPrintf("DoWork: shutdown %s\n", w.address)
     args := &ShutdownArgs{}
     var reply ShutdownReply;
-    ok := call(w.address, "Worker.Shutdown", args, &reply)
+    ok := transport.Call(mr.t, w.address, "Worker.Shutdown", args, &reply)
     if ok == false {
       fmt.Printf("DoWork: RPC %s shutdown error\n", w.address)
     } else {
@@ -41,7 +42,7 @@ func (mr *MapReduce) RunMaster() *list.List {
     args.JobNumber = i
     args.File = mr.file
     args.NumOtherPhase = mr.nReduce
-    ok := call(worker, "Worker.DoJob", args, &reply)
+    ok := transport.Call(mr.t, worker, "Worker.DoJob", args, &reply)
     fmt.Println("rpc call status", ok)
 
     // when tasks completed, release this worker
@@ -65,7 +66,7 @@ func (mr *MapReduce) RunMaster() *list.List {
    args.JobNumber = i
    args.File = mr.file
    args.NumOtherPhase = mr.nMap
-   ok := call(worker, "Worker.DoJob", args, &reply)
+   ok := transport.Call(mr.t, worker, "Worker.DoJob", args, &reply)
    fmt.Println("rpc call status", ok)
    // when tasks completed, release this worker
    if ok {
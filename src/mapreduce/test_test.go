@@ -11,6 +11,7 @@ import "bufio"
 import "log"
 import "sort"
 import "strconv"
+import "transport"
 
 const (
   nNumber= 100000
@@ -125,7 +126,7 @@ func port(suffix string) string {
 func setup() *MapReduce {
   file := makeInput()
   master := port("master")
-  mr := MakeMapReduce(nMap, nReduce, file, master)
+  mr := MakeMapReduce(nMap, nReduce, file, master, transport.Unix{})
   return mr
 }
 
@@ -139,7 +140,7 @@ func TestBasic(t *testing.T) {
  mr := setup()
  for i := 0; i < 2; i++ {
    go RunWorker(mr.MasterAddress, port("worker" + strconv.Itoa(i)),
-                MapFunc, ReduceFunc, -1)
+                MapFunc, ReduceFunc, -1, transport.Unix{})
  }
  // Wait until MR is done
  <- mr.DoneChannel
@@ -154,9 +155,9 @@ fmt.Printf("Test: One Failure mapreduce ...\n")
 mr := setup()
 // Start 2 workers that fail after 10 jobs
 go RunWorker(mr.MasterAddress, port("worker" + strconv.Itoa(0)),
-             MapFunc, ReduceFunc, 10)
+             MapFunc, ReduceFunc, 10, transport.Unix{})
 go RunWorker(mr.MasterAddress, port("worker" + strconv.Itoa(1)),
-             MapFunc, ReduceFunc, -1)
+             MapFunc, ReduceFunc, -1, transport.Unix{})
 // Wait until MR is done
 <- mr.DoneChannel
 check(t, mr.file)
@@ -179,10 +180,10 @@ func TestManyFailures(t *testing.T) {
    default:
      // Start 2 workers each sec. The workers fail after 10 jobs
      w := port("worker" + strconv.Itoa(i))
-     go RunWorker(mr.MasterAddress, w, MapFunc, ReduceFunc, 10)
+     go RunWorker(mr.MasterAddress, w, MapFunc, ReduceFunc, 10, transport.Unix{})
      i++
      w = port("worker" + strconv.Itoa(i))
-     go RunWorker(mr.MasterAddress, w, MapFunc, ReduceFunc, 10)
+     go RunWorker(mr.MasterAddress, w, MapFunc, ReduceFunc, 10, transport.Unix{})
      i++
      time.Sleep(1 * time.Second)
    }
@@ -1,11 +1,11 @@
 package mapreduce
 
 import "fmt"
-import "os"
 import "log"
 import "net/rpc"
 import "net"
 import "container/list"
+import "transport"
 
 // Worker is a server waiting for DoJob or Shutdown RPCs
 
@@ -45,11 +45,11 @@ func (wk *Worker) Shutdown(args *ShutdownArgs, res *ShutdownReply) error {
 }
 
 // Tell the master we exist and ready to work
-func Register(master string, me string) {
+func Register(master string, me string, t transport.Transport) {
   args := &RegisterArgs{}
   args.Worker = me
   var reply RegisterReply
-  ok := call(master, "MapReduce.Register", args, &reply)
+  ok := transport.Call(t, master, "MapReduce.Register", args, &reply)
   if ok == false {
     fmt.Printf("Register: RPC %s register error\n", master)
   }
@@ -59,7 +59,8 @@ func Register(master string, me string) {
 // and wait for jobs from the master
 func RunWorker(MasterAddress string, me string,
                MapFunc func(string) *list.List,
-               ReduceFunc func(string,*list.List) string, nRPC int) {
+               ReduceFunc func(string,*list.List) string, nRPC int,
+               t transport.Transport) {
   DPrintf("RunWorker %s\n", me)
   wk := new(Worker)
   wk.name = me
@@ -68,13 +69,12 @@ func RunWorker(MasterAddress string, me string,
   wk.nRPC = nRPC
   rpcs := rpc.NewServer()
   rpcs.Register(wk)
-  os.Remove(me)   // only needed for "unix"
-  l, e := net.Listen("unix", me)
+  l, e := t.Listen(me)
   if e != nil {
     log.Fatal("RunWorker: worker ", me, " error: ", e)
   }
   wk.l = l
-  Register(MasterAddress, me)
+  Register(MasterAddress, me, t)
 
   // DON'T MODIFY CODE BELOW
   for wk.nRPC != 0 {
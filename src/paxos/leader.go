@@ -0,0 +1,324 @@
+package paxos
+
+//
+// distinguished leader (Multi-Paxos).
+//
+// a peer becomes leader by winning a single Phase 1 (PROPOSE) that
+// covers every instance >= from. acceptors remember that as their
+// Promise and report every value they accepted in that range. from
+// then on the leader only sends ACCEPTs, with its ballot, for those
+// instances. a rejected ACCEPT means someone got a higher ballot, and
+// the leader steps down.
+//
+// ballots are unique: the i'th peer of a Membership only uses
+// numbers that are i mod len(peers), so the owner of a ballot is
+// peers[ballot % len(peers)]. leadership is for one Membership
+// only; instances under the next one need a new Phase 1.
+//
+
+import "math/rand"
+import "time"
+
+// how long a forwarder waits for the leader to decide.
+const forwardTimeout = 1 * time.Second
+
+// how long Leader() trusts a peer it hasn't heard from.
+const leaderHintTimeout = 1 * time.Second
+
+//
+// acceptor side: no ballot <= Ballot is accepted for instances >= From.
+//
+type Promise struct {
+  Ballot int
+  From   int
+}
+
+//
+// proposer side: state of our own leadership.
+//
+type Leader struct {
+  ballot int // won Phase 1 with this for instances >= from; -1 if not leading
+  from   int
+  epoch  int                 // Start of the Membership we lead
+  seen   int                 // highest ballot seen from anyone
+  values map[int]interface{} // values reported in Phase 1, to be re-proposed
+
+  electing bool // an elect() has PROPOSEs out
+
+  leaseUntil time.Time // see lease.go
+  renewing   bool
+}
+
+func (px *Paxos) nextBallot(seen int, peers []string) int {
+  n := len(peers)
+  return (seen/n+1)*n + indexOf(peers, px.self)
+}
+
+//
+// the ballot in force for an instance at this acceptor.
+// caller must hold px.acceptorLock.
+//
+func (px *Paxos) promisedNumber(seq int, instance *Instance) int {
+  np := instance.acceptor.highestProposedNumber
+  if seq >= px.promise.From {
+    np = max(np, px.promise.Ballot)
+  }
+  return np
+}
+
+//
+// the highest ballot promised for any instance >= from, and every
+// value accepted or decided there.
+// caller must hold px.acceptorLock.
+//
+func (px *Paxos) acceptedSince(from int) (int, []AcceptedValue) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  np := px.promise.Ballot
+  var accepted []AcceptedValue
+  for seq, instance := range px.instances {
+    if seq < from {
+      continue
+    }
+    np = max(np, instance.acceptor.highestProposedNumber)
+    if instance.decidedValue != nil {
+      accepted = append(accepted, AcceptedValue{seq, 0, instance.decidedValue, true})
+    } else if instance.acceptor.highestAcceptedValue != nil {
+      accepted = append(accepted, AcceptedValue{seq, instance.acceptor.highestAcceptedNumber,
+        instance.acceptor.highestAcceptedValue, false})
+    }
+  }
+  return np, accepted
+}
+
+func (px *Paxos) getLeaderHint() string {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.leaderHint
+}
+
+func (px *Paxos) setLeaderHint(leader string) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  px.leaderHint = leader
+  px.leaderHintAt = time.Now()
+}
+
+//
+// if we lead instance seq, the ballot to use and the value, if any,
+// that Phase 1 obliged us to propose.
+//
+func (px *Paxos) leading(seq int) (int, interface{}, bool) {
+  epoch := px.membershipFor(seq).Start
+  px.leaderMu.Lock()
+  defer px.leaderMu.Unlock()
+  if px.leader.ballot < 0 || seq < px.leader.from || epoch != px.leader.epoch {
+    return 0, nil, false
+  }
+  return px.leader.ballot, px.leader.values[seq], true
+}
+
+//
+// whether this peer thinks it leads. it may have been deposed
+// without knowing it yet, so this is only a hint; see lease.go for
+// something firmer.
+//
+func (px *Paxos) IsLeader() bool {
+  px.leaderMu.Lock()
+  defer px.leaderMu.Unlock()
+  return px.leader.ballot >= 0
+}
+
+//
+// the peer this one thinks leads: itself if IsLeader(), or else
+// the last peer it heard from with a ballot, if that was within
+// leaderHintTimeout. "" if it doesn't know. like IsLeader(), only
+// a hint.
+//
+func (px *Paxos) Leader() string {
+  if px.IsLeader() {
+    return px.self
+  }
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if px.leaderHint == px.self || time.Since(px.leaderHintAt) > leaderHintTimeout {
+    return ""
+  }
+  return px.leaderHint
+}
+
+//
+// remember a ballot someone else is using, so our next one is higher.
+//
+func (px *Paxos) sawBallot(seq int, ballot int) {
+  px.leaderMu.Lock()
+  seen := px.leader.seen
+  px.leader.seen = max(px.leader.seen, ballot)
+  px.leaderMu.Unlock()
+  if owner := px.ballotOwner(seq, ballot); ballot > seen && owner != px.self {
+    px.setLeaderHint(owner)
+  }
+}
+
+//
+// step down, unless we've already been re-elected with a new ballot.
+//
+func (px *Paxos) abdicate(ballot int) {
+  px.leaderMu.Lock()
+  defer px.leaderMu.Unlock()
+  if px.leader.ballot == ballot {
+    px.leader.ballot = -1
+    px.leader.values = nil
+  }
+}
+
+//
+// run Phase 1 for every instance >= min(seq, Max()+1) under the
+// Membership in effect for seq. returns true if we now lead seq.
+// px.leaderMu is not held across the PROPOSEs, so only one
+// election runs at a time, and it gives up if it sees a higher
+// ballot while they are out.
+//
+func (px *Paxos) elect(seq int) bool {
+  m := px.membershipFor(seq)
+  px.leaderMu.Lock()
+  if px.leader.ballot >= 0 && seq >= px.leader.from && m.Start == px.leader.epoch {
+    px.leaderMu.Unlock()
+    return true
+  }
+  if indexOf(m.Peers, px.self) < 0 || px.leader.electing {
+    px.leaderMu.Unlock()
+    return false
+  }
+  from := max(min(seq, px.Max()+1), m.Start)
+  ballot := px.nextBallot(px.leader.seen, m.Peers)
+  px.leader.seen = ballot
+  px.leader.electing = true
+  px.leaderMu.Unlock()
+
+  need := len(m.Peers)/2 + 1
+  count, refused := 0, 0
+  seen := ballot
+  holder := ""
+  reported := make(map[int]AcceptedValue)
+  args := &Proposal{PROPOSE, ballot, from, nil, px.initMeta()}
+  px.broadcast(m.Peers, args, func(reply *Response) bool {
+    if reply.Snapshot != nil {
+      // we're behind; catch up and let the caller try again.
+      px.saveSnapshot(*reply.Snapshot, false)
+      refused++
+    } else if reply.Approved {
+      count++
+      for _, a := range reply.Accepted {
+        old, ok := reported[a.Seq]
+        if !ok || (!old.Decided && (a.Decided || a.Number > old.Number)) {
+          reported[a.Seq] = a
+        }
+      }
+    } else {
+      seen = max(seen, reply.Number)
+      if owner := px.ballotOwner(from, reply.Number); reply.Number > 0 && owner != px.self {
+        holder = owner
+      }
+      refused++
+    }
+    return count >= need || refused > len(m.Peers)-need
+  })
+  if count < need && holder != "" {
+    // a lease holder may be refusing us with a ballot lower than
+    // ours; sawBallot() wouldn't notice it, so follow it here.
+    px.setLeaderHint(holder)
+  }
+
+  px.leaderMu.Lock()
+  px.leader.electing = false
+  px.leader.seen = max(px.leader.seen, seen)
+  if count < need || px.leader.seen > ballot {
+    px.leaderMu.Unlock()
+    return false
+  }
+  px.leader.ballot = ballot
+  px.leader.from = from
+  px.leader.epoch = m.Start
+  px.leader.values = make(map[int]interface{})
+  for s, a := range reported {
+    if px.membershipFor(s).Start != m.Start {
+      // under a later Membership; not ours to drive.
+      continue
+    }
+    px.leader.values[s] = a.Value
+  }
+  values := px.leader.values
+  px.leaderMu.Unlock()
+
+  for s, v := range values {
+    // finish whatever the previous leader left half done.
+    px.Start(s, v)
+  }
+  px.setLeaderHint(px.self)
+  return true
+}
+
+func (px *Paxos) backoff() {
+  time.Sleep(time.Duration(10+rand.Intn(40)) * time.Millisecond)
+}
+
+//
+// ask leader to get v agreed on for seq, and wait a while for the
+// outcome. returns true once this peer knows seq is decided.
+//
+func (px *Paxos) forward(leader string, seq int, v interface{}) bool {
+  args := &Proposal{FORWARD, 0, seq, v, px.initMeta()}
+  reply := Response{}
+  if !px.pool.Call(leader, "Paxos.Forward", args, &reply) {
+    return false
+  }
+  px.updateMeta(reply.Meta)
+  if reply.Type == DECIDE {
+    px.Receive(&Proposal{DECIDE, 0, seq, reply.Value, px.initMeta()}, &Response{})
+    return true
+  }
+  if reply.Type == SNAPSHOT {
+    px.saveSnapshot(*reply.Snapshot, false)
+    return true
+  }
+  if !reply.Approved {
+    return false
+  }
+  deadline := time.Now().Add(forwardTimeout)
+  for !px.dead && time.Now().Before(deadline) {
+    if decided, _ := px.Status(seq); decided {
+      return true
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  return false
+}
+
+//
+// a non-leader wants Start(proposal.Seq, proposal.Value).
+// if the instance is already decided, the reply carries the value.
+//
+func (px *Paxos) Forward(proposal *Proposal, response *Response) error {
+  px.updateMeta(proposal.Meta)
+  response.Meta = px.initMeta()
+  response.Type = FORWARD
+  if decided, v := px.Status(proposal.Seq); decided {
+    response.Type = DECIDE
+    response.Value = v
+    response.Approved = true
+    return nil
+  }
+  if s, ok := px.snapshotFor(proposal.Seq); ok {
+    response.Type = SNAPSHOT
+    response.Snapshot = &s
+    response.Approved = true
+    return nil
+  }
+  if !px.IsLeader() {
+    return nil
+  }
+  px.Start(proposal.Seq, proposal.Value)
+  response.Approved = true
+  return nil
+}
@@ -0,0 +1,139 @@
+package paxos
+
+//
+// leader leases, so the application can serve reads without
+// getting an instance agreed on.
+//
+// px.LeaseRead() (seq int, ok bool) -- if ok, the application's state
+//   is up to date for a read once it has applied every instance <= seq
+//
+// the leader asks the acceptors that promised it its ballot for a
+// lease. an acceptor that grants one won't promise a ballot to any
+// other peer for LeaseDuration, by its own clock. Phase 1 needs a
+// majority, so while a majority's grants last nobody else can get
+// a value decided: every decided instance is one the leader learned
+// in its Phase 1 or decided itself, and decide() tells the leader
+// first.
+//
+// the leader counts its lease from before it asked, and shortens it
+// by the most that clocks running MaxDrift apart can disagree over
+// LeaseDuration, so it expires before any grant it relies on does.
+// leases are only asked for when the application reads, so peers
+// that never call LeaseRead() never have to wait one out.
+//
+
+import "time"
+
+// how long an acceptor honors a grant.
+const LeaseDuration = 1 * time.Second
+
+// bound on how far any clock's rate may be from real time.
+var MaxDrift = 0.05
+
+// how long the leader may rely on a lease it asked for.
+func leaseSpan() time.Duration {
+  return time.Duration(float64(LeaseDuration) * (1 - MaxDrift) / (1 + MaxDrift))
+}
+
+//
+// acceptor side: no ballot is promised to anyone but Owner until
+// Until. an Owner of "" means nobody.
+//
+type Grant struct {
+  Owner string
+  Until time.Time
+}
+
+//
+// whether a grant to someone other than peer is still in force.
+// caller must hold px.acceptorLock.
+//
+func (px *Paxos) leasedToOther(peer string) bool {
+  return px.grant.Owner != peer && time.Now().Before(px.grant.Until)
+}
+
+//
+// a LEASE from the leader of the Membership that starts at
+// proposal.Seq. grant it if we're still promised to its ballot.
+// caller must hold px.acceptorLock.
+//
+func (px *Paxos) grantLease(proposal *Proposal, response *Response) {
+  response.Number = px.promise.Ballot
+  if proposal.ProposedNum != px.promise.Ballot {
+    return
+  }
+  px.grant = Grant{px.ballotOwner(proposal.Seq, proposal.ProposedNum), time.Now().Add(LeaseDuration)}
+  response.Approved = true
+}
+
+//
+// ask the acceptors of epoch for a lease on ballot.
+// returns true if we got one.
+//
+func (px *Paxos) renewLease(ballot int, epoch int) bool {
+  t0 := time.Now()
+  peers := px.peersFor(epoch)
+  need := len(peers)/2 + 1
+  count, refused := 0, 0
+  args := &Proposal{LEASE, ballot, epoch, nil, px.initMeta()}
+  px.broadcast(peers, args, func(reply *Response) bool {
+    if reply.Approved {
+      count++
+    } else {
+      px.sawBallot(epoch, reply.Number)
+      refused++
+    }
+    return count >= need || refused > len(peers)-need
+  })
+
+  px.leaderMu.Lock()
+  defer px.leaderMu.Unlock()
+  px.leader.renewing = false
+  if count < need || px.leader.ballot != ballot {
+    return false
+  }
+  px.leader.leaseUntil = t0.Add(leaseSpan())
+  return true
+}
+
+//
+// if this peer is the leader and holds a lease, the instance the
+// application must have applied before it can answer a read from
+// its own state. renews the lease as it runs low, and if it has
+// run out, waits for a round of RPCs to renew it; don't call this
+// holding a lock the application needs meanwhile.
+//
+func (px *Paxos) LeaseRead() (int, bool) {
+  px.mu.Lock()
+  latest := px.latestLocked().Start
+  px.mu.Unlock()
+
+  px.leaderMu.Lock()
+  ballot, epoch := px.leader.ballot, px.leader.epoch
+  if ballot < 0 || epoch != latest {
+    // instances under a later Membership aren't ours to vouch for.
+    px.leaderMu.Unlock()
+    return 0, false
+  }
+  // instances Phase 1 told us about may have been decided already,
+  // and so may anything under the previous Membership.
+  seq := epoch - 1
+  for s := range px.leader.values {
+    seq = max(seq, s)
+  }
+  left := time.Until(px.leader.leaseUntil)
+  renew := !px.leader.renewing && left < leaseSpan()/2
+  if renew {
+    px.leader.renewing = true
+  }
+  px.leaderMu.Unlock()
+
+  if left <= 0 {
+    if !renew || !px.renewLease(ballot, epoch) {
+      return 0, false
+    }
+  } else if renew {
+    go px.renewLease(ballot, epoch)
+  }
+  return max(seq, px.Max()), true
+}
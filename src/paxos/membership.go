@@ -0,0 +1,229 @@
+package paxos
+
+//
+// dynamic group membership.
+//
+// the set of peers can change. px.Reconfigure(peers) gets a
+// Reconfig value agreed on in an ordinary instance s, and the new
+// set is in effect for instances >= s+Alpha. majorities, ballots,
+// leadership and Min() are computed against the set in effect for
+// each instance.
+//
+// Alpha bounds how far ahead of its knowledge a peer may run: the
+// application must not Start(seq) until it knows the decisions of
+// all instances <= seq-Alpha, or it may use a stale peer set. the
+// kvpaxos, shardmaster and shardkv servers start instances in order,
+// so they always do.
+//
+// Reconfig values show up in Status() like any other value, and
+// applications should skip them.
+//
+// a new peer is started with Make() and the new set of peers; it
+// fetches the history of peer sets from the others, and catches up
+// from a snapshot on the instances they've forgotten, so whoever
+// calls Reconfigure should make sure one exists (px.Snapshot()).
+// KVPaxos.Reconfigure does all this for a kvpaxos group.
+//
+
+import "context"
+import "math/rand"
+import "sort"
+
+const Alpha = 10
+
+//
+// the peers in effect for instances >= Start,
+// until the next Membership.
+//
+type Membership struct {
+  Start int
+  Peers []string
+}
+
+//
+// the value agreed on to change membership.
+//
+type Reconfig struct {
+  Id    int64
+  Peers []string
+}
+
+type MembersArgs struct {
+}
+
+type MembersReply struct {
+  Members []Membership
+}
+
+func indexOf(peers []string, peer string) int {
+  for i, p := range peers {
+    if p == peer {
+      return i
+    }
+  }
+  return -1
+}
+
+//
+// the Membership in effect for seq.
+// caller must hold px.mu.
+//
+func (px *Paxos) membershipLocked(seq int) Membership {
+  m := px.members[0]
+  for _, next := range px.members[1:] {
+    if next.Start > seq {
+      break
+    }
+    m = next
+  }
+  return m
+}
+
+func (px *Paxos) membershipFor(seq int) Membership {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.membershipLocked(seq)
+}
+
+func (px *Paxos) peersFor(seq int) []string {
+  return px.membershipFor(seq).Peers
+}
+
+//
+// the latest Membership we know of.
+// caller must hold px.mu.
+//
+func (px *Paxos) latestLocked() Membership {
+  return px.members[len(px.members)-1]
+}
+
+//
+// the Membership that starts at start, if we know it.
+// caller must hold px.mu.
+//
+func (px *Paxos) epochLocked(start int) (Membership, bool) {
+  for _, m := range px.members {
+    if m.Start == start {
+      return m, true
+    }
+  }
+  return Membership{}, false
+}
+
+//
+// the peer that owns ballot in the Membership in effect for seq.
+//
+func (px *Paxos) ballotOwner(seq int, ballot int) string {
+  peers := px.peersFor(seq)
+  return peers[ballot%len(peers)]
+}
+
+//
+// note a decided value; if it is a Reconfig, schedule the change.
+// caller must hold px.mu.
+//
+func (px *Paxos) learnReconfig(seq int, v interface{}) {
+  rc, ok := v.(Reconfig)
+  if !ok {
+    return
+  }
+  // a peer that joins hasn't called Done(), but mustn't hold Min()
+  // below instances the rest have forgotten; it gets a snapshot
+  // of them instead.
+  floor := px.minLocked() - 1
+  px.addMembership(Membership{seq + Alpha, rc.Peers})
+  for _, peer := range rc.Peers {
+    px.setDone(peer, floor)
+  }
+}
+
+// caller must hold px.mu.
+func (px *Paxos) addMembership(m Membership) {
+  if _, ok := px.epochLocked(m.Start); ok {
+    return
+  }
+  members := make([]Membership, len(px.members), len(px.members)+1)
+  copy(members, px.members)
+  members = append(members, m)
+  sort.Slice(members, func(i, j int) bool { return members[i].Start < members[j].Start })
+  px.members = members
+}
+
+//
+// the first instance this peer hasn't seen decided.
+//
+func (px *Paxos) firstUndecided() int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  seq := px.forgetPointLocked()
+  for {
+    instance, ok := px.instances[seq]
+    if !ok || instance.decidedValue == nil {
+      return seq
+    }
+    seq++
+  }
+}
+
+//
+// get agreement on a new set of peers. returns the instance that
+// carries the change; the new set is in effect Alpha instances
+// later. returns -1 if this peer is killed first.
+//
+// like the applications, we only Start(seq) once we know every
+// decision before seq, which keeps to the Alpha rule: no one can
+// have started an instance that the change should have covered.
+//
+func (px *Paxos) Reconfigure(peers []string) int {
+  rc := Reconfig{rand.Int63(), peers}
+  seq := px.firstUndecided()
+  for !px.dead {
+    px.Start(seq, rc)
+    v, err := px.Wait(seq, context.Background())
+    if err == ErrKilled {
+      break
+    }
+    if err == ErrForgotten {
+      // a snapshot took us past seq.
+      seq = px.firstUndecided()
+      continue
+    }
+    if r, ok := v.(Reconfig); ok && r.Id == rc.Id {
+      return seq
+    }
+    seq++
+  }
+  return -1
+}
+
+//
+// another peer, probably a new one, wants our membership history.
+//
+func (px *Paxos) Members(args *MembersArgs, reply *MembersReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  reply.Members = px.members
+  return nil
+}
+
+//
+// adopt the longest membership history any peer will tell us about.
+// histories are built from decided instances, so a longer one
+// extends a shorter one.
+//
+func (px *Paxos) syncMembers() {
+  for _, peer := range px.peersFor(px.Max() + 1) {
+    if peer == px.self {
+      continue
+    }
+    var reply MembersReply
+    if !px.pool.Call(peer, "Paxos.Members", &MembersArgs{}, &reply) {
+      continue
+    }
+    px.mu.Lock()
+    if len(reply.Members) > len(px.members) {
+      px.members = reply.Members
+    }
+    px.mu.Unlock()
+  }
+}
@@ -6,18 +6,30 @@ package paxos
 // a Paxos peer.
 //
 // Manages a sequence of agreed-on values.
-// The set of peers is fixed.
+// The set of peers can change; see membership.go.
 // Copes with network failures (partition, msg loss, &c).
-// Does not store anything persistently, so cannot handle crash+restart.
+// Peers made with MakeDurable keep their acceptor state in a
+// write-ahead log, so they can handle crash+restart.
+// A peer that wins Phase 1 for all instances >= N becomes the
+// leader and runs only Phase 2 for later instances; other peers
+// forward their Start()s to it.
 //
 // The application interface:
 //
-// px = paxos.Make(peers []string, me string)
+// px = paxos.Make(peers []string, me string, rpcs, t transport.Transport)
+// px = paxos.MakeDurable(peers []string, me int, rpcs, dir string, t)
 // px.Start(seq int, v interface{}) -- start agreement on new instance
 // px.Status(seq int) (decided bool, v interface{}) -- get info about an instance
 // px.Done(seq int) -- ok to forget all instances <= seq
 // px.Max() int -- highest instance seq known, or -1
 // px.Min() int -- instances before this seq have been forgotten
+// px.Reconfigure(peers []string) int -- agree on a new set of peers
+// px.Wait(seq int, ctx) (v interface{}, err error) -- block until decided
+// px.Subscribe(from int, ctx) <-chan Decision -- decided values, in order
+// px.SetSnapshotter(take, install) -- let the application's state replace old instances
+// px.LeaseRead() (seq int, ok bool) -- may the leader serve reads locally? see lease.go
+// px.IsLeader() bool -- does this peer think it's the leader?
+// px.Leader() string -- the peer this one thinks leads, or ""
 //
 
 import (
@@ -25,11 +37,14 @@ import (
 )
 import "net/rpc"
 import "log"
-import "os"
-import "syscall"
 import "sync"
 import "fmt"
-import "math/rand"
+import "encoding/gob"
+import "time"
+import "transport"
+
+// how long to wait for another peer to answer an RPC.
+const rpcTimeout = 250 * time.Millisecond
 
 type Paxos struct {
   mu         sync.Mutex
@@ -39,18 +54,30 @@ type Paxos struct {
   rpcCount   int
   peers      []string
   me         int // index into peers[]
+  pool       *transport.Pool
 
   // Your data here.
+  self         string // peers[me]; how we appear in Membership lists
+  members      []Membership // sorted by Start; never empty
   acceptorLock sync.Mutex
   instances    InstanceMap
   maxSeq       int
-  doneMap      []int
+  decidedCh    chan struct{} // closed and replaced on each decision
+  doneMap      map[string]int // peer -> highest Done() heard of
+  doneLog      map[string]int // doneMap increases not yet in the wal
   toCleanSeq   int
-}
-
-type Proposer struct {
-  proposedNumber            int
-  highestSeenProposedNumber int
+  wal          *wal // nil unless made with MakeDurable
+  promise      Promise
+  leaderHint   string // peer believed to be leading, or ""
+  leaderHintAt time.Time // when we last heard from it
+  leaderMu     sync.Mutex
+  leader       Leader
+  grant        Grant // lease we granted; see lease.go
+
+  snapshot          Snapshot // latest snapshot; see snapshot.go
+  snapshotInstalled bool     // whether the application has it
+  takeSnapshot      func() []byte
+  installSnapshot   func([]byte)
 }
 
 type Acceptor struct {
@@ -61,7 +88,6 @@ type Acceptor struct {
 
 type Instance struct {
   mu           sync.Mutex
-  proposer     Proposer
   acceptor     Acceptor
   decidedValue interface{}
 }
@@ -78,9 +104,12 @@ func (px *Paxos) getInstance(seq int) *Instance {
 }
 
 const (
-  PROPOSE = "PROPOSE"
+  PROPOSE = "PROPOSE" // Phase 1 for every instance >= Seq
   ACCEPT  = "ACCEPT"
   DECIDE  = "DECIDE"
+  FORWARD  = "FORWARD"
+  SNAPSHOT = "SNAPSHOT"
+  LEASE    = "LEASE" // leader asks for a lease; Seq is its Membership's Start
 )
 
 type Proposal struct {
@@ -97,47 +126,30 @@ type Response struct {
   Number   int
   Value    interface{}
   Meta     MetaData
+  Accepted []AcceptedValue // PROPOSE only
+  Snapshot *Snapshot       // instead of the instance, which we forgot
 }
 
-type MetaData struct {
-  Me   int
-  Done int
+type AcceptedValue struct {
+  Seq     int
+  Number  int
+  Value   interface{}
+  Decided bool
 }
 
 //
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be a pointer
-// to a reply structure.
+// peers are named by their index in the sender's latest
+// Membership, identified by its Start, since each peer may
+// know the others by different addresses. the sender names
+// itself as it appears in the Membership lists, since a peer
+// that has been removed still holds back the instances it was
+// a member for.
 //
-// the return value is true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// the replys contents are only valid if call() returned true.
-//
-// you should assume that call() will time out and return an
-// error after a while if it does not get a reply from the server.
-//
-// please use call() to send all RPCs, in client.go and server.go.
-// please do not change this function.
-//
-func call(srv string, name string, args interface{}, reply interface{}) bool {
-  c, err := rpc.Dial("unix", srv)
-  if err != nil {
-    err1 := err.(*net.OpError)
-    if err1.Err != syscall.ENOENT && err1.Err != syscall.ECONNREFUSED {
-      fmt.Printf("paxos Dial() failed: %v\n", err1)
-    }
-    return false
-  }
-  defer c.Close()
-
-  err = c.Call(name, args, reply)
-  if err == nil {
-    return true
-  }
-
-  fmt.Println(err)
-  return false
+type MetaData struct {
+  Epoch int    // Start of the sender's latest Membership
+  From  string // sender
+  Done  int
+  Dones []int // sender's doneMap; followers only hear from the leader
 }
 
 //
@@ -149,27 +161,52 @@ func call(srv string, name string, args interface{}, reply interface{}) bool {
 //
 func (px *Paxos) Start(seq int, v interface{}) {
   // Your code here.
-  if seq < px.Min() {
+  if seq < px.forgetPoint() {
     return
   }
   go func() {
     instance := px.getInstance(seq)
     instance.mu.Lock()
     defer instance.mu.Unlock()
-    for !px.dead {
-      if instance.decidedValue != nil {
+    forwardedTo := ""
+    for k := 0; !px.dead; k++ {
+      if decided, _ := px.Status(seq); decided || seq < px.forgetPoint() {
+        break
+      }
+      peers := px.peersFor(seq)
+      if indexOf(peers, px.self) < 0 {
+        // only members may propose; ask each of them in turn.
+        if !px.forward(peers[k%len(peers)], seq, v) {
+          px.backoff()
+          continue
+        }
         break
       }
-      instance.proposer.highestSeenProposedNumber++
-      instance.proposer.proposedNumber = instance.proposer.highestSeenProposedNumber
-      ok, value := px.propose(instance, seq)
+      // hand the value to the leader, once per leader we hear of.
+      leader := px.getLeaderHint()
+      if leader != "" && leader != px.self && leader != forwardedTo {
+        forwardedTo = leader
+        if px.forward(leader, seq, v) {
+          break
+        }
+        continue
+      }
+      ballot, value, ok := px.leading(seq)
       if !ok {
+        if !px.elect(seq) {
+          // the leader may only have been unreachable for a moment,
+          // and holding a lease that keeps us from taking over.
+          forwardedTo = ""
+          px.backoff()
+        }
         continue
       }
       if value != nil {
+        // someone may have chosen this already; we must propose it.
         v = value
       }
-      if !px.requestAccept(instance, seq, v) {
+      if !px.requestAccept(seq, ballot, v) {
+        px.abdicate(ballot)
         continue
       }
       px.decide(seq, v)
@@ -178,86 +215,85 @@ func (px *Paxos) Start(seq int, v interface{}) {
   }()
 }
 
-func (px *Paxos) propose(instance *Instance, seq int) (bool, interface{}) {
-  count := 0
-  highestProposedNumber := instance.proposer.highestSeenProposedNumber
-  highestAcceptedNumber := -1
-  var highestAcceptedValue interface{}
-  for i := 0; i < len(px.peers); i++ {
-    args := &Proposal{PROPOSE, instance.proposer.proposedNumber, seq, nil, px.initMeta()}
-    reply := Response{}
-    flag := true
-    if i != px.me {
-      flag = call(px.peers[i], "Paxos.Receive", args, &reply)
-    } else {
-      px.Receive(args, &reply)
-    }
-    if !flag {
-      continue
-    }
-    px.updateMeta(reply.Meta)
-    if reply.Approved {
+func (px *Paxos) requestAccept(seq int, ballot int, value interface{}) bool {
+  highestProposedNumber := ballot
+  peers := px.peersFor(seq)
+  need := len(peers)/2 + 1
+  count, refused := 0, 0
+  args := &Proposal{ACCEPT, ballot, seq, value, px.initMeta()}
+  px.broadcast(peers, args, func(reply *Response) bool {
+    if reply.Snapshot != nil {
+      px.saveSnapshot(*reply.Snapshot, false)
+      refused++
+    } else if reply.Approved {
       count++
-      if reply.Number > highestAcceptedNumber {
-        //fmt.Printf("Get Propose reponse: %d back to %d, seq: %d, N_a: %d, N_v: %d \n", reply.Meta.Me, px.me, seq, reply.Number, reply.Value)
-        highestAcceptedNumber = reply.Number
-        highestAcceptedValue = reply.Value
-      }
     } else {
       highestProposedNumber = max(highestProposedNumber, reply.Number)
+      refused++
     }
-  }
+    return count >= need || refused > len(peers)-need
+  })
   // make sure the proposer get the latest and max proposed number
-  instance.proposer.highestSeenProposedNumber = highestProposedNumber
-  if count > len(px.peers)/2 {
-    return true, highestAcceptedValue
-  } else {
-    return false, nil
-  }
+  px.sawBallot(seq, highestProposedNumber)
+  return count >= need
 }
 
-func (px *Paxos) requestAccept(instance *Instance, seq int, value interface{}) bool {
-  highestProposedNumber := instance.proposer.highestSeenProposedNumber
-  count := 0
-  for i := 0; i < len(px.peers); i++ {
-    args := &Proposal{ACCEPT, instance.proposer.proposedNumber, seq, value, px.initMeta()}
-    reply := Response{}
-    flag := true
-    if i != px.me {
-      flag = call(px.peers[i], "Paxos.Receive", args, &reply)
-    } else {
-      px.Receive(args, &reply)
-    }
-    if flag {
-      px.updateMeta(reply.Meta)
-      if reply.Approved {
-        count++
-      } else {
-        highestProposedNumber = max(highestProposedNumber, reply.Number)
+//
+// send args to every peer at once, and hand their replies to handle
+// as they come in, until it returns true or every peer has answered
+// or given up. a peer that is slow or loses the reply then holds
+// up the round only if we need it for a majority.
+//
+func (px *Paxos) broadcast(peers []string, args *Proposal, handle func(reply *Response) bool) {
+  replies := make(chan *Response, len(peers))
+  for _, peer := range peers {
+    go func(peer string) {
+      reply := &Response{}
+      if peer == px.self {
+        px.Receive(args, reply)
+      } else if !px.pool.Call(peer, "Paxos.Receive", args, reply) {
+        replies <- nil
+        return
       }
+      px.updateMeta(reply.Meta)
+      replies <- reply
+    }(peer)
+  }
+  for range peers {
+    if reply := <-replies; reply != nil && handle(reply) {
+      return
     }
   }
-  // make sure the proposer get the latest and max proposed number
-  instance.proposer.highestSeenProposedNumber = highestProposedNumber
-  return count > len(px.peers)/2
 }
 
 func (px *Paxos) decide(seq int, value interface{}) {
-  var records = make([]bool, len(px.peers))
+  peers := px.peersFor(seq)
+  var records = make([]bool, len(peers))
   for i := range records {
     records[i] = false
   }
   count := 0
 
-  for i := 0; count < len(px.peers); i = (i + 1) % len(px.peers) {
+  // keep trying until every peer knows, backing off between rounds.
+  // tell ourselves first, so a leader with a lease learns every
+  // decision before anyone else can act on it.
+  to := 10 * time.Millisecond
+  first := max(indexOf(peers, px.self), 0)
+  for i := first; count < len(peers) && !px.dead; i = (i + 1) % len(peers) {
+    if i == first && count > 0 {
+      time.Sleep(to)
+      if to < time.Second {
+        to *= 2
+      }
+    }
     if records[i] {
       continue
     }
     args := &Proposal{DECIDE, 0, seq, value, px.initMeta()}
     reply := Response{}
     flag := true
-    if i != px.me {
-      flag = call(px.peers[i], "Paxos.Receive", args, &reply)
+    if peers[i] != px.self {
+      flag = px.pool.Call(peers[i], "Paxos.Receive", args, &reply)
     } else {
       px.Receive(args, &reply)
     }
@@ -275,57 +311,165 @@ func (px *Paxos) Receive(proposal *Proposal, response *Response) error {
   px.updateMeta(proposal.Meta)
   px.acceptorLock.Lock()
   defer px.acceptorLock.Unlock()
-  instance := px.getInstance(proposal.Seq)
 
   response.Meta = px.initMeta()
   response.Type = proposal.Type
+  if proposal.Type == LEASE {
+    px.grantLease(proposal, response)
+    return nil
+  }
+  if s, ok := px.snapshotFor(proposal.Seq); ok {
+    // we forgot this instance; tell the sender what it led to.
+    if proposal.Type == DECIDE {
+      response.Approved = true
+    } else {
+      response.Snapshot = &s
+    }
+    return nil
+  }
+  instance := px.getInstance(proposal.Seq)
   if proposal.Type == PROPOSE {
-    if proposal.ProposedNum <= instance.acceptor.highestProposedNumber {
+    np, accepted := px.acceptedSince(proposal.Seq)
+    // np may equal the ballot itself: the proposer goes on to ACCEPT
+    // once a majority has promised, and that can get here first.
+    if proposal.ProposedNum < np {
+      response.Approved = false
+      response.Number = np
+    } else if px.leasedToOther(px.ballotOwner(proposal.Seq, proposal.ProposedNum)) {
+      // we promised the lease holder not to. its ballot tells the
+      // proposer whom to forward to instead.
       response.Approved = false
-      response.Number = instance.acceptor.highestProposedNumber
+      response.Number = px.promise.Ballot
     } else {
-      instance.acceptor.highestProposedNumber = proposal.ProposedNum
+      promise := Promise{proposal.ProposedNum, proposal.Seq}
+      if px.promise.Ballot > 0 {
+        // never shrink the range an earlier promise covered.
+        promise.From = min(promise.From, px.promise.From)
+      }
+      err := px.persist(walRecord{Kind: walPromise, Np: promise.Ballot, Seq: promise.From})
+      if err != nil {
+        return err
+      }
+      px.promise = promise
+      px.setLeaderHint(px.ballotOwner(proposal.Seq, proposal.ProposedNum))
       response.Approved = true
-      response.Number = instance.acceptor.highestAcceptedNumber
-      response.Value = instance.acceptor.highestAcceptedValue
+      response.Accepted = accepted
     }
   } else if proposal.Type == ACCEPT {
-    if proposal.ProposedNum < instance.acceptor.highestProposedNumber {
+    if np := px.promisedNumber(proposal.Seq, instance); proposal.ProposedNum < np {
       response.Approved = false
-      response.Number = instance.acceptor.highestProposedNumber
+      response.Number = np
     } else {
       //fmt.Printf("Accept %d to %d, seq: %d, N: %d, V: %d \n",
       //  proposal.Meta.Me, px.me, proposal.Seq, proposal.ProposedNum, proposal.Value)
-      instance.acceptor.highestProposedNumber = proposal.ProposedNum
-      instance.acceptor.highestAcceptedNumber = proposal.ProposedNum
-      instance.acceptor.highestAcceptedValue = proposal.Value
+      a := Acceptor{proposal.ProposedNum, proposal.ProposedNum, proposal.Value}
+      if err := px.persistAcceptor(proposal.Seq, a); err != nil {
+        return err
+      }
+      instance.acceptor = a
+      px.setLeaderHint(px.ballotOwner(proposal.Seq, proposal.ProposedNum))
       response.Approved = true
       response.Number = proposal.ProposedNum
     }
   } else if proposal.Type == DECIDE {
+    if instance.decidedValue == nil {
+      err := px.persist(walRecord{Kind: walDecided, Seq: proposal.Seq, Value: proposal.Value})
+      if err != nil {
+        return err
+      }
+    }
+    px.mu.Lock()
     instance.decidedValue = proposal.Value
     px.maxSeq = max(px.maxSeq, proposal.Seq)
+    px.learnReconfig(proposal.Seq, proposal.Value)
+    px.notifyDecided()
+    px.mu.Unlock()
     response.Approved = true
   }
   return nil
 }
 
+func (px *Paxos) persistAcceptor(seq int, a Acceptor) error {
+  return px.persist(walRecord{Kind: walAcceptor, Seq: seq,
+    Np: a.highestProposedNumber, Na: a.highestAcceptedNumber, Va: a.highestAcceptedValue})
+}
+
 func (px *Paxos) initMeta() MetaData {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  latest := px.latestLocked()
+  dones := make([]int, len(latest.Peers))
+  for i, peer := range latest.Peers {
+    dones[i] = px.getDone(peer)
+  }
   return MetaData{
-    Me:   px.me,
-    Done: px.doneMap[px.me],
+    Epoch: latest.Start,
+    From:  px.self,
+    Done:  px.getDone(px.self),
+    Dones: dones,
   }
 }
 
 func (px *Paxos) updateMeta(meta MetaData) {
   px.mu.Lock()
-  defer px.mu.Unlock()
-  px.doneMap[meta.Me] = max(px.doneMap[meta.Me], meta.Done)
+  if meta.From != "" {
+    px.setDone(meta.From, meta.Done)
+  }
+  if m, ok := px.epochLocked(meta.Epoch); ok && len(meta.Dones) == len(m.Peers) {
+    for i, done := range meta.Dones {
+      px.setDone(m.Peers[i], done)
+    }
+  }
+  // otherwise we haven't heard of that Membership yet.
   px.cleanDoneValues()
+  px.mu.Unlock()
+  px.flushDone()
+}
+
+// caller must hold px.mu.
+func (px *Paxos) getDone(peer string) int {
+  if done, ok := px.doneMap[peer]; ok {
+    return done
+  }
+  return -1
+}
+
+// caller must hold px.mu.
+// the increase reaches the wal at the next flushDone().
+func (px *Paxos) setDone(peer string, done int) {
+  if done <= px.getDone(peer) {
+    return
+  }
+  px.doneMap[peer] = done
+  if px.wal != nil {
+    px.doneLog[peer] = done
+  }
 }
 
+//
+// write the doneMap increases that setDone() collected, with
+// a single fsync and without holding px.mu, since gossip brings
+// them on every message. losing them is harmless (replay keeps
+// the max, and peers tell us again), so errors are ignored.
+//
+func (px *Paxos) flushDone() {
+  px.mu.Lock()
+  if len(px.doneLog) == 0 {
+    px.mu.Unlock()
+    return
+  }
+  records := make([]walRecord, 0, len(px.doneLog))
+  for peer, done := range px.doneLog {
+    records = append(records, walRecord{Kind: walDone, Peer: peer, Done: done})
+  }
+  px.doneLog = map[string]int{}
+  px.mu.Unlock()
+  px.wal.append(records...)
+}
+
+// caller must hold px.mu.
 func (px *Paxos) cleanDoneValues() {
-  end := px.Min()
+  end := px.forgetPointLocked()
   for seq := px.toCleanSeq; seq < end; seq++ {
     delete(px.instances, seq)
   }
@@ -346,19 +490,6 @@ func min(a, b int) int {
   return b
 }
 
-func minOfArray(arr []int) int {
-  if len(arr) == 0 {
-    return -1
-  }
-  if len(arr) == 1 {
-    return arr[0]
-  }
-  res := arr[0]
-  for i := 1; i < len(arr); i++ {
-    res = min(res, arr[i])
-  }
-  return res
-}
 
 //
 // the application on this machine is done with
@@ -369,9 +500,11 @@ func minOfArray(arr []int) int {
 func (px *Paxos) Done(seq int) {
   // Your code here.
   px.mu.Lock()
-  defer px.mu.Unlock()
-  px.doneMap[px.me] = max(px.doneMap[px.me], seq)
+  px.setDone(px.self, seq)
   px.cleanDoneValues()
+  px.mu.Unlock()
+  px.flushDone()
+  px.maybeSnapshot(seq)
   return
 }
 
@@ -413,9 +546,35 @@ func (px *Paxos) Max() int {
 // missed -- the other peers therefor cannot forget these
 // instances.
 //
+// "all" means the peers in the latest Membership; peers
+// that have been removed no longer hold Min() back.
+//
 func (px *Paxos) Min() int {
   // You code here.
-  return minOfArray(px.doneMap) + 1
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.minLocked()
+}
+
+//
+// an instance may be forgotten once every peer in the Membership
+// in effect for it is Done() with it, so a peer that has been
+// removed can still learn the instances it was a member for.
+// caller must hold px.mu.
+//
+func (px *Paxos) minLocked() int {
+  res := 0
+  for i, m := range px.members {
+    done := px.getDone(m.Peers[0])
+    for _, peer := range m.Peers[1:] {
+      done = min(done, px.getDone(peer))
+    }
+    res = max(done+1, m.Start)
+    if i+1 < len(px.members) && res < px.members[i+1].Start {
+      break
+    }
+  }
+  return res
 }
 
 //
@@ -439,14 +598,21 @@ func (px *Paxos) Status(seq int) (bool, interface{}) {
 
 //
 // tell the peer to shut itself down.
-// for testing.
-// please do not change this function.
+// for testing. besides the listener, this closes the log and
+// the connection pool, and wakes anyone blocked in Wait().
 //
 func (px *Paxos) Kill() {
   px.dead = true
   if px.l != nil {
     px.l.Close()
   }
+  if px.wal != nil {
+    px.wal.close()
+  }
+  px.pool.Close()
+  px.mu.Lock()
+  px.notifyDecided()
+  px.mu.Unlock()
 }
 
 //
@@ -454,18 +620,39 @@ func (px *Paxos) Kill() {
 // the ports of all the paxos peers (including this one)
 // are in peers[]. this servers port is peers[me].
 //
-func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
+func Make(peers []string, me int, rpcs *rpc.Server, t transport.Transport) *Paxos {
+  return MakeDurable(peers, me, rpcs, "", t)
+}
+
+//
+// like Make, but log acceptor state to dir and recover
+// whatever a previous incarnation of this peer left there.
+// an empty dir keeps everything in memory.
+//
+func MakeDurable(peers []string, me int, rpcs *rpc.Server, dir string,
+  t transport.Transport) *Paxos {
+  gob.Register(Reconfig{})
+
   px := &Paxos{}
   px.peers = peers
   px.me = me
+  px.pool = transport.NewPool(t, rpcTimeout)
 
   // Your initialization code here.
+  px.self = peers[me]
+  px.members = []Membership{{0, peers}}
   px.instances = make(map[int]*Instance)
-  px.doneMap = make([]int, len(px.peers))
-  for i := 0; i < len(px.doneMap); i++ {
-    px.doneMap[i] = -1
-  }
+  px.decidedCh = make(chan struct{})
+  px.snapshot.Seq = -1
+  px.doneMap = make(map[string]int)
+  px.doneLog = make(map[string]int)
   px.maxSeq = -1
+  px.leader.ballot = -1
+  if dir != "" {
+    if err := px.recover(dir); err != nil {
+      log.Fatal("paxos recover: ", err)
+    }
+  }
 
   if rpcs != nil {
     // caller will create socket &c
@@ -475,47 +662,27 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
     rpcs.Register(px)
 
     // prepare to receive connections from clients.
-    // change "unix" to "tcp" to use over a network.
-    os.Remove(peers[me]) // only needed for "unix"
-    l, e := net.Listen("unix", peers[me])
+    l, e := t.Listen(peers[me])
     if e != nil {
       log.Fatal("listen error: ", e)
     }
     px.l = l
 
-    // please do not change any of the following code,
-    // or do anything to subvert it.
+    // transport.Serve() is the accept loop, and simulates the
+    // unreliable network the tests depend on; please do not
+    // subvert it.
 
     // create a thread to accept RPC connections
-    go func() {
-      for px.dead == false {
-        conn, err := px.l.Accept()
-        if err == nil && px.dead == false {
-          if px.unreliable && (rand.Int63()%1000) < 100 {
-            // discard the request.
-            conn.Close()
-          } else if px.unreliable && (rand.Int63()%1000) < 200 {
-            // process the request but force discard of reply.
-            c1 := conn.(*net.UnixConn)
-            f, _ := c1.File()
-            err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-            if err != nil {
-              fmt.Printf("shutdown: %v\n", err)
-            }
-            px.rpcCount++
-            go rpcs.ServeConn(conn)
-          } else {
-            px.rpcCount++
-            go rpcs.ServeConn(conn)
-          }
-        } else if err == nil {
-          conn.Close()
-        }
-        if err != nil && px.dead == false {
-          fmt.Printf("Paxos(%v) accept: %v\n", me, err.Error())
-        }
-      }
-    }()
+    go transport.Serve(px.l, rpcs, transport.Hooks{
+      Name:       fmt.Sprintf("Paxos(%v)", me),
+      Dead:       func() bool { return px.dead },
+      Unreliable: func() bool { return px.unreliable },
+      Served:     func() { px.rpcCount++ },
+    })
+  }
+
+  if len(px.members) == 1 {
+    px.syncMembers()
   }
 
   return px
@@ -0,0 +1,167 @@
+package paxos
+
+//
+// application snapshots.
+//
+// px.SetSnapshotter(take func() []byte, install func([]byte))
+//
+// with a snapshotter, Done(seq) now and then calls take() and keeps
+// the result as the state after instance seq. this peer then forgets
+// every instance <= seq even if other peers haven't called Done();
+// a peer that later needs one of those instances is sent the snapshot
+// instead, in reply to whatever message it sent us.
+//
+// take() is called from inside Done(), and install() from inside the
+// application's own Wait() for an instance the snapshot covers, so
+// both run while the application holds whatever locks it held for
+// those calls, and must not take them again. install() must leave
+// the application as it was after the snapshot's instance; Wait()
+// then returns ErrForgotten, and the application carries on after
+// the snapshot's instance. px.Snapshot(seq) takes one right away.
+//
+
+// take a snapshot once Done() has moved this far past the last one.
+const snapshotInterval = 100
+
+type Snapshot struct {
+  Seq  int // state after this instance; -1 if none
+  Data []byte
+}
+
+type SnapshotArgs struct {
+  Seq int
+}
+
+type SnapshotReply struct {
+  Snapshot Snapshot
+}
+
+func (px *Paxos) SetSnapshotter(take func() []byte, install func([]byte)) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  px.takeSnapshot = take
+  px.installSnapshot = install
+}
+
+//
+// the first instance this peer still remembers.
+//
+func (px *Paxos) forgetPoint() int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.forgetPointLocked()
+}
+
+// caller must hold px.mu.
+func (px *Paxos) forgetPointLocked() int {
+  return max(px.minLocked(), px.snapshot.Seq+1)
+}
+
+//
+// called by Done(seq): take a snapshot if one is due.
+//
+func (px *Paxos) maybeSnapshot(seq int) {
+  px.mu.Lock()
+  take := px.takeSnapshot
+  due := take != nil && seq-px.snapshot.Seq >= snapshotInterval
+  px.mu.Unlock()
+  if !due {
+    return
+  }
+  px.saveSnapshot(Snapshot{seq, take()}, true)
+}
+
+//
+// take a snapshot after instance seq now, rather than when Done()
+// finds one due: a peer that Reconfigure adds needs one covering
+// every instance the others have forgotten. the caller must hold
+// the locks take() expects, as it would for Done(seq).
+//
+func (px *Paxos) Snapshot(seq int) {
+  px.mu.Lock()
+  take := px.takeSnapshot
+  px.mu.Unlock()
+  if take != nil {
+    px.saveSnapshot(Snapshot{seq, take()}, true)
+  }
+}
+
+//
+// adopt s if it is newer than what we have, and forget the
+// instances it covers. installed says whether the application
+// already reflects it.
+//
+func (px *Paxos) saveSnapshot(s Snapshot, installed bool) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if s.Seq <= px.snapshot.Seq {
+    return
+  }
+  if px.wal != nil {
+    if err := px.wal.append(walRecord{Kind: walSnapshot, Seq: s.Seq, Data: s.Data}); err != nil {
+      return
+    }
+  }
+  px.snapshot = s
+  px.snapshotInstalled = installed
+  px.maxSeq = max(px.maxSeq, s.Seq)
+  px.cleanDoneValues()
+  px.notifyDecided()
+}
+
+//
+// the snapshot to send someone asking about seq, if seq is one
+// of the instances it replaced.
+//
+func (px *Paxos) snapshotFor(seq int) (Snapshot, bool) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if px.takeSnapshot == nil && px.installSnapshot == nil || seq > px.snapshot.Seq {
+    return Snapshot{}, false
+  }
+  return px.snapshot, true
+}
+
+//
+// called by Wait(seq) for a forgotten seq: hand the application the
+// snapshot that covers seq, unless it already has it.
+//
+func (px *Paxos) catchUp(seq int) {
+  px.mu.Lock()
+  install := px.installSnapshot
+  if install == nil || px.snapshotInstalled || seq > px.snapshot.Seq {
+    px.mu.Unlock()
+    return
+  }
+  data := px.snapshot.Data
+  px.snapshotInstalled = true
+  px.mu.Unlock()
+  install(data)
+}
+
+//
+// another peer wants the snapshot covering args.Seq.
+//
+func (px *Paxos) GetSnapshot(args *SnapshotArgs, reply *SnapshotReply) error {
+  reply.Snapshot.Seq = -1
+  if s, ok := px.snapshotFor(args.Seq); ok {
+    reply.Snapshot = s
+  }
+  return nil
+}
+
+//
+// ask the other peers for a snapshot covering seq.
+//
+func (px *Paxos) fetchSnapshot(seq int) {
+  for _, peer := range px.peersFor(seq) {
+    if peer == px.self {
+      continue
+    }
+    var reply SnapshotReply
+    if px.pool.Call(peer, "Paxos.GetSnapshot", &SnapshotArgs{seq}, &reply) && reply.Snapshot.Seq >= seq {
+      px.saveSnapshot(reply.Snapshot, false)
+      return
+    }
+  }
+}
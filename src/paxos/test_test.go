@@ -1,6 +1,7 @@
 package paxos
 
 import (
+  "context"
   "math/rand"
   "testing"
 )
@@ -9,6 +10,8 @@ import "strconv"
 import "os"
 import "time"
 import "fmt"
+import "sync"
+import "transport"
 
 func port(tag string, host int) string {
   s := "/var/tmp/824-"
@@ -89,7 +92,7 @@ func noTestSpeed(t *testing.T) {
     pxh[i] = port("time", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, transport.Unix{})
   }
 
   t0 := time.Now()
@@ -115,7 +118,7 @@ func TestBasic(t *testing.T) {
     pxh[i] = port("basic", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, transport.Unix{})
   }
 
   fmt.Printf("Test: Single proposer ...\n")
@@ -175,7 +178,7 @@ func TestDeaf(t *testing.T) {
    pxh[i] = port("deaf", i)
  }
  for i := 0; i < npaxos; i++ {
-   pxa[i] = Make(pxh, i, nil)
+   pxa[i] = Make(pxh, i, nil, transport.Unix{})
  }
 
  fmt.Printf("Test: Deaf proposer ...\n")
@@ -218,7 +221,7 @@ func TestForget(t *testing.T) {
    pxh[i] = port("gc", i)
  }
  for i := 0; i < npaxos; i++ {
-   pxa[i] = Make(pxh, i, nil)
+   pxa[i] = Make(pxh, i, nil, transport.Unix{})
  }
 
  fmt.Printf("Test: Forgetting ...\n")
@@ -300,7 +303,7 @@ func TestManyForget(t *testing.T) {
    pxh[i] = port("manygc", i)
  }
  for i := 0; i < npaxos; i++ {
-   pxa[i] = Make(pxh, i, nil)
+   pxa[i] = Make(pxh, i, nil, transport.Unix{})
    pxa[i].unreliable = true
  }
 
@@ -369,7 +372,7 @@ func TestForgetMem(t *testing.T) {
    pxh[i] = port("gcmem", i)
  }
  for i := 0; i < npaxos; i++ {
-   pxa[i] = Make(pxh, i, nil)
+   pxa[i] = Make(pxh, i, nil, transport.Unix{})
  }
 
  pxa[0].Start(0, "x")
@@ -433,7 +436,7 @@ func TestRPCCount(t *testing.T) {
    pxh[i] = port("count", i)
  }
  for i := 0; i < npaxos; i++ {
-   pxa[i] = Make(pxh, i, nil)
+   pxa[i] = Make(pxh, i, nil, transport.Unix{})
  }
 
  ninst1 := 5
@@ -508,7 +511,7 @@ func TestMany(t *testing.T) {
    pxh[i] = port("many", i)
  }
  for i := 0; i < npaxos; i++ {
-   pxa[i] = Make(pxh, i, nil)
+   pxa[i] = Make(pxh, i, nil, transport.Unix{})
    pxa[i].Start(0, 0)
  }
 
@@ -558,20 +561,20 @@ func TestOld(t *testing.T) {
    pxh[i] = port("old", i)
  }
 
- pxa[1] = Make(pxh, 1, nil)
- pxa[2] = Make(pxh, 2, nil)
- pxa[3] = Make(pxh, 3, nil)
+ pxa[1] = Make(pxh, 1, nil, transport.Unix{})
+ pxa[2] = Make(pxh, 2, nil, transport.Unix{})
+ pxa[3] = Make(pxh, 3, nil, transport.Unix{})
  pxa[1].Start(1, 111)
 
  waitmajority(t, pxa, 1)
 
- pxa[0] = Make(pxh, 0, nil)
+ pxa[0] = Make(pxh, 0, nil, transport.Unix{})
  pxa[0].Start(1, 222)
 
  waitn(t, pxa, 1, 4)
 
  if false {
-   pxa[4] = Make(pxh, 4, nil)
+   pxa[4] = Make(pxh, 4, nil, transport.Unix{})
    waitn(t, pxa, 1, npaxos)
  }
 
@@ -595,7 +598,7 @@ func TestManyUnreliable(t *testing.T) {
    pxh[i] = port("manyun", i)
  }
  for i := 0; i < npaxos; i++ {
-   pxa[i] = Make(pxh, i, nil)
+   pxa[i] = Make(pxh, i, nil, transport.Unix{})
    pxa[i].unreliable = true
    pxa[i].Start(0, 0)
  }
@@ -687,7 +690,7 @@ func TestPartition(t *testing.T) {
        pxh[j] = pp(tag, i, j)
      }
    }
-   pxa[i] = Make(pxh, i, nil)
+   pxa[i] = Make(pxh, i, nil, transport.Unix{})
  }
  defer part(t, tag, npaxos, []int{}, []int{}, []int{})
 
@@ -789,7 +792,7 @@ func TestLots(t *testing.T) {
        pxh[j] = pp(tag, i, j)
      }
    }
-   pxa[i] = Make(pxh, i, nil)
+   pxa[i] = Make(pxh, i, nil, transport.Unix{})
    pxa[i].unreliable = true
  }
  defer part(t, tag, npaxos, []int{}, []int{}, []int{})
@@ -874,3 +877,577 @@ func TestLots(t *testing.T) {
 
  fmt.Printf("  ... Passed\n")
 }
+
+func TestPersistence(t *testing.T) {
+ runtime.GOMAXPROCS(4)
+
+ fmt.Printf("Test: Durable peers survive restart ...\n")
+
+ const npaxos = 3
+ var pxa []*Paxos = make([]*Paxos, npaxos)
+ var pxh []string = make([]string, npaxos)
+ var dirs []string = make([]string, npaxos)
+ defer cleanup(pxa)
+
+ for i := 0; i < npaxos; i++ {
+   pxh[i] = port("wal", i)
+   dirs[i] = port("waldir", i)
+   os.RemoveAll(dirs[i])
+   defer os.RemoveAll(dirs[i])
+ }
+ for i := 0; i < npaxos; i++ {
+   pxa[i] = MakeDurable(pxh, i, nil, dirs[i], transport.Unix{})
+ }
+
+ for seq := 0; seq < 5; seq++ {
+   pxa[seq % npaxos].Start(seq, seq * 100)
+   waitn(t, pxa, seq, npaxos)
+ }
+ for i := 0; i < npaxos; i++ {
+   pxa[i].Done(1)
+ }
+
+ // crash and restart every peer.
+ for i := 0; i < npaxos; i++ {
+   pxa[i].Kill()
+ }
+ time.Sleep(500 * time.Millisecond)
+ for i := 0; i < npaxos; i++ {
+   pxa[i] = MakeDurable(pxh, i, nil, dirs[i], transport.Unix{})
+ }
+
+ for seq := 2; seq < 5; seq++ {
+   for i := 0; i < npaxos; i++ {
+     decided, v := pxa[i].Status(seq)
+     if !decided || v != seq * 100 {
+       t.Fatalf("peer %v lost decision %v after restart; got %v %v", i, seq, decided, v)
+     }
+   }
+ }
+ for i := 0; i < npaxos; i++ {
+   if pxa[i].Max() != 4 {
+     t.Fatalf("wrong Max() %v after restart", pxa[i].Max())
+   }
+   if pxa[i].doneMap[pxh[i]] != 1 {
+     t.Fatalf("peer %v lost its Done() after restart", i)
+   }
+ }
+
+ // restarted peers still reach agreement, and can't be talked
+ // out of a value they already accepted.
+ pxa[1].Start(5, "five")
+ waitn(t, pxa, 5, npaxos)
+ pxa[0].Kill()
+ pxa[0] = MakeDurable(pxh, 0, nil, dirs[0], transport.Unix{})
+ pxa[0].Start(5, "other")
+ time.Sleep(1 * time.Second)
+ if decided, v := pxa[0].Status(5); !decided || v != "five" {
+   t.Fatalf("restarted peer decided %v %v, expected five", decided, v)
+ }
+
+ fmt.Printf("  ... Passed\n")
+}
+
+func TestPersistFailure(t *testing.T) {
+ fmt.Printf("Test: Failed log write leaves acceptor alone ...\n")
+
+ pxh := []string{port("walfail", 0)}
+ dir := port("walfaildir", 0)
+ os.RemoveAll(dir)
+ defer os.RemoveAll(dir)
+ px := MakeDurable(pxh, 0, nil, dir, transport.Unix{})
+ defer px.Kill()
+
+ px.wal.close()
+ var rsp Response
+ err := px.Receive(&Proposal{Type: ACCEPT, ProposedNum: 5, Seq: 3,
+   Value: "lost", Meta: px.initMeta()}, &rsp)
+ if err == nil {
+   t.Fatalf("ACCEPT succeeded with a closed log")
+ }
+ a := px.getInstance(3).acceptor
+ if a.highestAcceptedNumber != 0 || a.highestAcceptedValue != nil {
+   t.Fatalf("acceptor took %v %v without logging it",
+     a.highestAcceptedNumber, a.highestAcceptedValue)
+ }
+
+ fmt.Printf("  ... Passed\n")
+}
+
+func TestLeader(t *testing.T) {
+ runtime.GOMAXPROCS(4)
+
+ fmt.Printf("Test: Stable leader skips Phase 1 ...\n")
+
+ const npaxos = 3
+ var pxa []*Paxos = make([]*Paxos, npaxos)
+ var pxh []string = make([]string, npaxos)
+ defer cleanup(pxa)
+
+ for i := 0; i < npaxos; i++ {
+   pxh[i] = port("leader", i)
+ }
+ for i := 0; i < npaxos; i++ {
+   pxa[i] = Make(pxh, i, nil, transport.Unix{})
+ }
+
+ pxa[0].Start(0, "elect")
+ waitn(t, pxa, 0, npaxos)
+ time.Sleep(500 * time.Millisecond)
+
+ ballot := pxa[0].promise.Ballot
+ total1 := 0
+ for j := 0; j < npaxos; j++ {
+   total1 += pxa[j].rpcCount
+ }
+
+ ninst := 10
+ for seq := 1; seq <= ninst; seq++ {
+   pxa[seq % npaxos].Start(seq, seq)
+   waitn(t, pxa, seq, npaxos)
+ }
+ time.Sleep(500 * time.Millisecond)
+
+ for j := 0; j < npaxos; j++ {
+   if pxa[j].promise.Ballot != ballot {
+     t.Fatalf("peer %v saw a new Phase 1; ballot %v, expected %v", j, pxa[j].promise.Ballot, ballot)
+   }
+ }
+
+ total2 := 0
+ for j := 0; j < npaxos; j++ {
+   total2 += pxa[j].rpcCount
+ }
+ total2 -= total1
+
+ // per agreement: 1 forward, 2 accepts, 2 decides.
+ expected := ninst * 5
+ if total2 > expected {
+   t.Fatalf("too many RPCs with a stable leader; got %v, expected at most %v", total2, expected)
+ }
+
+ fmt.Printf("  ... Passed\n")
+}
+
+func TestLease(t *testing.T) {
+ runtime.GOMAXPROCS(4)
+
+ const npaxos = 3
+ var pxa []*Paxos = make([]*Paxos, npaxos)
+ var pxh []string = make([]string, npaxos)
+ defer cleanup(pxa)
+
+ for i := 0; i < npaxos; i++ {
+   pxh[i] = port("lease", i)
+ }
+ for i := 0; i < npaxos; i++ {
+   pxa[i] = Make(pxh, i, nil, transport.Unix{})
+ }
+
+ fmt.Printf("Test: Only the leader gets a lease ...\n")
+
+ pxa[0].Start(0, "elect")
+ waitn(t, pxa, 0, npaxos)
+
+ seq, ok := pxa[0].LeaseRead()
+ if !ok {
+   t.Fatalf("leader did not get a lease")
+ }
+ if seq != 0 {
+   t.Fatalf("LeaseRead() said to apply up to %v, expected 0", seq)
+ }
+ for i := 1; i < npaxos; i++ {
+   if _, ok := pxa[i].LeaseRead(); ok {
+     t.Fatalf("peer %v got a lease, but isn't leader", i)
+   }
+ }
+
+ // the others can still get values decided, through the leader.
+ pxa[1].Start(1, "x")
+ waitn(t, pxa, 1, npaxos)
+ if seq, ok := pxa[0].LeaseRead(); !ok || seq != 1 {
+   t.Fatalf("LeaseRead() returned %v %v, expected 1 true", seq, ok)
+ }
+
+ fmt.Printf("  ... Passed\n")
+
+ fmt.Printf("Test: Nobody else leads until the lease runs out ...\n")
+
+ pxa[0].LeaseRead()
+ t0 := time.Now()
+ if pxa[1].elect(2) {
+   t.Fatalf("peer 1 won Phase 1 while peer 0 held a lease")
+ }
+
+ pxa[0].Kill()
+ pxa[1].Start(2, "after")
+ waitn(t, pxa[1:], 2, npaxos - 1)
+ if d := time.Since(t0); d < leaseSpan() {
+   t.Fatalf("a new leader took over after %v, before the lease ran out", d)
+ }
+ if _, ok := pxa[1].LeaseRead(); !ok {
+   t.Fatalf("new leader did not get a lease")
+ }
+
+ fmt.Printf("  ... Passed\n")
+}
+
+func TestReconfigure(t *testing.T) {
+ runtime.GOMAXPROCS(4)
+
+ fmt.Printf("Test: Replace a dead peer ...\n")
+
+ const npaxos = 4
+ var pxa []*Paxos = make([]*Paxos, npaxos)
+ var pxh []string = make([]string, npaxos)
+ defer cleanup(pxa)
+
+ for i := 0; i < npaxos; i++ {
+   pxh[i] = port("reconfig", i)
+ }
+ for i := 0; i < 3; i++ {
+   pxa[i] = Make(pxh[:3], i, nil, transport.Unix{})
+ }
+
+ pxa[0].Start(0, "before")
+ waitn(t, pxa, 0, 3)
+ // Max() runs ahead of what's decided; the change must still go
+ // in the first open instance, so it covers everything after.
+ pxa[1].Start(Alpha - 1, "ahead")
+ waitn(t, pxa, Alpha - 1, 3)
+
+ pxa[2].Kill()
+ pxa[2] = nil
+
+ newPeers := []string{pxh[0], pxh[1], pxh[3]}
+ s := pxa[0].Reconfigure(newPeers)
+ if s != 1 {
+   t.Fatalf("Reconfigure() agreed at %v, expected 1", s)
+ }
+
+ pxa[3] = Make(newPeers, 2, nil, transport.Unix{})
+ if len(pxa[3].members) != 2 {
+   t.Fatalf("new peer did not learn the membership history")
+ }
+
+ last := s + Alpha + 2
+ for seq := s + 1; seq <= last; seq++ {
+   pxa[seq % 2].Start(seq, seq)
+   waitn(t, []*Paxos{pxa[0], pxa[1]}, seq, 2)
+ }
+ waitn(t, pxa, last, 3)
+
+ // the dead peer still holds back the instances it was a member
+ // for, but not the ones after.
+ for _, i := range []int{0, 1, 3} {
+   pxa[i].Done(last)
+ }
+ last++
+ pxa[0].Start(last, "poke")
+ waitn(t, pxa, last, 3)
+ time.Sleep(500 * time.Millisecond)
+ for _, i := range []int{0, 1, 3} {
+   if pxa[i].Min() != 0 {
+     t.Fatalf("peer %v: Min() %v, expected 0", i, pxa[i].Min())
+   }
+ }
+
+ // the old set has no majority left, but the new one does.
+ pxa[1].Kill()
+ pxa[1] = nil
+ last++
+ pxa[3].Start(last, "after")
+ waitn(t, pxa, last, 2)
+
+ fmt.Printf("  ... Passed\n")
+}
+
+func TestRemoveLagging(t *testing.T) {
+ runtime.GOMAXPROCS(4)
+
+ fmt.Printf("Test: A removed peer catches up on its old instances ...\n")
+
+ const npaxos = 5
+ var pxa []*Paxos = make([]*Paxos, npaxos)
+ var pxh []string = make([]string, npaxos)
+ defer cleanup(pxa)
+
+ for i := 0; i < npaxos; i++ {
+   pxh[i] = port("lagging", i)
+ }
+ for i := 0; i < npaxos; i++ {
+   pxa[i] = Make(pxh, i, nil, transport.Unix{})
+ }
+ lag := npaxos - 1
+ others := pxa[:lag]
+
+ // the lagging peer hears nothing from here on.
+ os.Remove(pxh[lag])
+ const nold = 5
+ for seq := 0; seq < nold; seq++ {
+   pxa[seq % 2].Start(seq, seq * 10)
+   waitn(t, others, seq, lag)
+ }
+
+ s := pxa[0].Reconfigure(pxh[:lag])
+ if s != nold {
+   t.Fatalf("Reconfigure() agreed at %v, expected %v", s, nold)
+ }
+ last := s + Alpha + 2
+ for seq := s + 1; seq <= last; seq++ {
+   pxa[seq % 2].Start(seq, seq * 10)
+   waitn(t, others, seq, lag)
+ }
+ for i := 0; i < lag; i++ {
+   pxa[i].Done(last)
+ }
+ last++
+ pxa[0].Start(last, "poke")
+ waitn(t, others, last, lag)
+ time.Sleep(500 * time.Millisecond)
+ for i := 0; i < lag; i++ {
+   if pxa[i].Min() != 0 {
+     t.Fatalf("peer %v forgot instances the lagging peer hasn't seen; Min() %v", i, pxa[i].Min())
+   }
+ }
+
+ for seq := 0; seq < nold; seq++ {
+   pxa[lag].Start(seq, "late")
+ }
+ for seq := 0; seq < nold; seq++ {
+   waitn(t, pxa, seq, npaxos)
+   if _, v := pxa[lag].Status(seq); v != seq * 10 {
+     t.Fatalf("lagging peer learned %v for instance %v, expected %v", v, seq, seq * 10)
+   }
+ }
+
+ // once it is Done() with them, they can go.
+ pxa[lag].Done(s + Alpha - 1)
+ pxa[lag].Start(last + 1, "poke")
+ waitn(t, others, last + 1, lag)
+ time.Sleep(500 * time.Millisecond)
+ if pxa[0].Min() != last {
+   t.Fatalf("Min() %v after the lagging peer's Done(), expected %v", pxa[0].Min(), last)
+ }
+
+ fmt.Printf("  ... Passed\n")
+}
+
+func TestWait(t *testing.T) {
+ runtime.GOMAXPROCS(4)
+
+ fmt.Printf("Test: Wait and Subscribe ...\n")
+
+ const npaxos = 3
+ var pxa []*Paxos = make([]*Paxos, npaxos)
+ var pxh []string = make([]string, npaxos)
+ defer cleanup(pxa)
+
+ for i := 0; i < npaxos; i++ {
+   pxh[i] = port("wait", i)
+ }
+ for i := 0; i < npaxos; i++ {
+   pxa[i] = Make(pxh, i, nil, transport.Unix{})
+ }
+
+ ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+ if _, err := pxa[0].Wait(0, ctx); err != context.DeadlineExceeded {
+   t.Fatalf("Wait() on an undecided instance returned %v", err)
+ }
+ cancel()
+
+ ctx, cancel = context.WithCancel(context.Background())
+ sub := pxa[2].Subscribe(0, ctx)
+
+ // decide out of order; Subscribe must still deliver in order.
+ pxa[1].Start(2, 200)
+ waitn(t, pxa, 2, npaxos)
+ pxa[0].Start(1, 100)
+ pxa[0].Start(0, 0)
+
+ v, err := pxa[1].Wait(0, context.Background())
+ if err != nil || v != 0 {
+   t.Fatalf("Wait() returned %v %v, expected 0", v, err)
+ }
+ for seq := 0; seq < 3; seq++ {
+   select {
+   case d := <-sub:
+     if d.Seq != seq || d.Value != seq * 100 {
+       t.Fatalf("Subscribe() delivered %v, expected seq %v", d, seq)
+     }
+   case <-time.After(5 * time.Second):
+     t.Fatalf("Subscribe() did not deliver seq %v", seq)
+   }
+ }
+
+ cancel()
+ select {
+ case _, ok := <-sub:
+   if ok {
+     t.Fatalf("Subscribe() delivered after cancel")
+   }
+ case <-time.After(time.Second):
+   t.Fatalf("Subscribe() channel not closed after cancel")
+ }
+
+ for i := 0; i < npaxos; i++ {
+   pxa[i].Done(2)
+ }
+ pxa[0].Start(3, 300)
+ waitn(t, pxa, 3, npaxos)
+ if _, err := pxa[0].Wait(1, context.Background()); err != ErrForgotten {
+   t.Fatalf("Wait() on a forgotten instance returned %v", err)
+ }
+
+ fmt.Printf("  ... Passed\n")
+}
+
+//
+// a tiny application for TestSnapshot: the sum of the decided ints.
+//
+type sumApp struct {
+  mu   sync.Mutex
+  px   *Paxos
+  next int
+  sum  int
+}
+
+func (a *sumApp) take() []byte {
+  return []byte(fmt.Sprintf("%d %d", a.next, a.sum))
+}
+
+func (a *sumApp) install(data []byte) {
+  fmt.Sscanf(string(data), "%d %d", &a.next, &a.sum)
+}
+
+func (a *sumApp) run() {
+  a.px.SetSnapshotter(a.take, a.install)
+  for !a.px.dead {
+    ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    a.mu.Lock()
+    seq := a.next
+    v, err := a.px.Wait(seq, ctx)
+    if err == nil {
+      if n, ok := v.(int); ok {
+        a.sum += n
+      }
+      a.next++
+      a.px.Done(seq)
+    } else if err == ErrForgotten && a.next == seq {
+      a.next++
+    }
+    a.mu.Unlock()
+    cancel()
+  }
+}
+
+func (a *sumApp) get() int {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  return a.sum
+}
+
+func TestSnapshot(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("snapshot", i)
+  }
+
+  fmt.Printf("Test: Snapshots let peers forget without the others' Done() ...\n")
+
+  // peer 2 is down, so Min() stays at 0.
+  apps := make([]*sumApp, npaxos)
+  for i := 0; i < 2; i++ {
+    pxa[i] = Make(pxh, i, nil, transport.Unix{})
+    apps[i] = &sumApp{px: pxa[i]}
+    go apps[i].run()
+  }
+
+  const n = 3 * snapshotInterval
+  want := 0
+  for seq := 0; seq < n; seq++ {
+    pxa[seq % 2].Start(seq, seq)
+    want += seq
+  }
+
+  for iters := 0; ; iters++ {
+    if apps[0].get() == want && apps[1].get() == want {
+      break
+    }
+    if iters > 300 {
+      t.Fatalf("sums are %v and %v, expected %v", apps[0].get(), apps[1].get(), want)
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  if pxa[0].Min() != 0 {
+    t.Fatalf("Min() is %v, expected 0", pxa[0].Min())
+  }
+  for i := 0; i < 2; i++ {
+    pxa[i].mu.Lock()
+    ninstances := len(pxa[i].instances)
+    pxa[i].mu.Unlock()
+    if ninstances > n - 2 * snapshotInterval {
+      t.Fatalf("peer %v still remembers %v instances", i, ninstances)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A new peer catches up from a snapshot ...\n")
+
+  pxa[2] = Make(pxh, 2, nil, transport.Unix{})
+  apps[2] = &sumApp{px: pxa[2]}
+  go apps[2].run()
+  pxa[2].Start(n - 1, n - 1)
+
+  for iters := 0; apps[2].get() != want; iters++ {
+    if iters > 300 {
+      t.Fatalf("new peer's sum is %v, expected %v", apps[2].get(), want)
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestMemTransport(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  mem := transport.NewMem()
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = fmt.Sprintf("px-%d", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, mem)
+  }
+
+  fmt.Printf("Test: In-memory transport ...\n")
+
+  for i := 0; i < 10; i++ {
+    pxa[i % npaxos].Start(i, i * 10)
+    waitn(t, pxa, i, npaxos)
+  }
+
+  for i := 0; i < npaxos; i++ {
+    pxa[i].unreliable = true
+  }
+  for i := 10; i < 20; i++ {
+    pxa[i % npaxos].Start(i, i * 10)
+  }
+  for i := 10; i < 20; i++ {
+    waitn(t, pxa, i, npaxos)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
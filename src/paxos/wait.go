@@ -0,0 +1,92 @@
+package paxos
+
+//
+// waiting for decisions without polling Status().
+//
+// px.Wait(seq, ctx) (v interface{}, err error) -- block until seq is decided
+// px.Subscribe(from, ctx) <-chan Decision -- decided values, in order
+//
+// like Status(), these only report what this peer has learned; the
+// application still has to Start() an instance it wants decided.
+// Wait() on an instance a snapshot replaced installs the snapshot
+// (see snapshot.go) and returns ErrForgotten.
+//
+
+import "context"
+import "errors"
+
+var ErrForgotten = errors.New("paxos: instance forgotten")
+var ErrKilled = errors.New("paxos: peer killed")
+
+type Decision struct {
+  Seq   int
+  Value interface{}
+}
+
+//
+// wake everyone blocked in Wait().
+// caller must hold px.mu.
+//
+func (px *Paxos) notifyDecided() {
+  close(px.decidedCh)
+  px.decidedCh = make(chan struct{})
+}
+
+//
+// block until this peer learns the value decided for seq, the
+// instance is forgotten, the peer is killed, or ctx is done.
+//
+func (px *Paxos) Wait(seq int, ctx context.Context) (interface{}, error) {
+  for {
+    px.mu.Lock()
+    if instance, ok := px.instances[seq]; ok && instance.decidedValue != nil {
+      v := instance.decidedValue
+      px.mu.Unlock()
+      return v, nil
+    }
+    if seq < px.forgetPointLocked() {
+      fetch := px.installSnapshot != nil && seq > px.snapshot.Seq
+      px.mu.Unlock()
+      if fetch {
+        px.fetchSnapshot(seq)
+      }
+      px.catchUp(seq)
+      return nil, ErrForgotten
+    }
+    ch := px.decidedCh
+    px.mu.Unlock()
+
+    if px.dead {
+      return nil, ErrKilled
+    }
+    select {
+    case <-ch:
+    case <-ctx.Done():
+      return nil, ctx.Err()
+    }
+  }
+}
+
+//
+// deliver every decided instance >= from, in sequence order, as
+// this peer learns them. the channel is closed when ctx is done,
+// the peer is killed, or the next instance has been forgotten.
+//
+func (px *Paxos) Subscribe(from int, ctx context.Context) <-chan Decision {
+  out := make(chan Decision)
+  go func() {
+    defer close(out)
+    for seq := from; ; seq++ {
+      v, err := px.Wait(seq, ctx)
+      if err != nil {
+        return
+      }
+      select {
+      case out <- Decision{seq, v}:
+      case <-ctx.Done():
+        return
+      }
+    }
+  }()
+  return out
+}
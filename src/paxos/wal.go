@@ -0,0 +1,307 @@
+package paxos
+
+//
+// write-ahead log for the acceptor state.
+//
+// every change to an instance's acceptor fields or to the
+// leader Promise, and every decided value (which includes every
+// Reconfig) is appended to the log and fsync'd before Receive()
+// replies, so a restarted peer never forgets a promise or an
+// accepted value it has told someone about. increases of doneMap
+// are batched by flushDone(), outside px.mu.
+//
+// the log is rewritten from the in-memory state when it is opened
+// and whenever enough records have piled up, which also drops the
+// instances that Done()/Min() allowed us to forget.
+//
+
+import "encoding/gob"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync"
+import "time"
+import "unicode"
+
+const (
+  walAcceptor = "acceptor"
+  walDecided  = "decided"
+  walDone     = "done"
+  walMax      = "max"
+  walPromise  = "promise"
+  walMembers  = "members"
+  walSnapshot = "snapshot"
+)
+
+// rewrite the log after this many appended records.
+const walCompactThreshold = 1000
+
+type walRecord struct {
+  Kind  string
+  Seq   int
+  Np    int
+  Na    int
+  Va    interface{}
+  Value interface{}
+  Peer  string
+  Peers []string
+  Done  int
+  Data  []byte
+}
+
+type wal struct {
+  mu     sync.Mutex
+  path   string
+  file   *os.File
+  enc    *gob.Encoder
+  count  int
+  closed bool
+}
+
+//
+// the log is named after the peer's address rather than its
+// index, which Reconfigure() can change.
+//
+func walPath(dir string, peer string) string {
+  name := strings.Map(func(r rune) rune {
+    if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '.' {
+      return r
+    }
+    return '_'
+  }, peer)
+  return filepath.Join(dir, "paxos-"+name+".wal")
+}
+
+//
+// read every complete record from the log at path.
+// a torn record at the tail (crash during append) ends the replay.
+//
+func readWal(path string) ([]walRecord, error) {
+  f, err := os.Open(path)
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  var records []walRecord
+  dec := gob.NewDecoder(f)
+  for {
+    var r walRecord
+    if err := dec.Decode(&r); err != nil {
+      // io.EOF, or a record torn by a crash.
+      break
+    }
+    records = append(records, r)
+  }
+  return records, nil
+}
+
+//
+// atomically replace the log at path with records, and
+// return a wal that appends to the new file.
+//
+func createWal(path string, records []walRecord) (*wal, error) {
+  tmp := path + ".tmp"
+  f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+  if err != nil {
+    return nil, err
+  }
+  enc := gob.NewEncoder(f)
+  for i := range records {
+    if err := enc.Encode(&records[i]); err != nil {
+      f.Close()
+      return nil, err
+    }
+  }
+  if err := f.Sync(); err != nil {
+    f.Close()
+    return nil, err
+  }
+  if err := os.Rename(tmp, path); err != nil {
+    f.Close()
+    return nil, err
+  }
+  if d, err := os.Open(filepath.Dir(path)); err == nil {
+    d.Sync()
+    d.Close()
+  }
+  return &wal{path: path, file: f, enc: enc}, nil
+}
+
+//
+// append records and wait for them to reach the disk.
+//
+func (w *wal) append(records ...walRecord) error {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  if w.closed {
+    return fmt.Errorf("paxos wal %v: closed", w.path)
+  }
+  for i := range records {
+    if err := w.enc.Encode(&records[i]); err != nil {
+      return err
+    }
+    w.count++
+  }
+  return w.file.Sync()
+}
+
+func (w *wal) needsCompaction() bool {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  return !w.closed && w.count >= walCompactThreshold
+}
+
+//
+// replace the log contents with records, which must describe
+// the complete state to be recovered.
+//
+func (w *wal) rewrite(records []walRecord) error {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  if w.closed {
+    return fmt.Errorf("paxos wal %v: closed", w.path)
+  }
+  nw, err := createWal(w.path, records)
+  if err != nil {
+    return err
+  }
+  w.file.Close()
+  w.file = nw.file
+  w.enc = nw.enc
+  w.count = 0
+  return nil
+}
+
+func (w *wal) close() {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  if !w.closed {
+    w.closed = true
+    w.file.Close()
+  }
+}
+
+//
+// the records needed to rebuild the current state.
+// caller must hold px.acceptorLock so acceptor fields don't move.
+//
+func (px *Paxos) walSnapshot() []walRecord {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  records := make([]walRecord, 0, len(px.instances)+len(px.doneMap)+1)
+  records = append(records, walRecord{Kind: walMax, Seq: px.maxSeq})
+  records = append(records, walRecord{Kind: walPromise, Np: px.promise.Ballot, Seq: px.promise.From})
+  if px.snapshot.Seq >= 0 {
+    records = append(records, walRecord{Kind: walSnapshot, Seq: px.snapshot.Seq, Data: px.snapshot.Data})
+  }
+  for _, m := range px.members {
+    records = append(records, walRecord{Kind: walMembers, Seq: m.Start, Peers: m.Peers})
+  }
+  for peer, done := range px.doneMap {
+    records = append(records, walRecord{Kind: walDone, Peer: peer, Done: done})
+  }
+  for seq, instance := range px.instances {
+    if seq < px.toCleanSeq {
+      continue
+    }
+    a := instance.acceptor
+    records = append(records, walRecord{Kind: walAcceptor, Seq: seq,
+      Np: a.highestProposedNumber, Na: a.highestAcceptedNumber, Va: a.highestAcceptedValue})
+    if instance.decidedValue != nil {
+      records = append(records, walRecord{Kind: walDecided, Seq: seq, Value: instance.decidedValue})
+    }
+  }
+  return records
+}
+
+//
+// apply a replayed record to the in-memory state.
+//
+func (px *Paxos) walApply(r walRecord) {
+  switch r.Kind {
+  case walAcceptor:
+    instance := px.getInstance(r.Seq)
+    instance.acceptor.highestProposedNumber = r.Np
+    instance.acceptor.highestAcceptedNumber = r.Na
+    instance.acceptor.highestAcceptedValue = r.Va
+    px.leader.seen = max(px.leader.seen, r.Np)
+  case walDecided:
+    px.getInstance(r.Seq).decidedValue = r.Value
+    px.maxSeq = max(px.maxSeq, r.Seq)
+    px.learnReconfig(r.Seq, r.Value)
+  case walDone:
+    px.doneMap[r.Peer] = max(px.getDone(r.Peer), r.Done)
+  case walMembers:
+    if r.Seq == 0 {
+      px.members[0] = Membership{0, r.Peers}
+    } else {
+      px.addMembership(Membership{r.Seq, r.Peers})
+    }
+  case walMax:
+    px.maxSeq = max(px.maxSeq, r.Seq)
+  case walSnapshot:
+    if r.Seq > px.snapshot.Seq {
+      // the application starts out empty, so it still needs this.
+      px.snapshot = Snapshot{r.Seq, r.Data}
+      px.maxSeq = max(px.maxSeq, r.Seq)
+    }
+  case walPromise:
+    px.promise = Promise{r.Np, r.Seq}
+    px.leader.seen = max(px.leader.seen, r.Np)
+  }
+}
+
+//
+// rebuild state from the log in dir, then start a fresh log.
+//
+func (px *Paxos) recover(dir string) error {
+  if err := os.MkdirAll(dir, 0777); err != nil {
+    return err
+  }
+  path := walPath(dir, px.self)
+  records, err := readWal(path)
+  if err != nil {
+    return err
+  }
+  for _, r := range records {
+    px.walApply(r)
+  }
+  if len(records) > 0 {
+    // we may have granted a lease we no longer remember.
+    px.grant = Grant{"", time.Now().Add(LeaseDuration)}
+  }
+  px.mu.Lock()
+  px.cleanDoneValues()
+  px.mu.Unlock()
+
+  w, err := createWal(path, px.walSnapshot())
+  if err != nil {
+    return err
+  }
+  px.wal = w
+  return nil
+}
+
+//
+// make a state change durable before it is revealed to anyone.
+// caller must hold px.acceptorLock.
+//
+func (px *Paxos) persist(r walRecord) error {
+  if px.wal == nil {
+    return nil
+  }
+  if err := px.wal.append(r); err != nil {
+    return err
+  }
+  if px.wal.needsCompaction() {
+    if err := px.wal.rewrite(px.walSnapshot()); err != nil {
+      fmt.Printf("paxos wal compaction failed: %v\n", err)
+    }
+  }
+  return nil
+}
@@ -1,12 +1,13 @@
 package pbservice
 
 import (
+  "context"
+  "errors"
   "strconv"
   "time"
   "viewservice"
 )
-import "net/rpc"
-import "fmt"
+import "transport"
 
 // You'll probably need to uncomment these:
 // import "time"
@@ -15,18 +16,30 @@ import "fmt"
 
 
 
+//
+// each call keeps trying forever; its Ctx form gives up with
+// ctx.Err() once ctx is done, and reports a missing key as
+// ErrNotFound.
+//
 type Clerk struct {
   vs *viewservice.Clerk
   // Your declarations here
   // added by Shusen Xu
   view viewservice.View
   me string
+  // a new connection per call, with a deadline: the tests' proxy
+  // delays a message by delaying the connection it arrives on.
+  t transport.Transport
 }
 
 
-func MakeClerk(vshost string, me string) *Clerk {
+// what the Ctx calls return for a missing key.
+var ErrNotFound = errors.New("pbservice: no such key")
+
+func MakeClerk(vshost string, me string, t transport.Transport) *Clerk {
   ck := new(Clerk)
-  ck.vs = viewservice.MakeClerk(me, vshost)
+  ck.t = t
+  ck.vs = viewservice.MakeClerk(me, vshost, t)
   // Your ck.* initializations here
   // added by Shusen Xu
   ck.view = viewservice.View{}
@@ -36,48 +49,38 @@ func MakeClerk(vshost string, me string) *Clerk {
 }
 
 
-//
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be a pointer
-// to a reply structure.
-//
-// the return value is true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// the reply's contents are only valid if call() returned true.
-//
-// you should assume that call() will time out and return an
-// error after a while if it doesn't get a reply from the server.
-//
-// please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
-//
-func call(srv string, rpcname string,
-    args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
-  }
-
-  fmt.Println(err)
-  return false
-}
-
 // helper function added by Shusen Xu
-func (ck *Clerk) PingView() {
-  view, err := ck.vs.Ping(ck.view.Viewnum)
+func (ck *Clerk) PingView(ctx context.Context) {
+  view, err := ck.vs.PingCtx(ctx, ck.view.Viewnum)
   if err != nil {
     return
   }
   ck.view = view
 }
 
+//
+// send an RPC to the primary, for at most DefaultTimeout and
+// until ctx is done.
+//
+func (ck *Clerk) call(ctx context.Context, name string, args interface{}, reply interface{}) bool {
+  ctx, cancel := context.WithTimeout(ctx, transport.DefaultTimeout)
+  defer cancel()
+  return transport.CallContext(ctx, ck.t, ck.view.Primary, name, args, reply)
+}
+
+//
+// wait a moment, then ask the viewservice who the primary is now.
+//
+func (ck *Clerk) refresh(ctx context.Context) error {
+  select {
+  case <-time.After(viewservice.PingInterval):
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+  ck.PingView(ctx)
+  return nil
+}
+
 // the above are helper functions added by Shusen Xu
 
 //
@@ -89,24 +92,32 @@ func (ck *Clerk) PingView() {
 //
 
 func (ck *Clerk) Get(key string) string {
+  v, _ := ck.GetCtx(context.Background(), key)
+  return v
+}
+
+func (ck *Clerk) GetCtx(ctx context.Context, key string) (string, error) {
 
   // Your code here.
   // added by Shusen Xu
   if ck.view.Viewnum == 0{
-    ck.PingView()
+    ck.PingView(ctx)
   }
   args := &GetArgs{key, nrand()}
   var reply GetReply
 
   for {
-    ok := call(ck.view.Primary, "PBServer.Get", args, &reply)
+    ok := ck.call(ctx, "PBServer.Get", args, &reply)
+    if ok && reply.Err == ErrNoKey {
+      return "", ErrNotFound
+    }
     if ok {
-      return reply.Value
+      return reply.Value, nil
+    }
+    if err := ck.refresh(ctx); err != nil {
+      return "", err
     }
-    time.Sleep(viewservice.PingInterval)
-    ck.PingView()
   }
-  return "???"
 }
 
 //
@@ -114,26 +125,30 @@ func (ck *Clerk) Get(key string) string {
 // must keep trying until it succeeds.
 //
 func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
+  v, _ := ck.PutExtCtx(context.Background(), key, value, dohash)
+  return v
+}
+
+func (ck *Clerk) PutExtCtx(ctx context.Context, key string, value string, dohash bool) (string, error) {
 
   // Your code here.
   // added by Shusen Xu
   if ck.view.Viewnum == 0 {
-    ck.PingView()
+    ck.PingView(ctx)
   }
   args := &PutArgs{key, value, dohash, false, strconv.FormatInt(nrand(), 10), ck.me}
 
   var reply PutReply
 
   for {
-    ok := call(ck.view.Primary, "PBServer.Put", args, &reply)
+    ok := ck.call(ctx, "PBServer.Put", args, &reply)
     if ok {
-      return reply.PreviousValue
+      return reply.PreviousValue, nil
+    }
+    if err := ck.refresh(ctx); err != nil {
+      return "", err
     }
-
-    time.Sleep(viewservice.PingInterval)
-    ck.PingView()
   }
-  return "???"
 }
 
 func (ck *Clerk) Put(key string, value string) {
@@ -144,3 +159,12 @@ func (ck *Clerk) PutHash(key string, value string) string {
   v := ck.PutExt(key, value, true)
   return v
 }
+
+func (ck *Clerk) PutCtx(ctx context.Context, key string, value string) error {
+  _, err := ck.PutExtCtx(ctx, key, value, false)
+  return err
+}
+
+func (ck *Clerk) PutHashCtx(ctx context.Context, key string, value string) (string, error) {
+  return ck.PutExtCtx(ctx, key, value, true)
+}
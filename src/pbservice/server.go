@@ -10,10 +10,8 @@ import "net/rpc"
 import "log"
 import "time"
 import "viewservice"
-import "os"
-import "syscall"
-import "math/rand"
 import "sync"
+import "transport"
 
 //import "strconv"
 
@@ -33,6 +31,7 @@ type PBServer struct {
   unreliable bool // for testing
   me string
   vs *viewservice.Clerk
+  pool *transport.Pool
   done sync.WaitGroup
   finish chan interface{}
   // Your declarations here.
@@ -46,6 +45,7 @@ type PBServer struct {
   content map[string] string
   mu sync.Mutex
   isinitBackup bool    // when backup is created, check if it has been initialized by current primary
+  backupSynced bool    // whether the primary has sent all of content to view.Backup
 
 }
 
@@ -71,7 +71,7 @@ func (pb *PBServer) Append(args *AppendArgs) error {
     return nil
   }
   var reply AppendReply
-  ok := call(pb.view.Backup, "PBServer.DoAppend", args, &reply)
+  ok := pb.pool.Call(pb.view.Backup, "PBServer.DoAppend", args, &reply)
   if !ok {
     return errors.New("doappend fail")
   }
@@ -122,7 +122,7 @@ func (pb *PBServer) Put(args *PutArgs, reply *PutReply) error {
   //// update primary's data into backup and syn
   //var initReply InitStateReply
   //tmpArgs := InitStateArgs{pb.content}
-  //call(pb.view.Backup, "PBServer.InitBackup", tmpArgs, &initReply)
+  //pb.pool.Call(pb.view.Backup, "PBServer.InitBackup", tmpArgs, &initReply)
 
   key, value, client, uid := args.Key, args.Value, args.Me, args.UUID
 
@@ -170,9 +170,13 @@ func (pb *PBServer) Get(args *GetArgs, reply *GetReply) error {
   // update primary's data into backup and syn
   var initReply InitStateReply
   tmpArgs := InitStateArgs{pb.content}
-  call(pb.view.Backup, "PBServer.InitBackup", tmpArgs, &initReply)
+  pb.pool.Call(pb.view.Backup, "PBServer.InitBackup", tmpArgs, &initReply)
 
-  reply.Value = pb.content[args.Key]
+  value, ok := pb.content[args.Key]
+  if !ok {
+    reply.Err = ErrNoKey
+  }
+  reply.Value = value
   pb.mu.Unlock()
   return nil
 }
@@ -186,11 +190,20 @@ func (pb *PBServer) tick() {
   defer pb.mu.Unlock()
   view, err := pb.vs.Ping(pb.view.Viewnum)
   if err != nil {
+    // we may have been replaced, so serve nothing until we hear
+    // back; but keep acking the view we had, since Viewnum 0 would
+    // tell the viewservice we restarted.
+    pb.view.Primary, pb.view.Backup = "", ""
+    return
+  }
+  if view.Backup != pb.view.Backup {
+    pb.backupSynced = false
   }
-  // update primary's data into backup every tick
   pb.view = view
-  if view.Backup != "" && view.Backup != pb.view.Backup && pb.isPrimary() {
-    pb.Append(&AppendArgs{Content:pb.content})
+  // a new backup gets all of the primary's data; keep trying
+  // until it has it, since the request or reply may be lost.
+  if pb.isPrimary() && pb.hasBackup() && !pb.backupSynced {
+    pb.backupSynced = pb.Append(&AppendArgs{Content:pb.content}) == nil
   }
   // update initBackup flag
   //if !pb.isBackup() && !pb.isPrimary(){
@@ -208,10 +221,11 @@ func (pb *PBServer) kill() {
 }
 
 
-func StartServer(vshost string, me string) *PBServer {
+func StartServer(vshost string, me string, t transport.Transport) *PBServer {
   pb := new(PBServer)
   pb.me = me
-  pb.vs = viewservice.MakeClerk(me, vshost)
+  pb.pool = transport.NewPool(t, transport.DefaultTimeout)
+  pb.vs = viewservice.MakeClerk(me, vshost, t)
   pb.finish = make(chan interface{})
   // Your pb.* initializations here.
   // added by Shusen Xu
@@ -220,51 +234,24 @@ func StartServer(vshost string, me string) *PBServer {
   rpcs := rpc.NewServer()
   rpcs.Register(pb)
 
-  os.Remove(pb.me)
-  l, e := net.Listen("unix", pb.me);
+  l, e := t.Listen(pb.me);
   if e != nil {
     log.Fatal("listen error: ", e);
   }
   pb.l = l
 
-  // please do not change any of the following code,
-  // or do anything to subvert it.
+  // transport.Serve() is the accept loop, and simulates the
+  // unreliable network the tests depend on; please do not
+  // subvert it.
 
   go func() {
-    for pb.dead == false {
-      conn, err := pb.l.Accept()
-      if err == nil && pb.dead == false {
-        if pb.unreliable && (rand.Int63() % 1000) < 100 {
-          // discard the request.
-          conn.Close()
-        } else if pb.unreliable && (rand.Int63() % 1000) < 200 {
-          // process the request but force discard of reply.
-          c1 := conn.(*net.UnixConn)
-          f, _ := c1.File()
-          err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-          if err != nil {
-            fmt.Printf("shutdown: %v\n", err)
-          }
-          pb.done.Add(1)
-          go func() {
-            rpcs.ServeConn(conn)
-            pb.done.Done()
-          }()
-        } else {
-          pb.done.Add(1)
-          go func() {
-            rpcs.ServeConn(conn)
-            pb.done.Done()
-          }()
-        }
-      } else if err == nil {
-        conn.Close()
-      }
-      if err != nil && pb.dead == false {
-        fmt.Printf("PBServer(%v) accept: %v\n", me, err.Error())
-        pb.kill()
-      }
-    }
+    transport.Serve(pb.l, rpcs, transport.Hooks{
+      Name:       fmt.Sprintf("PBServer(%v)", me),
+      Dead:       func() bool { return pb.dead },
+      Unreliable: func() bool { return pb.unreliable },
+      Failed:     pb.kill,
+      Active:     &pb.done,
+    })
     DPrintf("%s: wait until all request are done\n", pb.me)
     pb.done.Wait()
     // If you have an additional thread in your solution, you could
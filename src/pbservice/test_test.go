@@ -1,6 +1,8 @@
 package pbservice
 
+import "context"
 import "viewservice"
+import "transport"
 import "fmt"
 import "io"
 import "net"
@@ -35,15 +37,15 @@ func TestBasicFail(t *testing.T) {
 
   tag := "basic"
   vshost := port(tag+"v", 1)
-  vs := viewservice.StartServer(vshost)
+  vs := viewservice.StartServer(vshost, transport.Unix{})
   time.Sleep(time.Second)
-  vck := viewservice.MakeClerk("", vshost)
+  vck := viewservice.MakeClerk("", vshost, transport.Unix{})
 
-  ck := MakeClerk(vshost, "")
+  ck := MakeClerk(vshost, "", transport.Unix{})
 
   fmt.Printf("Test: Single primary, no backup ...\n")
 
-  s1 := StartServer(vshost, port(tag, 1))
+  s1 := StartServer(vshost, port(tag, 1), transport.Unix{})
 
   deadtime := viewservice.PingInterval * viewservice.DeadPings
   time.Sleep(deadtime * 2)
@@ -66,7 +68,7 @@ func TestBasicFail(t *testing.T) {
 
   fmt.Printf("Test: Add a backup ...\n")
 
-  s2 := StartServer(vshost, port(tag, 2))
+  s2 := StartServer(vshost, port(tag, 2), transport.Unix{})
   for i := 0; i < viewservice.DeadPings * 2; i++ {
     v, _ := vck.Get()
     if v.Backup == s2.me {
@@ -119,7 +121,7 @@ func TestBasicFail(t *testing.T) {
   fmt.Printf("Test: Kill last server, new one should not be active ...\n")
 
   s2.kill()
-  s3 := StartServer(vshost, port(tag, 3))
+  s3 := StartServer(vshost, port(tag, 3), transport.Unix{})
   time.Sleep(1 * time.Second)
   get_done := false
   go func() {
@@ -141,21 +143,77 @@ func TestBasicFail(t *testing.T) {
   time.Sleep(time.Second)
 }
 
+func TestContext(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "ctx"
+  vshost := port(tag+"v", 1)
+  vs := viewservice.StartServer(vshost, transport.Unix{})
+  time.Sleep(time.Second)
+  vck := viewservice.MakeClerk("", vshost, transport.Unix{})
+
+  ck := MakeClerk(vshost, "", transport.Unix{})
+  bg := context.Background()
+
+  fmt.Printf("Test: Ctx calls report missing keys ...\n")
+
+  s1 := StartServer(vshost, port(tag, 1), transport.Unix{})
+
+  deadtime := viewservice.PingInterval * viewservice.DeadPings
+  time.Sleep(deadtime * 2)
+  if vck.Primary() != s1.me {
+    t.Fatal("first primary never formed view")
+  }
+
+  if _, err := ck.GetCtx(bg, "a"); err != ErrNotFound {
+    t.Fatalf("GetCtx of a missing key returned %v", err)
+  }
+  if err := ck.PutCtx(bg, "a", "x"); err != nil {
+    t.Fatalf("PutCtx returned %v", err)
+  }
+  if v, err := ck.GetCtx(bg, "a"); v != "x" || err != nil {
+    t.Fatalf("GetCtx returned %v, %v", v, err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Ctx calls give up at the deadline ...\n")
+
+  s1.kill()
+  ctx, cancel := context.WithTimeout(bg, 500 * time.Millisecond)
+  defer cancel()
+  t0 := time.Now()
+  if _, err := ck.GetCtx(ctx, "a"); err != context.DeadlineExceeded {
+    t.Fatalf("GetCtx with no primary returned %v", err)
+  }
+  if err := ck.PutCtx(ctx, "a", "y"); err != context.DeadlineExceeded {
+    t.Fatalf("PutCtx after the deadline returned %v", err)
+  }
+  if d := time.Since(t0); d > 2 * time.Second {
+    t.Fatalf("Ctx calls took %v, deadline was 500ms", d)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  vs.Kill()
+  time.Sleep(time.Second)
+}
+
 func TestAtMostOnce(t *testing.T) {
   runtime.GOMAXPROCS(4)
 
   tag := "csu"
   vshost := port(tag+"v", 1)
-  vs := viewservice.StartServer(vshost)
+  vs := viewservice.StartServer(vshost, transport.Unix{})
   time.Sleep(time.Second)
-  vck := viewservice.MakeClerk("", vshost)
+  vck := viewservice.MakeClerk("", vshost, transport.Unix{})
 
   fmt.Printf("Test: at-most-once Put; unreliable ...\n")
 
   const nservers = 1
   var sa [nservers]*PBServer
   for i := 0; i < nservers; i++ {
-    sa[i] = StartServer(vshost, port(tag, i+1))
+    sa[i] = StartServer(vshost, port(tag, i+1), transport.Unix{})
     sa[i].unreliable = true
   }
 
@@ -170,7 +228,7 @@ func TestAtMostOnce(t *testing.T) {
   // give p+b time to ack, initialize
   time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
 
-  ck := MakeClerk(vshost, "")
+  ck := MakeClerk(vshost, "", transport.Unix{})
   k := "counter"
   val := ""
   for i := 0; i < 100; i++ {
@@ -204,15 +262,15 @@ func TestFailPut(t *testing.T) {
 
   tag := "failput"
   vshost := port(tag+"v", 1)
-  vs := viewservice.StartServer(vshost)
+  vs := viewservice.StartServer(vshost, transport.Unix{})
   time.Sleep(time.Second)
-  vck := viewservice.MakeClerk("", vshost)
+  vck := viewservice.MakeClerk("", vshost, transport.Unix{})
 
-  s1 := StartServer(vshost, port(tag, 1))
+  s1 := StartServer(vshost, port(tag, 1), transport.Unix{})
   time.Sleep(time.Second)
-  s2 := StartServer(vshost, port(tag, 2))
+  s2 := StartServer(vshost, port(tag, 2), transport.Unix{})
   time.Sleep(time.Second)
-  s3 := StartServer(vshost, port(tag, 3))
+  s3 := StartServer(vshost, port(tag, 3), transport.Unix{})
 
   for i := 0; i < viewservice.DeadPings * 3; i++ {
     v, _ := vck.Get()
@@ -227,7 +285,7 @@ func TestFailPut(t *testing.T) {
     t.Fatalf("wrong primary or backup")
   }
 
-  ck := MakeClerk(vshost, "")
+  ck := MakeClerk(vshost, "", transport.Unix{})
 
   ck.Put("a", "aa")
   ck.Put("b", "bb")
@@ -293,16 +351,16 @@ func TestConcurrentSame(t *testing.T) {
 
   tag := "cs"
   vshost := port(tag+"v", 1)
-  vs := viewservice.StartServer(vshost)
+  vs := viewservice.StartServer(vshost, transport.Unix{})
   time.Sleep(time.Second)
-  vck := viewservice.MakeClerk("", vshost)
+  vck := viewservice.MakeClerk("", vshost, transport.Unix{})
 
   fmt.Printf("Test: Concurrent Put()s to the same key ...\n")
 
   const nservers = 2
   var sa [nservers]*PBServer
   for i := 0; i < nservers; i++ {
-    sa[i] = StartServer(vshost, port(tag, i+1))
+    sa[i] = StartServer(vshost, port(tag, i+1), transport.Unix{})
   }
 
   for iters := 0; iters < viewservice.DeadPings*2; iters++ {
@@ -323,7 +381,7 @@ func TestConcurrentSame(t *testing.T) {
   const nkeys = 2
   for xi := 0; xi < nclients; xi++ {
     go func(i int) {
-      ck := MakeClerk(vshost, "")
+      ck := MakeClerk(vshost, "", transport.Unix{})
       rr := rand.New(rand.NewSource(int64(os.Getpid()+i)))
       for done == false {
         k := strconv.Itoa(rr.Int() % nkeys)
@@ -338,7 +396,7 @@ func TestConcurrentSame(t *testing.T) {
   time.Sleep(time.Second)
 
   // read from primary
-  ck := MakeClerk(vshost, "")
+  ck := MakeClerk(vshost, "", transport.Unix{})
   var vals [nkeys]string
   for i := 0; i < nkeys; i++ {
     vals[i] = ck.Get(strconv.Itoa(i))
@@ -389,16 +447,16 @@ func TestConcurrentSameUnreliable(t *testing.T) {
 
   tag := "csu"
   vshost := port(tag+"v", 1)
-  vs := viewservice.StartServer(vshost)
+  vs := viewservice.StartServer(vshost, transport.Unix{})
   time.Sleep(time.Second)
-  vck := viewservice.MakeClerk("", vshost)
+  vck := viewservice.MakeClerk("", vshost, transport.Unix{})
 
   fmt.Printf("Test: Concurrent Put()s to the same key; unreliable ...\n")
 
   const nservers = 2
   var sa [nservers]*PBServer
   for i := 0; i < nservers; i++ {
-    sa[i] = StartServer(vshost, port(tag, i+1))
+    sa[i] = StartServer(vshost, port(tag, i+1), transport.Unix{})
     sa[i].unreliable = true
   }
 
@@ -420,7 +478,7 @@ func TestConcurrentSameUnreliable(t *testing.T) {
   const nkeys = 2
   for xi := 0; xi < nclients; xi++ {
     go func(i int) {
-      ck := MakeClerk(vshost, "")
+      ck := MakeClerk(vshost, "", transport.Unix{})
       rr := rand.New(rand.NewSource(int64(os.Getpid()+i)))
       for done == false {
         k := strconv.Itoa(rr.Int() % nkeys)
@@ -435,7 +493,7 @@ func TestConcurrentSameUnreliable(t *testing.T) {
   time.Sleep(time.Second)
 
   // read from primary
-  ck := MakeClerk(vshost, "")
+  ck := MakeClerk(vshost, "", transport.Unix{})
   var vals [nkeys]string
   for i := 0; i < nkeys; i++ {
     vals[i] = ck.Get(strconv.Itoa(i))
@@ -487,16 +545,16 @@ func TestRepeatedCrash(t *testing.T) {
 
   tag := "rc"
   vshost := port(tag+"v", 1)
-  vs := viewservice.StartServer(vshost)
+  vs := viewservice.StartServer(vshost, transport.Unix{})
   time.Sleep(time.Second)
-  vck := viewservice.MakeClerk("", vshost)
+  vck := viewservice.MakeClerk("", vshost, transport.Unix{})
 
   fmt.Printf("Test: Repeated failures/restarts ...\n")
 
   const nservers = 3
   var sa [nservers]*PBServer
   for i := 0; i < nservers; i++ {
-    sa[i] = StartServer(vshost, port(tag, i+1))
+    sa[i] = StartServer(vshost, port(tag, i+1), transport.Unix{})
   }
 
   for i := 0; i < viewservice.DeadPings; i++ {
@@ -523,7 +581,7 @@ func TestRepeatedCrash(t *testing.T) {
       // wait long enough for new view to form, backup to be initialized
       time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
 
-      sa[i] = StartServer(vshost, port(tag, i+1))
+      sa[i] = StartServer(vshost, port(tag, i+1), transport.Unix{})
 
       // wait long enough for new view to form, backup to be initialized
       time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
@@ -537,7 +595,7 @@ func TestRepeatedCrash(t *testing.T) {
     go func(i int) {
       ok := false
       defer func() { cha[i] <- ok } ()
-      ck := MakeClerk(vshost, "")
+      ck := MakeClerk(vshost, "", transport.Unix{})
       data := map[string]string{}
       rr := rand.New(rand.NewSource(int64(os.Getpid()+i)))
       for done == false {
@@ -572,7 +630,7 @@ func TestRepeatedCrash(t *testing.T) {
     }
   }
 
-  ck := MakeClerk(vshost, "")
+  ck := MakeClerk(vshost, "", transport.Unix{})
   ck.Put("aaa", "bbb")
   if v := ck.Get("aaa"); v != "bbb" {
     t.Fatalf("final Put/Get failed")
@@ -593,16 +651,16 @@ func TestRepeatedCrashUnreliable(t *testing.T) {
 
   tag := "rcu"
   vshost := port(tag+"v", 1)
-  vs := viewservice.StartServer(vshost)
+  vs := viewservice.StartServer(vshost, transport.Unix{})
   time.Sleep(time.Second)
-  vck := viewservice.MakeClerk("", vshost)
+  vck := viewservice.MakeClerk("", vshost, transport.Unix{})
 
   fmt.Printf("Test: Repeated failures/restarts; unreliable ...\n")
 
   const nservers = 3
   var sa [nservers]*PBServer
   for i := 0; i < nservers; i++ {
-    sa[i] = StartServer(vshost, port(tag, i+1))
+    sa[i] = StartServer(vshost, port(tag, i+1), transport.Unix{})
     sa[i].unreliable = true
   }
 
@@ -630,7 +688,7 @@ func TestRepeatedCrashUnreliable(t *testing.T) {
       // wait long enough for new view to form, backup to be initialized
       time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
 
-      sa[i] = StartServer(vshost, port(tag, i+1))
+      sa[i] = StartServer(vshost, port(tag, i+1), transport.Unix{})
 
       // wait long enough for new view to form, backup to be initialized
       time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
@@ -644,7 +702,7 @@ func TestRepeatedCrashUnreliable(t *testing.T) {
     go func(i int) {
       ok := false
       defer func() { cha[i] <- ok } ()
-      ck := MakeClerk(vshost, "")
+      ck := MakeClerk(vshost, "", transport.Unix{})
       data := map[string]string{}
       // rr := rand.New(rand.NewSource(int64(os.Getpid()+i)))
       k := strconv.Itoa(i)
@@ -684,7 +742,7 @@ func TestRepeatedCrashUnreliable(t *testing.T) {
     }
   }
 
-  ck := MakeClerk(vshost, "")
+  ck := MakeClerk(vshost, "", transport.Unix{})
   ck.Put("aaa", "bbb")
   if v := ck.Get("aaa"); v != "bbb" {
     t.Fatalf("final Put/Get failed")
@@ -764,18 +822,18 @@ func TestPartition1(t *testing.T) {
 
   tag := "part1"
   vshost := port(tag+"v", 1)
-  vs := viewservice.StartServer(vshost)
+  vs := viewservice.StartServer(vshost, transport.Unix{})
   time.Sleep(time.Second)
-  vck := viewservice.MakeClerk("", vshost)
+  vck := viewservice.MakeClerk("", vshost, transport.Unix{})
 
-  ck1 := MakeClerk(vshost, "")
+  ck1 := MakeClerk(vshost, "", transport.Unix{})
 
   fmt.Printf("Test: Old primary does not serve Gets ...\n")
 
   vshosta := vshost + "a"
   os.Link(vshost, vshosta)
 
-  s1 := StartServer(vshosta, port(tag, 1))
+  s1 := StartServer(vshosta, port(tag, 1), transport.Unix{})
   delay := 0
   proxy(t, port(tag, 1), &delay)
 
@@ -785,7 +843,7 @@ func TestPartition1(t *testing.T) {
     t.Fatal("primary never formed initial view")
   }
 
-  s2 := StartServer(vshost, port(tag, 2))
+  s2 := StartServer(vshost, port(tag, 2), transport.Unix{})
   time.Sleep(deadtime * 2)
   v1, _ := vck.Get()
   if v1.Primary != s1.me || v1.Backup != s2.me {
@@ -828,7 +886,7 @@ func TestPartition1(t *testing.T) {
   time.Sleep(2 * viewservice.PingInterval)
 
   // change the value (on s2) so it's no longer "1".
-  ck2 := MakeClerk(vshost, "")
+  ck2 := MakeClerk(vshost, "", transport.Unix{})
   ck2.Put("a", "111")
   check(ck2, "a", "111")
 
@@ -852,16 +910,16 @@ func TestPartition2(t *testing.T) {
 
   tag := "part2"
   vshost := port(tag+"v", 1)
-  vs := viewservice.StartServer(vshost)
+  vs := viewservice.StartServer(vshost, transport.Unix{})
   time.Sleep(time.Second)
-  vck := viewservice.MakeClerk("", vshost)
+  vck := viewservice.MakeClerk("", vshost, transport.Unix{})
 
-  ck1 := MakeClerk(vshost, "")
+  ck1 := MakeClerk(vshost, "", transport.Unix{})
 
   vshosta := vshost + "a"
   os.Link(vshost, vshosta)
 
-  s1 := StartServer(vshosta, port(tag, 1))
+  s1 := StartServer(vshosta, port(tag, 1), transport.Unix{})
   delay := 0
   proxy(t, port(tag, 1), &delay)
 
@@ -873,7 +931,7 @@ func TestPartition2(t *testing.T) {
     t.Fatal("primary never formed initial view")
   }
 
-  s2 := StartServer(vshost, port(tag, 2))
+  s2 := StartServer(vshost, port(tag, 2), transport.Unix{})
   time.Sleep(deadtime * 2)
   v1, _ := vck.Get()
   if v1.Primary != s1.me || v1.Backup != s2.me {
@@ -909,7 +967,7 @@ func TestPartition2(t *testing.T) {
     t.Fatalf("primary never changed")
   }
 
-  s3 := StartServer(vshost, port(tag, 3))
+  s3 := StartServer(vshost, port(tag, 3), transport.Unix{})
   for iter := 0; iter < viewservice.DeadPings * 3; iter++ {
     v, _ := vck.Get()
     if v.Backup == s3.me && v.Primary == s2.me {
@@ -923,7 +981,7 @@ func TestPartition2(t *testing.T) {
   }
   time.Sleep(2 * time.Second)
 
-  ck2 := MakeClerk(vshost, "")
+  ck2 := MakeClerk(vshost, "", transport.Unix{})
   ck2.Put("a", "2")
   check(ck2, "a", "2")
 
@@ -1,80 +1,79 @@
 package shardkv
 
 import (
+  "context"
+  "errors"
   "math/rand"
   "shardmaster"
 )
-import "net/rpc"
 import "time"
-import "sync"
+import "transport"
 import "fmt"
 
+//
+// each call keeps trying forever; its Ctx form gives up with
+// ctx.Err() once ctx is done, and reports a missing key as
+// ErrNotFound.
+//
 type Clerk struct {
-  mu sync.Mutex // one RPC at a time
+  busy chan struct{} // holds a token during an RPC; one at a time
   sm *shardmaster.Clerk
+  pool *transport.Pool
   config shardmaster.Config
   // You'll have to modify Clerk.
   // added by Shusen Xu
   uid string
+  seq int64 // of the last Put; see dedup.go
 }
 
 
 
-func MakeClerk(shardmasters []string) *Clerk {
+// what the Ctx calls return for a missing key.
+var ErrNotFound = errors.New("shardkv: no such key")
+
+func MakeClerk(shardmasters []string, t transport.Transport) *Clerk {
   ck := new(Clerk)
-  ck.sm = shardmaster.MakeClerk(shardmasters)
+  ck.pool = transport.NewPool(t, transport.DefaultTimeout)
+  ck.sm = shardmaster.MakeClerk(shardmasters, t)
   // You'll have to modify MakeClerk.
   // added by Shusen Xu
   ck.uid = fmt.Sprintf("%d_%d", time.Now().UnixNano(), rand.Int63())
   //ck.uid = strconv.Itoa(int(time.Now().UnixNano()))+"_"+strconv.Itoa(int(rand.Int63()))
+  ck.busy = make(chan struct{}, 1)
   return ck
 }
 
 //
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be a pointer
-// to a reply structure.
-//
-// the return value is true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// the reply's contents are only valid if call() returned true.
-//
-// you should assume that call() will time out and return an
-// error after a while if it doesn't get a reply from the server.
+// wait for the Clerk's call in progress, if any, to finish.
 //
-// please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
-//
-func call(srv string, rpcname string,
-    args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
+func (ck *Clerk) lock(ctx context.Context) error {
+  select {
+  case ck.busy <- struct{}{}:
+    return nil
+  case <-ctx.Done():
+    return ctx.Err()
   }
+}
 
-  fmt.Println(err)
-  return false
+func (ck *Clerk) unlock() {
+  <-ck.busy
 }
 
 //
-// which shard is a key in?
-// please use this function,
-// and please do not change it.
+// wait a moment, then ask the master for a new configuration.
 //
-func key2shard(key string) int {
-  shard := 0
-  if len(key) > 0 {
-    shard = int(key[0])
+func (ck *Clerk) refresh(ctx context.Context) error {
+  select {
+  case <-time.After(100 * time.Millisecond):
+  case <-ctx.Done():
+    return ctx.Err()
   }
-  shard %= shardmaster.NShards
-  return shard
+  config, err := ck.sm.QueryCtx(ctx, -1)
+  if err != nil {
+    return err
+  }
+  ck.config = config
+  return nil
 }
 
 //
@@ -83,16 +82,21 @@ func key2shard(key string) int {
 // keeps trying forever in the face of all other errors.
 //
 func (ck *Clerk) Get(key string) string {
-  ck.mu.Lock()
-  defer ck.mu.Unlock()
+  v, _ := ck.GetCtx(context.Background(), key)
+  return v
+}
+
+func (ck *Clerk) GetCtx(ctx context.Context, key string) (string, error) {
+  if err := ck.lock(ctx); err != nil {
+    return "", err
+  }
+  defer ck.unlock()
 
   // You'll have to modify Get().
   // modified by Shusen Xu
 
   for {
-    shard := key2shard(key)
-
-    gid := ck.config.Shards[shard]
+    gid := ck.config.Owner(key)
 
     servers, ok := ck.config.Groups[gid]
 
@@ -104,9 +108,12 @@ func (ck *Clerk) Get(key string) string {
         args.Pid = fmt.Sprintf("%d_%s", time.Now().UnixNano(), ck.uid)
         args.Uid = ck.uid
         var reply GetReply
-        ok := call(srv, "ShardKV.Get", args, &reply)
-        if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
-          return reply.Value
+        ok := ck.pool.CallContext(ctx, srv, "ShardKV.Get", args, &reply)
+        if ok && reply.Err == OK {
+          return reply.Value, nil
+        }
+        if ok && reply.Err == ErrNoKey {
+          return "", ErrNotFound
         }
         if ok && (reply.Err == ErrWrongGroup) {
           break
@@ -114,40 +121,42 @@ func (ck *Clerk) Get(key string) string {
       }
     }
 
-    time.Sleep(100 * time.Millisecond)
-
-    // ask master for a new configuration.
-    ck.config = ck.sm.Query(-1)
+    if err := ck.refresh(ctx); err != nil {
+      return "", err
+    }
   }
-  return ""
 }
 
 func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
-  ck.mu.Lock()
-  defer ck.mu.Unlock()
+  v, _ := ck.put(context.Background(), &PutArgs{Key: key, Value: value, DoHash: dohash})
+  return v
+}
+
+func (ck *Clerk) put(ctx context.Context, args *PutArgs) (string, error) {
+  if err := ck.lock(ctx); err != nil {
+    return "", err
+  }
+  defer ck.unlock()
 
   // You'll have to modify Put().
   // added by Shusen Xu
-  args := &PutArgs{}
-  args.Key = key
-  args.Value = value
-  args.DoHash = dohash
+  key := args.Key
   args.Pid = fmt.Sprintf("%d_%s", time.Now().UnixNano(), ck.uid)
   args.Uid = ck.uid
+  ck.seq++
+  args.Seq = ck.seq
   var reply PutReply
   for {
-    shard := key2shard(key)
-
-    gid := ck.config.Shards[shard]
+    gid := ck.config.Owner(key)
 
     servers, ok := ck.config.Groups[gid]
 
     if ok {
       // try each server in the shard's replication group.
       for _, srv := range servers {
-        ok := call(srv, "ShardKV.Put", args, &reply)
+        ok := ck.pool.CallContext(ctx, srv, "ShardKV.Put", args, &reply)
         if ok && reply.Err == OK {
-          return reply.PreviousValue
+          return reply.PreviousValue, nil
         }
         if ok && (reply.Err == ErrWrongGroup) {
           break
@@ -155,10 +164,9 @@ func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
       }
     }
 
-    time.Sleep(100 * time.Millisecond)
-
-    // ask master for a new configuration.
-    ck.config = ck.sm.Query(-1)
+    if err := ck.refresh(ctx); err != nil {
+      return "", err
+    }
   }
 }
 
@@ -169,3 +177,24 @@ func (ck *Clerk) PutHash(key string, value string) string {
   v := ck.PutExt(key, value, true)
   return v
 }
+
+func (ck *Clerk) PutCtx(ctx context.Context, key string, value string) error {
+  _, err := ck.put(ctx, &PutArgs{Key: key, Value: value})
+  return err
+}
+
+func (ck *Clerk) PutHashCtx(ctx context.Context, key string, value string) (string, error) {
+  return ck.put(ctx, &PutArgs{Key: key, Value: value, DoHash: true})
+}
+
+//
+// Put a key that expires after ttl; Gets then find "".
+//
+func (ck *Clerk) PutWithTTL(key string, value string, ttl time.Duration) {
+  ck.PutWithTTLCtx(context.Background(), key, value, ttl)
+}
+
+func (ck *Clerk) PutWithTTLCtx(ctx context.Context, key string, value string, ttl time.Duration) error {
+  _, err := ck.put(ctx, &PutArgs{Key: key, Value: value, TTL: ttl})
+  return err
+}
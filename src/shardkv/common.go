@@ -1,5 +1,6 @@
 package shardkv
 import "hash/fnv"
+import "time"
 
 //
 // Sharded key/value server.
@@ -14,6 +15,7 @@ const (
     OK = "OK"
     ErrNoKey = "ErrNoKey"
     ErrWrongGroup = "ErrWrongGroup"
+    ErrNotReady = "ErrNotReady" // GetShard: not at that config yet
 )
 type Err string
 
@@ -21,6 +23,7 @@ type PutArgs struct {
     Key string
     Value string
     DoHash bool  // For PutHash
+    TTL time.Duration // 0 for a key that doesn't expire
     // You'll have to add definitions here.
     // Field names must start with capital letters,
     // otherwise RPC will break.
@@ -28,6 +31,7 @@ type PutArgs struct {
     // added by Shusen Xu
     Uid string
     Pid string
+    Seq int64 // of this Put among the client's; see dedup.go
 }
 
 type PutReply struct {
@@ -53,11 +57,23 @@ type GetShardArgs struct {
     Num   int
     Shard int
     Gid   int64
+    Lo    uint64 // the shard's hashes in Config Num:
+    Hi    uint64 // Lo <= KeyHash(key) < Hi
 }
 
 type GetShardReply struct {
+    Err     Err
     Data    map[string]Value
-    ReqData map[string]kvdata
+    Clients map[string]ClientEntry // see dedup.go
+}
+
+type DeleteShardArgs struct {
+    Num   int // the config the shard was installed at
+    Shard int
+}
+
+type DeleteShardReply struct {
+    Err Err
 }
 
 func hash(s string) uint32 {
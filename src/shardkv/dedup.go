@@ -0,0 +1,80 @@
+package shardkv
+
+//
+// at-most-once Puts.
+//
+// a Clerk numbers its Puts 1, 2, ... (PutArgs.Seq) and sends one at
+// a time, retrying each until some group takes it. a group remembers,
+// for each client (PutArgs.Uid), its last Put applied and what that
+// Put returned, so a retry of it gets the same reply and a retry of
+// anything older is ignored.
+//
+// a client's entry goes with the shard its last Put was to: GetShard
+// hands over the entries whose Key is in the shard, and OpInstall
+// keeps whichever of two entries is newer. a retry that follows its
+// shard to a new group is still recognized there.
+//
+
+import "shardmaster"
+
+// a client's last Put.
+type ClientEntry struct {
+  Seq   int64
+  Key   string
+  Value string // what the Put returned
+}
+
+//
+// if op is a Put its client has already had applied, what it
+// returned.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) executed(op Op) (result, bool) {
+  e, ok := kv.clients[op.Uid]
+  if op.Op != OpPut || op.Uid == "" || !ok || op.Seq > e.Seq {
+    return result{}, false
+  }
+  if op.Seq == e.Seq {
+    return result{OK, e.Value}, true
+  }
+  // the client has moved on, and won't look at this reply.
+  return result{err: OK}, true
+}
+
+//
+// record the Put op, which returned value.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) remember(op Op, value string) {
+  if op.Uid != "" {
+    kv.clients[op.Uid] = ClientEntry{op.Seq, op.Key, value}
+  }
+}
+
+//
+// the entries of clients whose last Put was to a key whose hash is
+// in [lo, hi).
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) clientsIn(lo uint64, hi uint64) map[string]ClientEntry {
+  clients := make(map[string]ClientEntry)
+  for uid, e := range kv.clients {
+    if h := uint64(shardmaster.KeyHash(e.Key)); lo <= h && h < hi {
+      clients[uid] = e
+    }
+  }
+  return clients
+}
+
+//
+// take in entries that came with a shard, keeping the newer of any
+// two for the same client.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) mergeClients(clients map[string]ClientEntry) {
+  for uid, e := range clients {
+    if cur, ok := kv.clients[uid]; !ok || e.Seq > cur.Seq {
+      kv.clients[uid] = e
+    }
+  }
+}
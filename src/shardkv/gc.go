@@ -0,0 +1,132 @@
+package shardkv
+
+//
+// dropping the keys of shards that other groups have installed.
+//
+// a HandedOff shard's keys stay until its new group has them in
+// its own log. then the new group asks the old one to drop them
+// (DeleteShard), the old group does it with an OpDelete in its log,
+// and once that's done the new group puts an OpConfirm in its log,
+// so it stops asking. until the OpDelete the old group still holds
+// the keys, but answers ErrWrongGroup for them like any shard it
+// doesn't serve.
+//
+// an OpDelete keeps the keys of any shard the old group holds again
+// by then: a shard may have been split and part of it come back.
+//
+
+import "fmt"
+import "shardmaster"
+import "time"
+
+// a shard we installed, whose old group may still hold its keys.
+type Handoff struct {
+  Num     int // the config we pulled it at
+  Shard   int
+  Servers []string // the old group's
+}
+
+func handoffKey(num int, shard int) string {
+  return fmt.Sprintf("%d/%d", num, shard)
+}
+
+//
+// the group that installed shard req.Shard at config req.Num no
+// longer needs our copy.
+//
+func (kv *ShardKV) DeleteShard(req *DeleteShardArgs, rsp *DeleteShardReply) error {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+
+  kv.catchUp()
+  if kv.cfg.Num < req.Num {
+    rsp.Err = ErrNotReady
+    return nil
+  }
+  if s := kv.shards[req.Shard]; s.Status == HandedOff && s.Num == req.Num {
+    kv.ProcessOp(Op{Op: OpDelete, Shard: req.Shard, Num: req.Num,
+      Pid: fmt.Sprintf("Delete_%d_%d", req.Num, req.Shard)})
+  }
+  rsp.Err = OK
+  return nil
+}
+
+//
+// drop a HandedOff shard's keys, unless a copy of this OpDelete
+// got here first.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) applyDelete(op Op) {
+  s, ok := kv.shards[op.Shard]
+  if !ok || s.Status != HandedOff || s.Num != op.Num {
+    return
+  }
+  for key := range kv.data {
+    h := uint64(shardmaster.KeyHash(key))
+    if h < s.Lo || h >= s.Hi {
+      continue
+    }
+    if held := kv.shards[kv.cfg.ShardOf(uint32(h))]; held.Status == Serving || held.Status == Pulling {
+      continue
+    }
+    delete(kv.data, key)
+  }
+  delete(kv.shards, op.Shard)
+}
+
+//
+// the old group has dropped a shard we installed.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) applyConfirm(op Op) {
+  delete(kv.handoffs, handoffKey(op.Num, op.Shard))
+}
+
+//
+// tell h's old group to drop its copy, and once it has, get an
+// OpConfirm into our log.
+//
+func (kv *ShardKV) confirm(key string, h Handoff) {
+  defer func() {
+    kv.mu.Lock()
+    delete(kv.confirming, key)
+    kv.mu.Unlock()
+  }()
+
+  req := DeleteShardArgs{h.Num, h.Shard}
+  for i := 0; kv.dead == false; i++ {
+    kv.mu.Lock()
+    _, owed := kv.handoffs[key]
+    kv.mu.Unlock()
+    if !owed {
+      return
+    }
+
+    var rsp DeleteShardReply
+    srv := h.Servers[i % len(h.Servers)]
+    if kv.pool.Call(srv, "ShardKV.DeleteShard", &req, &rsp) && rsp.Err == OK {
+      kv.mu.Lock()
+      kv.ProcessOp(Op{Op: OpConfirm, Shard: h.Shard, Num: h.Num,
+        Pid: fmt.Sprintf("Confirm_%d_%d", h.Num, h.Shard)})
+      kv.mu.Unlock()
+      return
+    }
+    if (i + 1) % len(h.Servers) == 0 {
+      time.Sleep(100 * time.Millisecond)
+    }
+  }
+}
+
+//
+// start a confirm() for every handoff that hasn't one.
+//
+func (kv *ShardKV) startConfirms() {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+  for key, h := range kv.handoffs {
+    if !kv.confirming[key] && len(h.Servers) > 0 {
+      kv.confirming[key] = true
+      go kv.confirm(key, h)
+    }
+  }
+}
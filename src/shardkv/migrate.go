@@ -0,0 +1,259 @@
+package shardkv
+
+//
+// moving shards between groups.
+//
+// a group moves through the shardmaster's configs one at a time,
+// each by an OpConfig in its log, so every replica changes config
+// at the same point. applying config N puts each shard in a state:
+//
+//   Serving   -- ours in N, and we have its keys.
+//   Pulling   -- ours in N, but another group had it in N-1; we
+//                fetch its keys from that group (GetShard) and get
+//                them into the log with an OpInstall.
+//   HandedOff -- ours in N-1 but not in N; we keep its keys until
+//                the group pulling it has them (see gc.go).
+//
+// a shard with no state is one we have nothing to do with. only
+// Serving shards take Gets and Puts, and that's checked as each op
+// is applied, so an op that was proposed before the config changed
+// but lands after it gets ErrWrongGroup.
+//
+// every Pulling shard is fetched at once, each by its own
+// goroutine, and the rest go on serving meanwhile. we don't take
+// config N+1 until no shard is Pulling, so a group asked for a
+// shard at config N never needs to have got further than N itself:
+// once it has applied config N it will take no more writes to it.
+//
+
+import "context"
+import "shardmaster"
+import "time"
+
+const (
+  Serving   = "Serving"
+  Pulling   = "Pulling"
+  HandedOff = "HandedOff"
+)
+
+type ShardState struct {
+  Status  string
+  Num     int      // the config that put the shard in Status
+  From    int64    // Pulling: the group that had it
+  Servers []string // Pulling: that group's servers
+  Lo      uint64   // the shard's hashes at Num:
+  Hi      uint64   // Lo <= KeyHash(key) < Hi
+}
+
+// whether we're serving the shard key is in.
+// caller must hold kv.mu.
+func (kv *ShardKV) serving(key string) bool {
+  shard := kv.cfg.Shard(key)
+  return shard >= 0 && kv.shards[shard].Status == Serving
+}
+
+// whether any shard is still on its way here.
+// caller must hold kv.mu.
+func (kv *ShardKV) migrating() bool {
+  for _, s := range kv.shards {
+    if s.Status == Pulling {
+      return true
+    }
+  }
+  return false
+}
+
+//
+// move from kv.cfg to ncfg, the next config. a copy of an OpConfig
+// that's already been applied, or one that comes while shards are
+// still Pulling, does nothing.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) applyConfig(ncfg shardmaster.Config) {
+  if ncfg.Num != kv.cfg.Num + 1 || kv.migrating() {
+    return
+  }
+  shards := make(map[int]ShardState)
+  for j := 0; j < len(ncfg.Shards); j++ {
+    // a shard split off in ncfg was part of another in kv.cfg.
+    from := int64(0)
+    if old := kv.cfg.ShardOf(ncfg.Starts[j]); old >= 0 {
+      from = kv.cfg.Shards[old]
+    }
+    lo, hi := ncfg.Bounds(j)
+    s := ShardState{Num: ncfg.Num, Lo: lo, Hi: hi}
+    switch {
+    case ncfg.Shards[j] == kv.gid && (from == kv.gid || from == 0):
+      s.Status = Serving
+    case ncfg.Shards[j] == kv.gid:
+      s.Status = Pulling
+      s.From = from
+      s.Servers = kv.cfg.Groups[from]
+    case from == kv.gid:
+      s.Status = HandedOff
+    default:
+      if prev, ok := kv.shards[j]; ok && prev.Status == HandedOff {
+        // still waiting to be pulled; its keys stay.
+        shards[j] = prev
+      }
+      continue
+    }
+    shards[j] = s
+  }
+  kv.shards = shards
+  cfg := ncfg
+  kv.cfg = &cfg
+}
+
+//
+// the keys of a shard we were Pulling, as its old group had them.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) applyInstall(op Op) {
+  s, ok := kv.shards[op.Shard]
+  if !ok || s.Status != Pulling || s.Num != op.Num {
+    return
+  }
+  // anything left from when the shard was last here is stale.
+  for key := range kv.data {
+    if h := uint64(shardmaster.KeyHash(key)); s.Lo <= h && h < s.Hi {
+      delete(kv.data, key)
+    }
+  }
+  for key, val := range op.Data {
+    kv.data[key] = val
+  }
+  kv.mergeClients(op.Clients)
+  s.Status = Serving
+  kv.shards[op.Shard] = s
+  kv.handoffs[handoffKey(op.Num, op.Shard)] = Handoff{op.Num, op.Shard, s.Servers}
+}
+
+//
+// apply every instance decided so far, without proposing one.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) catchUp() {
+  for {
+    decided, v := kv.px.Status(kv.seq + 1)
+    if !decided {
+      return
+    }
+    op, _ := v.(Op)
+    kv.apply(op)
+  }
+}
+
+//
+// another group, at config req.Num, wants the keys of the shard
+// that Lo and Hi bound. we can give them once we've reached that
+// config ourselves.
+//
+func (kv *ShardKV) GetShard(req *GetShardArgs, rsp *GetShardReply) error {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+
+  kv.catchUp()
+  if kv.cfg.Num < req.Num {
+    rsp.Err = ErrNotReady
+    return nil
+  }
+
+  rsp.Err = OK
+  rsp.Data = make(map[string]Value)
+  for k, v := range kv.data {
+    if h := uint64(shardmaster.KeyHash(k)); req.Lo <= h && h < req.Hi {
+      rsp.Data[k] = v
+    }
+  }
+  rsp.Clients = kv.clientsIn(req.Lo, req.Hi)
+  return nil
+}
+
+//
+// fetch one Pulling shard from its old group, and get its keys
+// into our log. gives up if the shard stops Pulling, as when
+// another replica of our group installs it first.
+//
+func (kv *ShardKV) pull(shard int, s ShardState) {
+  defer func() {
+    kv.mu.Lock()
+    delete(kv.inflight, shard)
+    kv.mu.Unlock()
+  }()
+
+  req := GetShardArgs{s.Num, shard, kv.gid, s.Lo, s.Hi}
+  for i := 0; kv.dead == false; i++ {
+    kv.mu.Lock()
+    cur := kv.shards[shard]
+    kv.mu.Unlock()
+    if cur.Status != Pulling || cur.Num != s.Num {
+      return
+    }
+
+    var rsp GetShardReply
+    srv := s.Servers[i % len(s.Servers)]
+    if kv.pool.Call(srv, "ShardKV.GetShard", &req, &rsp) && rsp.Err == OK {
+      kv.mu.Lock()
+      kv.ProcessOp(Op{Op: OpInstall, Pid: kv.getPid(s.Num, shard),
+        Shard: shard, Num: s.Num, Data: rsp.Data, Clients: rsp.Clients})
+      kv.mu.Unlock()
+      return
+    }
+    if (i + 1) % len(s.Servers) == 0 {
+      time.Sleep(100 * time.Millisecond)
+    }
+  }
+}
+
+//
+// start a pull for every Pulling shard that hasn't one.
+//
+func (kv *ShardKV) startPulls() {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+  for shard, s := range kv.shards {
+    if s.Status == Pulling && !kv.inflight[shard] && len(s.Servers) > 0 {
+      kv.inflight[shard] = true
+      go kv.pull(shard, s)
+    }
+  }
+}
+
+//
+// follow the shardmaster's configs: wait for new ones, and get
+// each into the log in turn once the shards the last one gave us
+// have arrived.
+//
+func (kv *ShardKV) watch() {
+  var pending []shardmaster.Config
+  for kv.dead == false {
+    kv.mu.Lock()
+    num, busy := kv.cfg.Num, kv.migrating()
+    kv.mu.Unlock()
+    if busy {
+      kv.startPulls()
+      time.Sleep(50 * time.Millisecond)
+      continue
+    }
+
+    for len(pending) > 0 && pending[0].Num <= num {
+      pending = pending[1:]
+    }
+    if len(pending) == 0 || pending[0].Num != num + 1 {
+      ctx, cancel := context.WithTimeout(context.Background(), 2 * shardmaster.WatchTimeout)
+      configs, err := kv.sm.WatchConfigsCtx(ctx, num)
+      cancel()
+      if err != nil {
+        time.Sleep(250 * time.Millisecond)
+      }
+      pending = configs
+      continue
+    }
+
+    kv.mu.Lock()
+    kv.ProcessOp(Op{Op: OpConfig, Pid: kv.getPid(pending[0].Num, -1),
+      Config: pending[0]})
+    kv.mu.Unlock()
+  }
+}
@@ -1,16 +1,16 @@
 package shardkv
 
 import "net"
+import "bytes"
+import "context"
 import "fmt"
 import "net/rpc"
 import "log"
 import "time"
 import "paxos"
 import "sync"
-import "os"
-import "syscall"
 import "encoding/gob"
-import "math/rand"
+import "transport"
 import "shardmaster"
 import "strconv"
 
@@ -26,13 +26,22 @@ func DPrintf(format string, a ...interface{}) (n int, err error) {
 const (
   OpGet  = "Get"
   OpPut  = "Put"
-  OpJoin = "Join"
-  OpLeave = "Leave"
+  OpConfig = "Config"   // see migrate.go
+  OpInstall = "Install" // see migrate.go
+  OpDelete = "Delete"   // see gc.go
+  OpConfirm = "Confirm" // see gc.go
+  OpExpire = "Expire" // from the leader; see ttl.go
 )
 // helper struct added by Shusen Xu
 type Value struct {
   Val     string
   Version int
+  Expires int64 // in unix nanoseconds; 0 for never
+}
+
+// whether v has expired by now.
+func (v Value) expired(now int64) bool {
+  return v.Expires != 0 && v.Expires <= now
 }
 
 type Op struct {
@@ -42,23 +51,33 @@ type Op struct {
   Val  string
   Hash bool
   Pid  string
-  Data map[string]Value
-  ReqData  map[string]kvdata
-  seqNum  int
+  Uid  string // OpPut only
+  Seq  int64  // OpPut only
+  Data map[string]Value  // OpInstall only
+  Clients map[string]ClientEntry // OpInstall only
+  Shard   int   // OpInstall, OpDelete and OpConfirm only
+  Num     int   // OpInstall, OpDelete and OpConfirm only
+  Config  shardmaster.Config // OpConfig only
+  TTL     int64 // OpPut only; nanoseconds, 0 for none
+  Time    int64 // the proposer's clock; see ttl.go
 }
 
-type kvdata struct {
-  Key string
-  Val string
+// what applying an Op tells the client that asked for it.
+type result struct {
+  err   Err
+  value string
 }
 
-type State struct {
-  data   map[string]kvdata
-  reqmap map[string]string
-  queue  []string
-  head   int
-  tail   int
-  size   int
+// what a paxos snapshot of this server holds;
+// ShardKV's fields, exported for gob.
+type Snapshot struct {
+  Seq     int
+  LogTime int64
+  Data    map[string]Value
+  Clients map[string]ClientEntry
+  Cfg     shardmaster.Config
+  Shards  map[int]ShardState
+  Handoffs map[string]Handoff
 }
 
 type ShardKV struct {
@@ -69,199 +88,220 @@ type ShardKV struct {
   unreliable bool // for testing
   sm         *shardmaster.Clerk
   px         *paxos.Paxos
+  pool       *transport.Pool
   gid        int64 // my replica group ID
   // Your definitions here.
   cfg        *shardmaster.Config
-  configLock    sync.Mutex
+  shards     map[int]ShardState // see migrate.go
+  inflight   map[int]bool // shards a pull() is fetching
+  handoffs   map[string]Handoff // see gc.go
+  confirming map[string]bool // handoffs a confirm() is working on
   data       map[string]Value
+  clients    map[string]ClientEntry // see dedup.go
   seq        int
-  state         State
+  logTime    int64 // latest Op.Time applied
+  waiters    map[string]*waiter // by Pid; see ProcessOp
 }
 // the above are helper structs added by Shusen Xu
 
 // the following are helper functions added by Shusen Xu
-func (state *State) Check(pid string) bool {
-  _, ok := state.data[pid]
-  return ok
-}
-
-func (state *State) Append(pid string, key string, val string) {
-  if len(state.data) == state.size {
-    oldpid := state.queue[state.head]
-    kv := state.data[oldpid]
-    delete(state.data, pid)
-    delete(state.reqmap, kv.Key)
-    state.head = (state.head + 1) % state.size
-  }
 
-  state.queue[state.tail] = pid
-  state.tail = (state.tail + 1) % state.size
-  state.data[pid] = kvdata{key, val}
-  state.reqmap[key] = pid
+// a ProcessOp waiting for its op to be applied.
+type waiter struct {
+  n    int  // ProcessOps waiting on the same Pid
+  done bool // r is what applying the op gave
+  r    result
 }
 
-func (state *State) GetByKey(key string) (string, string) {
-  return state.reqmap[key], state.data[state.reqmap[key]].Val
+// called by paxos from Done(), with kv.mu held.
+func (kv *ShardKV) takeSnapshot() []byte {
+  s := Snapshot{kv.seq, kv.logTime, kv.data, kv.clients, *kv.cfg, kv.shards, kv.handoffs}
+  var buf bytes.Buffer
+  if err := gob.NewEncoder(&buf).Encode(&s); err != nil {
+    log.Fatal("snapshot encode: ", err)
+  }
+  return buf.Bytes()
 }
 
-func (kv *ShardKV) waitForAgreement(seq int) Op {
-  to := 10 * time.Millisecond
-  for {
-    if ok, val := kv.px.Status(seq); ok {
-      return val.(Op)
-    }
-    time.Sleep(to)
-    if to < 10*time.Second {
-      to *= 2
-    }
+// called by paxos from Wait(), in ProcessOp without kv.mu.
+func (kv *ShardKV) installSnapshot(b []byte) {
+  var s Snapshot
+  if err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(&s); err != nil {
+    log.Fatal("snapshot decode: ", err)
+  }
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+  if s.Seq <= kv.seq {
+    return
+  }
+  kv.data = make(map[string]Value)
+  for k, v := range s.Data {
+    kv.data[k] = v
+  }
+  kv.clients = make(map[string]ClientEntry)
+  for uid, e := range s.Clients {
+    kv.clients[uid] = e
+  }
+  kv.seq = s.Seq
+  kv.logTime = s.LogTime
+  cfg := s.Cfg
+  kv.cfg = &cfg
+  kv.shards = make(map[int]ShardState)
+  for j, st := range s.Shards {
+    kv.shards[j] = st
+  }
+  kv.handoffs = make(map[string]Handoff)
+  for key, h := range s.Handoffs {
+    kv.handoffs[key] = h
   }
 }
 
-func (kv *ShardKV) ProcessHelper(op Op) {
+func (kv *ShardKV) ProcessHelper(op Op) result {
+  if op.Time > kv.logTime {
+    kv.logTime = op.Time
+  }
 
   switch op.Op {
   case OpGet:
-    //val, _ := kv.data[o.Key]
-    //kv.v.Add(o.Pid, val)
-    DPrintf("Get result key:%s ret:%s gid:%d seq:%d pid:%s\n",
-      op.Key, kv.data[op.Key].Val, kv.gid, kv.cfg.Num, op.Pid)
+    if !kv.serving(op.Key) {
+      return result{err: ErrWrongGroup}
+    }
+    val, ok := kv.data[op.Key]
+    if !ok || val.expired(kv.logTime) {
+      // an expired key may not have been removed yet.
+      return result{err: ErrNoKey}
+    }
+    return result{OK, val.Val}
 
   case OpPut:
+    if !kv.serving(op.Key) {
+      return result{err: ErrWrongGroup}
+    }
+    if r, done := kv.executed(op); done {
+      // a retry, from a client that timed out, got in twice.
+      return r
+    }
     oldv, _ := kv.data[op.Key]
+    if oldv.expired(kv.logTime) {
+      // not removed yet, but gone as far as the log's concerned.
+      oldv = Value{}
+    }
     if op.Hash {
       newval := strconv.Itoa(int(hash(oldv.Val + op.Val)))
-      kv.data[op.Key] = Value{newval, oldv.Version + 1}
+      kv.data[op.Key] = Value{newval, oldv.Version + 1, oldv.Expires}
 
-      kv.state.Append(op.Pid, op.Key, oldv.Val)
-    } else {
-      kv.data[op.Key] = Value{op.Val, oldv.Version + 1}
+      kv.remember(op, oldv.Val)
+      return result{OK, oldv.Val}
     }
-  case OpJoin:
-    for key, val := range op.Data {
-      if val.Version > kv.data[key].Version {
-        kv.data[key] = val
+    kv.data[op.Key] = Value{op.Val, oldv.Version + 1, kv.expiry(op.TTL)}
+    kv.remember(op, "")
+  case OpConfig:
+    kv.applyConfig(op.Config)
+  case OpInstall:
+    kv.applyInstall(op)
+  case OpDelete:
+    kv.applyDelete(op)
+  case OpConfirm:
+    kv.applyConfirm(op)
+  case OpExpire:
+    for key, val := range kv.data {
+      if val.expired(kv.logTime) {
+        delete(kv.data, key)
       }
     }
+  }
+  return result{err: OK}
+}
 
-    for pid, v := range op.ReqData {
-      kv.state.Append(pid, v.Key, v.Val)
-    }
-  case OpLeave:
-    newdata := make(map[string]Value)
-    for key, val := range kv.data {
-      newdata[key] = val
-    }
-    for key, _ := range op.Data {
-      delete(newdata, key)
-    }
-    kv.data = newdata
+//
+// apply instance kv.seq+1, which is decided, and hand the result
+// to any ProcessOp waiting for it.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) apply(op Op) {
+  r := kv.ProcessHelper(op)
+  kv.seq++
+  kv.px.Done(kv.seq)
+  if w, ok := kv.waiters[op.Pid]; ok {
+    w.done, w.r = true, r
   }
 }
 
-func (kv *ShardKV) ProcessOp(op Op) {
-  var tmpOp Op
-  if kv.state.Check(op.Pid) {
-    return
+//
+// get op into the log, applying everything before it, and
+// return what applying op gave. kv.mu is released while paxos
+// agrees, so other ops, and pulls of other shards, go on
+// meanwhile; the caller can't count on anything it read from kv
+// before still holding after.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) ProcessOp(op Op) result {
+  if r, done := kv.executed(op); done {
+    return r
   }
-  //fmt.Printf("begin to sync %#v\n", o)
-  for {
-    ok, v := kv.px.Status(kv.seq + 1)
-    if ok {
-      tmpOp = v.(Op)
-    } else {
-      kv.px.Start(kv.seq+1, op)
-      tmpOp = kv.waitForAgreement(kv.seq + 1)
+  op.Time = time.Now().UnixNano()
+  w, ok := kv.waiters[op.Pid]
+  if !ok {
+    w = &waiter{}
+    kv.waiters[op.Pid] = w
+  }
+  w.n++
+  defer func() {
+    if w.n--; w.n == 0 {
+      delete(kv.waiters, op.Pid)
     }
+  }()
 
-    kv.ProcessHelper(tmpOp)
-    kv.seq++
-    kv.px.Done(kv.seq)
-    if tmpOp.Pid == op.Pid {
-      break
+  for !kv.dead && !w.done {
+    seq := kv.seq + 1
+    if decided, v := kv.px.Status(seq); decided {
+      tmpOp, _ := v.(Op)
+      kv.apply(tmpOp)
+      continue
     }
-  }
-}
-
-func (kv *ShardKV) GetShard(req *GetShardArgs, rsp *GetShardReply) error {
-  kv.mu.Lock()
-
-  // Use a fake operation to synchorize the data
-  fake := Op{Op: OpGet, Key: "tmp", Pid: kv.getPid(int(rand.Int31()), int(rand.Int31()))}
-  kv.ProcessOp(fake)
-
-  op := Op{Op: OpLeave, Data: make(map[string]Value)}
-  rsp.Data = make(map[string]Value)
-  rsp.ReqData = make(map[string]kvdata)
-  for k, v := range kv.data {
-
-    if req.Shard == key2shard(k) {
-      rsp.Data[k] = v
-      op.Data[k] = v
-      pid, val := kv.state.GetByKey(k)
-      rsp.ReqData[pid] = kvdata{k, val}
+    kv.px.Start(seq, op)
+    kv.mu.Unlock()
+    _, err := kv.px.Wait(seq, context.Background())
+    kv.mu.Lock()
+    if err == paxos.ErrForgotten {
+      // a snapshot moved us past seq, and may hold op.
+      if r, done := kv.executed(op); done {
+        return r
+      }
     }
+    // seq is decided, or forgotten; apply it, if another
+    // ProcessOp hasn't already.
   }
-  kv.cfg.Shards[req.Shard] = req.Gid
-  kv.mu.Unlock()
-  return nil
+  if w.done {
+    return w.r
+  }
+  // killed; the client will try elsewhere.
+  return result{err: ErrWrongGroup}
 }
 
 func (kv *ShardKV) getPid(cfgnum int, shard int) string {
   return fmt.Sprintf("ChangeJoinState_%d_%d", cfgnum, shard)
 }
 
-func (kv *ShardKV) Reconfig(cfg *shardmaster.Config) {
-  for i := kv.cfg.Num + 1; i <= cfg.Num; i++ {
-    ncfg := kv.sm.Query(i)
-    if kv.cfg.Num == 0 {
-      kv.cfg = &ncfg
-      continue
-    }
-    // query new config
-    for j := 0; j < shardmaster.NShards; j++ {
-      if kv.cfg.Shards[j] != kv.gid && ncfg.Shards[j] == kv.gid {
-        req := GetShardArgs{ncfg.Num, j, kv.gid}
-        rsp := GetShardReply{}
-        svrs := kv.cfg.Groups[kv.cfg.Shards[j]]
-        pos := 0
-        for len(svrs) > 0 {
-          if call(svrs[pos], "ShardKV.GetShard", &req, &rsp) {
-            break
-          }
-          pos = (pos + 1) % len(svrs)
-        }
-
-        if len(rsp.Data) > 0 {
-          kv.mu.Lock()
-          kv.ProcessOp(Op{Op: OpJoin, Pid: kv.getPid(cfg.Num, j),
-            Data: rsp.Data, ReqData: rsp.ReqData, seqNum: cfg.Num})
-          kv.mu.Unlock()
-        }
-        kv.cfg.Shards[j] = kv.gid
-      }
-    }
-
-    kv.cfg = &ncfg
-
-  }
-}
-// the above  are helper functions added by Shusen Xu
-
+//
+// move through configs, which follow kv.cfg in order, fetching the
+// shards each one gives us.
+//
 func (kv *ShardKV) Get(args *GetArgs, reply *GetReply) error {
   // Your code here.
   // added by Shusen Xu
   kv.mu.Lock()
   defer kv.mu.Unlock()
 
-  if kv.cfg.Shards[key2shard(args.Key)] != kv.gid {
-    // Get error, not my group
+  if !kv.serving(args.Key) {
+    // Get error, not my group, or not yet
     reply.Err = ErrWrongGroup
     return nil
   }
 
-  reply.Err = OK
-  kv.ProcessOp(Op{Op: OpGet, Key: args.Key, Pid: args.Pid})
-  reply.Value = kv.data[args.Key].Val
+  r := kv.ProcessOp(Op{Op: OpGet, Key: args.Key, Pid: args.Pid})
+  reply.Err = r.err
+  reply.Value = r.value
   return nil
 }
 
@@ -271,32 +311,25 @@ func (kv *ShardKV) Put(args *PutArgs, reply *PutReply) error {
   kv.mu.Lock()
   defer kv.mu.Unlock()
 
-  if kv.cfg.Shards[key2shard(args.Key)] != kv.gid {
+  if !kv.serving(args.Key) {
     // Set error group
     reply.Err = ErrWrongGroup
     return nil
 
   }
 
-  reply.Err = OK
-  reply.PreviousValue = ""
-  kv.ProcessOp(Op{Op: OpPut, Key: args.Key, Val: args.Value,
-    Pid: args.Pid, Hash: args.DoHash})
-
-  if val, ok := kv.state.data[args.Pid]; ok {
-    reply.PreviousValue = val.Val
-  }
-
+  op := Op{Op: OpPut, Key: args.Key, Val: args.Value,
+    Pid: args.Pid, Hash: args.DoHash, Uid: args.Uid, Seq: args.Seq,
+    TTL: int64(args.TTL)}
+  r := kv.ProcessOp(op)
+  reply.Err = r.err
+  reply.PreviousValue = r.value
   return nil
 }
 
 func (kv *ShardKV) tick() {
-  kv.configLock.Lock()
-  defer kv.configLock.Unlock()
-  config := kv.sm.Query(-1)
-  if config.Num > kv.cfg.Num {
-    kv.Reconfig(&config)
-  }
+  kv.expire()
+  kv.startConfirms()
 }
 
 // tell the server to shut itself down.
@@ -304,6 +337,7 @@ func (kv *ShardKV) kill() {
   kv.dead = true
   kv.l.Close()
   kv.px.Kill()
+  kv.pool.Close()
 }
 
 //
@@ -316,67 +350,50 @@ func (kv *ShardKV) kill() {
 // Me is the index of this server in servers[].
 //
 func StartServer(gid int64, shardmasters []string,
-    servers []string, me int) *ShardKV {
+    servers []string, me int, t transport.Transport) *ShardKV {
   gob.Register(Op{})
 
   kv := new(ShardKV)
   kv.cfg = &shardmaster.Config{Num: 0}
   kv.me = me
   kv.gid = gid
-  kv.sm = shardmaster.MakeClerk(shardmasters)
+  kv.pool = transport.NewPool(t, transport.DefaultTimeout)
+  kv.sm = shardmaster.MakeClerk(shardmasters, t)
   // Your initialization code here.
   kv.data = make(map[string]Value)
-  kv.state.data = make(map[string]kvdata)
-  kv.state.reqmap = make(map[string]string)
-  kv.state.size = 1024
-  kv.state.queue = make([]string, 1024)
+  kv.shards = make(map[int]ShardState)
+  kv.inflight = make(map[int]bool)
+  kv.handoffs = make(map[string]Handoff)
+  kv.confirming = make(map[string]bool)
+  kv.clients = make(map[string]ClientEntry)
+  kv.waiters = make(map[string]*waiter)
   // Don't call Join().
 
 
   rpcs := rpc.NewServer()
   rpcs.Register(kv)
 
-  kv.px = paxos.Make(servers, me, rpcs)
+  kv.px = paxos.Make(servers, me, rpcs, t)
+  kv.px.SetSnapshotter(kv.takeSnapshot, kv.installSnapshot)
 
-  os.Remove(servers[me])
-  l, e := net.Listen("unix", servers[me])
+  l, e := t.Listen(servers[me])
   if e != nil {
     log.Fatal("listen error: ", e)
   }
   kv.l = l
 
-  // please do not change any of the following code,
-  // or do anything to subvert it.
+  // transport.Serve() is the accept loop, and simulates the
+  // unreliable network the tests depend on; please do not
+  // subvert it.
 
-  go func() {
-    for kv.dead == false {
-      conn, err := kv.l.Accept()
-      if err == nil && kv.dead == false {
-        if kv.unreliable && (rand.Int63()%1000) < 100 {
-          // discard the request.
-          conn.Close()
-        } else if kv.unreliable && (rand.Int63()%1000) < 200 {
-          // process the request but force discard of reply.
-          c1 := conn.(*net.UnixConn)
-          f, _ := c1.File()
-          err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-          if err != nil {
-            fmt.Printf("shutdown: %v\n", err)
-          }
-          go rpcs.ServeConn(conn)
-        } else {
-          go rpcs.ServeConn(conn)
-        }
-      } else if err == nil {
-        conn.Close()
-      }
-      if err != nil && kv.dead == false {
-        fmt.Printf("ShardKV(%v) accept: %v\n", me, err.Error())
-        kv.kill()
-      }
-    }
-  }()
+  go transport.Serve(kv.l, rpcs, transport.Hooks{
+    Name:       fmt.Sprintf("ShardKV(%v)", me),
+    Dead:       func() bool { return kv.dead },
+    Unreliable: func() bool { return kv.unreliable },
+    Failed:     kv.kill,
+  })
 
+  go kv.watch()
   go func() {
     for kv.dead == false {
       kv.tick()
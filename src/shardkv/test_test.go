@@ -1,6 +1,7 @@
 package shardkv
 
 import (
+  "context"
   "sync"
   "testing"
 )
@@ -10,6 +11,7 @@ import "strconv"
 import "os"
 import "time"
 import "fmt"
+import "transport"
 //import "sync"
 import "math/rand"
 
@@ -56,7 +58,7 @@ func setup(tag string, unreliable bool) ([]string, []int64, [][]string, [][]*Sha
     smh[i] = port(tag+"m", i)
   }
   for i := 0; i < nmasters; i++ {
-    sma[i] = shardmaster.StartServer(smh, i)
+    sma[i] = shardmaster.StartServer(smh, i, transport.Unix{})
   }
 
   const ngroups = 3   // replica groups
@@ -73,7 +75,7 @@ func setup(tag string, unreliable bool) ([]string, []int64, [][]string, [][]*Sha
       ha[i][j] = port(tag+"s", (i*nreplicas)+j)
     }
     for j := 0; j < nreplicas; j++ {
-      sa[i][j] = StartServer(gids[i], smh, ha[i], j)
+      sa[i][j] = StartServer(gids[i], smh, ha[i], j, transport.Unix{})
       sa[i][j].unreliable = unreliable
     }
   }
@@ -89,10 +91,10 @@ func TestBasic(t *testing.T) {
 
   fmt.Printf("Test: Basic Join/Leave ...\n")
 
-  mck := shardmaster.MakeClerk(smh)
+  mck := shardmaster.MakeClerk(smh, transport.Unix{})
   mck.Join(gids[0], ha[0])
 
-  ck := MakeClerk(smh)
+  ck := MakeClerk(smh, transport.Unix{})
 
   ck.Put("a", "x")
   v := ck.PutHash("a", "b")
@@ -146,22 +148,91 @@ func TestBasic(t *testing.T) {
 }
 
 
+func TestSplit(t *testing.T) {
+  smh, gids, ha, _, clean := setup("split", false)
+  defer clean()
+
+  fmt.Printf("Test: Keys survive Split and moving split shards ...\n")
+
+  mck := shardmaster.MakeClerk(smh, transport.Unix{})
+  mck.Join(gids[0], ha[0])
+
+  ck := MakeClerk(smh, transport.Unix{})
+
+  keys := make([]string, 30)
+  vals := make([]string, len(keys))
+  for i := 0; i < len(keys); i++ {
+    keys[i] = "k" + strconv.Itoa(i)
+    vals[i] = strconv.Itoa(rand.Int())
+    ck.Put(keys[i], vals[i])
+  }
+
+  for s := 0; s < shardmaster.NShards; s++ {
+    mck.Split(s)
+  }
+  time.Sleep(1 * time.Second)
+  for i := 0; i < len(keys); i++ {
+    if v := ck.Get(keys[i]); v != vals[i] {
+      t.Fatalf("after Split; wrong value; k=%v wanted=%v got=%v", keys[i], vals[i], v)
+    }
+  }
+
+  for g := 1; g < len(gids); g++ {
+    mck.Join(gids[g], ha[g])
+    time.Sleep(1 * time.Second)
+  }
+
+  c := mck.Query(-1)
+  moved := 0
+  for i := 0; i < len(keys); i++ {
+    if c.Shard(keys[i]) >= shardmaster.NShards && c.Owner(keys[i]) != gids[0] {
+      moved++
+    }
+    if v := ck.Get(keys[i]); v != vals[i] {
+      t.Fatalf("after Join; wrong value; k=%v wanted=%v got=%v", keys[i], vals[i], v)
+    }
+  }
+  if moved == 0 {
+    t.Fatalf("no key in a split-off shard changed groups")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// a key in each shard of cfg: "0" followed by a number, since
+// keys no longer fall into shards by their first byte.
+//
+func keysPerShard(cfg shardmaster.Config) []string {
+  keys := make([]string, len(cfg.Shards))
+  found := 0
+  for n := 0; found < len(keys); n++ {
+    key := "0" + strconv.Itoa(n)
+    if s := cfg.Shard(key); keys[s] == "" {
+      keys[s] = key
+      found++
+    }
+  }
+  return keys
+}
+
 func TestMove(t *testing.T) {
   smh, gids, ha, _, clean := setup("move", false)
   defer clean()
 
   fmt.Printf("Test: Shards really move ...\n")
 
-  mck := shardmaster.MakeClerk(smh)
+  mck := shardmaster.MakeClerk(smh, transport.Unix{})
   mck.Join(gids[0], ha[0])
 
-  ck := MakeClerk(smh)
+  ck := MakeClerk(smh, transport.Unix{})
 
   // insert one key per shard
+  keys := keysPerShard(mck.Query(-1))
   for i := 0; i < shardmaster.NShards; i++ {
     // before
     //ck.Put(string('0'+i), string('0'+i))
-    ck.Put("0"+strconv.Itoa(int(i)),"0"+strconv.Itoa(int(i)))
+    ck.Put(keys[i], keys[i])
   }
 
   // add group 1.
@@ -174,7 +245,7 @@ func TestMove(t *testing.T) {
     //  t.Fatalf("missing key/value")
     //}
 
-    if ck.Get("0"+strconv.Itoa(int(i))) != "0"+strconv.Itoa(int(i)) {
+    if ck.Get(keys[i]) != keys[i] {
       t.Fatalf("missing key/value")
     }
   }
@@ -188,9 +259,9 @@ func TestMove(t *testing.T) {
   var mu sync.Mutex
   for i := 0; i < shardmaster.NShards; i++ {
     go func(me int) {
-      myck := MakeClerk(smh)
+      myck := MakeClerk(smh, transport.Unix{})
       //v := myck.Get(string('0'+me))
-      v := myck.Get(string("0"+strconv.Itoa(int(me))))
+      v := myck.Get(keys[me])
       // before
       //if v == string('0'+me) {
       //  mu.Lock()
@@ -201,7 +272,7 @@ func TestMove(t *testing.T) {
       //}
 
       // after
-      if v == string("0"+strconv.Itoa(int(me))) {
+      if v == keys[me] {
         mu.Lock()
         count++
         mu.Unlock()
@@ -222,16 +293,295 @@ func TestMove(t *testing.T) {
 }
 
 
+func TestPartialMigration(t *testing.T) {
+  smh, gids, ha, _, clean := setup("partial", false)
+  defer clean()
+
+  fmt.Printf("Test: Shards that can move do while others are stuck ...\n")
+
+  mck := shardmaster.MakeClerk(smh, transport.Unix{})
+  mck.Join(gids[0], ha[0])
+  mck.Join(gids[1], ha[1])
+  time.Sleep(1 * time.Second)
+
+  ck := MakeClerk(smh, transport.Unix{})
+  keys := keysPerShard(mck.Query(-1))
+  for _, k := range keys {
+    ck.Put(k, "v" + k)
+  }
+
+  // group 1 can no longer hand its shards over.
+  for i := 0; i < len(ha[1]); i++ {
+    os.Remove(ha[1][i])
+  }
+  c1 := mck.Query(-1)
+  mck.Join(gids[2], ha[2])
+  c2 := mck.Query(-1)
+
+  fromOthers, stuck := 0, 0
+  for s := range c2.Shards {
+    if c1.Shards[s] == gids[1] {
+      if c2.Shards[s] == gids[2] {
+        stuck++
+      }
+      continue
+    }
+    if c2.Shards[s] == gids[2] {
+      fromOthers++
+    }
+    // not group 1's, so it should be served, moved or not.
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    v, err := ck.GetCtx(ctx, keys[s])
+    cancel()
+    if err != nil || v != "v" + keys[s] {
+      t.Fatalf("shard %v (group %v -> %v): Get returned %v, %v",
+        s, c1.Shards[s], c2.Shards[s], v, err)
+    }
+    ctx, cancel = context.WithTimeout(context.Background(), 5 * time.Second)
+    err = ck.PutCtx(ctx, keys[s], "w" + keys[s])
+    cancel()
+    if err != nil {
+      t.Fatalf("shard %v: Put returned %v", s, err)
+    }
+  }
+  if fromOthers == 0 || stuck == 0 {
+    t.Fatalf("test needs shards moving from both groups; got %v and %v", fromOthers, stuck)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestHandoffGC(t *testing.T) {
+  smh, gids, ha, sa, clean := setup("gc", false)
+  defer clean()
+
+  fmt.Printf("Test: Old group drops shards the new one installed ...\n")
+
+  mck := shardmaster.MakeClerk(smh, transport.Unix{})
+  mck.Join(gids[0], ha[0])
+
+  ck := MakeClerk(smh, transport.Unix{})
+  keys := keysPerShard(mck.Query(-1))
+  for _, k := range keys {
+    ck.Put(k, "v" + k)
+  }
+
+  mck.Join(gids[1], ha[1])
+  c := mck.Query(-1)
+
+  // the new group has every key, whoever serves it.
+  for _, k := range keys {
+    if v := ck.Get(k); v != "v" + k {
+      t.Fatalf("Get(%v) returned %v after the Join", k, v)
+    }
+  }
+
+  for i, kv := range sa[0] {
+    for iters := 0; ; iters++ {
+      kv.mu.Lock()
+      kv.catchUp()
+      left := []string{}
+      for _, k := range keys {
+        if _, ok := kv.data[k]; ok && c.Owner(k) != gids[0] {
+          left = append(left, k)
+        }
+      }
+      handedOff := 0
+      for _, st := range kv.shards {
+        if st.Status == HandedOff {
+          handedOff++
+        }
+      }
+      kv.mu.Unlock()
+      if len(left) == 0 && handedOff == 0 {
+        break
+      }
+      if iters > 50 {
+        t.Fatalf("replica %v still holds %v and %v handed-off shards", i, left, handedOff)
+      }
+      time.Sleep(100 * time.Millisecond)
+    }
+
+    // and refuses them.
+    for _, k := range keys {
+      if c.Owner(k) == gids[0] {
+        continue
+      }
+      args := &GetArgs{Key: k, Pid: strconv.Itoa(rand.Int())}
+      var reply GetReply
+      kv.Get(args, &reply)
+      if reply.Err != ErrWrongGroup {
+        t.Fatalf("replica %v: Get(%v) of a moved key returned %v", i, k, reply.Err)
+      }
+    }
+  }
+
+  for i, kv := range sa[1] {
+    for iters := 0; ; iters++ {
+      kv.mu.Lock()
+      kv.catchUp()
+      owed := len(kv.handoffs)
+      kv.mu.Unlock()
+      if owed == 0 {
+        break
+      }
+      if iters > 50 {
+        t.Fatalf("new group's replica %v never had %v handoffs confirmed", i, owed)
+      }
+      time.Sleep(100 * time.Millisecond)
+    }
+  }
+
+  // moving the shards back still works.
+  mck.Leave(gids[1])
+  time.Sleep(1 * time.Second)
+  for _, k := range keys {
+    if v := ck.Get(k); v != "v" + k {
+      t.Fatalf("Get(%v) returned %v after the Leave", k, v)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestDedup(t *testing.T) {
+  smh, gids, ha, sa, clean := setup("dedup", false)
+  defer clean()
+
+  mck := shardmaster.MakeClerk(smh, transport.Unix{})
+  mck.Join(gids[0], ha[0])
+  ck := MakeClerk(smh, transport.Unix{})
+
+  // send a Put straight to a server, until one of g's takes it.
+  put := func(g int, args PutArgs) PutReply {
+    for iters := 0; ; iters++ {
+      var reply PutReply
+      a := args
+      sa[g][iters % len(sa[g])].Put(&a, &reply)
+      if reply.Err == OK {
+        return reply
+      }
+      if iters > 100 {
+        t.Fatalf("group %v never took Put(%v)", g, args.Key)
+      }
+      time.Sleep(100 * time.Millisecond)
+    }
+  }
+
+  fmt.Printf("Test: Retries are recognized under load ...\n")
+
+  ck.Put("a", "x")
+  first := PutArgs{Key: "a", Value: "y", DoHash: true, Uid: "slow", Seq: 1, Pid: "slow_1"}
+  if r := put(0, first); r.PreviousValue != "x" {
+    t.Fatalf("PutHash returned %v; wanted x", r.PreviousValue)
+  }
+  want := NextValue("x", "y")
+  for i := 0; i < 1100; i++ {
+    uid := "busy" + strconv.Itoa(i)
+    put(0, PutArgs{Key: "b", Value: "z", DoHash: true, Uid: uid, Seq: 1, Pid: uid})
+  }
+  retry := first
+  retry.Pid = "slow_1_again"
+  if r := put(0, retry); r.PreviousValue != "x" {
+    t.Fatalf("retried PutHash returned %v; wanted x", r.PreviousValue)
+  }
+  if v := ck.Get("a"); v != want {
+    t.Fatalf("retried PutHash applied twice: Get returned %v, wanted %v", v, want)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Retries are recognized after their shard moves ...\n")
+
+  keys := keysPerShard(mck.Query(-1))
+  sent := make([]PutArgs, len(keys))
+  wants := make([]string, len(keys))
+  for s, k := range keys {
+    ck.Put(k, "v")
+    uid := "mover" + strconv.Itoa(s)
+    sent[s] = PutArgs{Key: k, Value: "w", DoHash: true, Uid: uid, Seq: 1, Pid: uid}
+    if r := put(0, sent[s]); r.PreviousValue != "v" {
+      t.Fatalf("PutHash(%v) returned %v; wanted v", k, r.PreviousValue)
+    }
+    wants[s] = NextValue("v", "w")
+  }
+
+  mck.Join(gids[1], ha[1])
+  mck.Join(gids[2], ha[2])
+  c := mck.Query(-1)
+  moved := 0
+  for s, k := range keys {
+    g := 0
+    for i := range gids {
+      if gids[i] == c.Owner(k) {
+        g = i
+      }
+    }
+    if g != 0 {
+      moved++
+    }
+    retry := sent[s]
+    retry.Pid += "_again"
+    if r := put(g, retry); r.PreviousValue != "v" {
+      t.Fatalf("PutHash(%v) retried at group %v returned %v; wanted v", k, g, r.PreviousValue)
+    }
+    if v := ck.Get(k); v != wants[s] {
+      t.Fatalf("PutHash(%v) applied twice: Get returned %v, wanted %v", k, v, wants[s])
+    }
+  }
+  if moved == 0 {
+    t.Fatalf("no shard moved")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestUnlockedAgreement(t *testing.T) {
+  smh, gids, ha, sa, clean := setup("unlocked", false)
+  defer clean()
+
+  fmt.Printf("Test: A server waiting on agreement isn't locked ...\n")
+
+  mck := shardmaster.MakeClerk(smh, transport.Unix{})
+  mck.Join(gids[0], ha[0])
+  ck := MakeClerk(smh, transport.Unix{})
+  ck.Put("a", "x")
+
+  // no majority, so this Put waits on paxos forever.
+  sa[0][1].kill()
+  sa[0][2].kill()
+  go func() {
+    args := &PutArgs{Key: "a", Value: "y", Pid: strconv.Itoa(rand.Int())}
+    var reply PutReply
+    sa[0][0].Put(args, &reply)
+  }()
+  time.Sleep(200 * time.Millisecond)
+
+  locked := make(chan bool)
+  go func() {
+    sa[0][0].mu.Lock()
+    sa[0][0].mu.Unlock()
+    locked <- true
+  }()
+  select {
+  case <-locked:
+  case <-time.After(2 * time.Second):
+    t.Fatalf("server held its lock while waiting on agreement")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
 func TestLimp(t *testing.T) {
   smh, gids, ha, sa, clean := setup("limp", false)
   defer clean()
 
   fmt.Printf("Test: Reconfiguration with some dead replicas ...\n")
 
-  mck := shardmaster.MakeClerk(smh)
+  mck := shardmaster.MakeClerk(smh, transport.Unix{})
   mck.Join(gids[0], ha[0])
 
-  ck := MakeClerk(smh)
+  ck := MakeClerk(smh, transport.Unix{})
 
   ck.Put("a", "b")
   if ck.Get("a") != "b" {
@@ -288,11 +638,132 @@ func TestLimp(t *testing.T) {
 
 
 
+func TestTTL(t *testing.T) {
+  smh, gids, ha, sa, clean := setup("ttl", false)
+  defer clean()
+
+  fmt.Printf("Test: keys expire after their TTL ...\n")
+
+  mck := shardmaster.MakeClerk(smh, transport.Unix{})
+  mck.Join(gids[0], ha[0])
+
+  ck := MakeClerk(smh, transport.Unix{})
+  ck.PutWithTTL("a", "x", 500 * time.Millisecond)
+  ck.Put("b", "y")
+
+  // a Get at each replica, which brings it up to date with the log.
+  get := func(i int, key string) string {
+    args := &GetArgs{Key: key, Pid: strconv.Itoa(rand.Int())}
+    var reply GetReply
+    sa[0][i].Get(args, &reply)
+    return reply.Value
+  }
+  for i := range sa[0] {
+    if v := get(i, "a"); v != "x" {
+      t.Fatalf("replica %v: Get(a) got %v, expected x", i, v)
+    }
+  }
+
+  time.Sleep(600 * time.Millisecond)
+  for i := range sa[0] {
+    if v := get(i, "a"); v != "" {
+      t.Fatalf("replica %v: Get(a) got %v after its TTL", i, v)
+    }
+    if v := get(i, "b"); v != "y" {
+      t.Fatalf("replica %v: Get(b) got %v, expected y", i, v)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: every replica removes expired keys ...\n")
+
+  for i, kv := range sa[0] {
+    for iters := 0; ; iters++ {
+      get(i, "b")
+      kv.mu.Lock()
+      _, there := kv.data["a"]
+      kv.mu.Unlock()
+      if !there {
+        break
+      }
+      if iters > 50 {
+        t.Fatalf("replica %v never removed the expired key", i)
+      }
+      time.Sleep(100 * time.Millisecond)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: PutHash treats an expired key as missing ...\n")
+
+  // expired long ago, but not removed yet.
+  for _, kv := range sa[0] {
+    kv.mu.Lock()
+    kv.data["c"] = Value{"x", 1, 1}
+    kv.mu.Unlock()
+  }
+  if prev := ck.PutHash("c", "y"); prev != "" {
+    t.Fatalf("PutHash(c) found %v, which had expired", prev)
+  }
+  if v := get(0, "c"); v != NextValue("", "y") {
+    t.Fatalf("Get(c) got %v, expected %v", v, NextValue("", "y"))
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestContext(t *testing.T) {
+  smh, gids, ha, sa, clean := setup("ctx", false)
+  defer clean()
+
+  fmt.Printf("Test: Ctx calls report missing keys ...\n")
+
+  mck := shardmaster.MakeClerk(smh, transport.Unix{})
+  mck.Join(gids[0], ha[0])
+
+  ck := MakeClerk(smh, transport.Unix{})
+  bg := context.Background()
+  if _, err := ck.GetCtx(bg, "a"); err != ErrNotFound {
+    t.Fatalf("GetCtx of a missing key returned %v", err)
+  }
+  if err := ck.PutCtx(bg, "a", "x"); err != nil {
+    t.Fatalf("PutCtx returned %v", err)
+  }
+  if v, err := ck.GetCtx(bg, "a"); v != "x" || err != nil {
+    t.Fatalf("GetCtx returned %v, %v", v, err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Ctx calls give up at the deadline ...\n")
+
+  // no replica of the group is left to answer.
+  for _, kv := range sa[0] {
+    kv.kill()
+  }
+  ctx, cancel := context.WithTimeout(bg, 500 * time.Millisecond)
+  defer cancel()
+  t0 := time.Now()
+  if _, err := ck.GetCtx(ctx, "a"); err != context.DeadlineExceeded {
+    t.Fatalf("GetCtx with the group dead returned %v", err)
+  }
+  if err := ck.PutCtx(ctx, "a", "y"); err != context.DeadlineExceeded {
+    t.Fatalf("PutCtx after the deadline returned %v", err)
+  }
+  if d := time.Since(t0); d > 2 * time.Second {
+    t.Fatalf("Ctx calls took %v, deadline was 500ms", d)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
 func doConcurrent(t *testing.T, unreliable bool) {
   smh, gids, ha, _, clean := setup("conc"+strconv.FormatBool(unreliable), unreliable)
   defer clean()
 
-  mck := shardmaster.MakeClerk(smh)
+  mck := shardmaster.MakeClerk(smh, transport.Unix{})
   for i := 0; i < len(gids); i++ {
     mck.Join(gids[i], ha[i])
   }
@@ -304,8 +775,8 @@ func doConcurrent(t *testing.T, unreliable bool) {
     go func(me int) {
       ok := true
       defer func() { ca[me] <- ok }()
-      ck := MakeClerk(smh)
-      mymck := shardmaster.MakeClerk(smh)
+      ck := MakeClerk(smh, transport.Unix{})
+      mymck := shardmaster.MakeClerk(smh, transport.Unix{})
       key := strconv.Itoa(me)
       last := ""
       for iters := 0; iters < 3; iters++ {
@@ -0,0 +1,51 @@
+package shardkv
+
+//
+// keys that expire.
+//
+// each Op carries its proposer's clock, and the log's time is the
+// latest of those applied so far, so it's the same at every replica
+// at each point in the log. a key Put with a TTL expires at the
+// log's time when the Put is applied, plus the TTL. Gets and Puts
+// treat the key as missing once the log's time passes that; a Get
+// carries its proposer's clock, so it finds the key gone as soon
+// as that clock says so. the key stays in data until the
+// leader sees it has expired and gets an OpExpire into the log,
+// which removes every key that has expired by the log's time.
+//
+
+import "fmt"
+import "time"
+
+//
+// if we lead the group and some key has expired by our clock, get
+// an OpExpire into the log, so every replica removes the same keys
+// at the same point.
+//
+func (kv *ShardKV) expire() {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+  if !kv.px.IsLeader() {
+    return
+  }
+  now := time.Now().UnixNano()
+  for _, val := range kv.data {
+    if val.expired(now) {
+      kv.ProcessOp(Op{Op: OpExpire,
+        Pid: fmt.Sprintf("Expire_%d_%d", now, kv.me)})
+      return
+    }
+  }
+}
+
+//
+// the expiry for a key Put now with a TTL of ttl nanoseconds,
+// or 0 if ttl is 0.
+// caller must hold kv.mu.
+//
+func (kv *ShardKV) expiry(ttl int64) int64 {
+  if ttl <= 0 {
+    return 0
+  }
+  return kv.logTime + ttl
+}
@@ -0,0 +1,168 @@
+package shardmaster
+
+//
+// assigning shards to groups.
+//
+// a group's share of the shards is in proportion to its weight
+// (Config.Weights; 1 if it has none), rounded down, and the shards
+// left over go one each to groups whose exact share was rounded
+// down furthest. among groups with equal claims, such as groups of
+// equal weight, the extras go to those that already hold the most,
+// so a group keeps as many of its shards as any balanced assignment
+// would let it.
+//
+// labels add anti-affinity: for each label, such as "zone" or
+// "rack", the groups sharing a value shouldn't together get more
+// than their combined weight's share, rounded up, so losing one zone
+// or rack loses no more than its share. an extra shard goes to a
+// group whose every label value still has room, if any such group
+// has a claim to one.
+//
+// shards of groups that have gone, and any a group holds beyond its
+// share, are handed in shard order to the groups below their share,
+// in GID order.
+//
+// only sorted slices are walked, never maps, so every replica
+// computes the same assignment from the same Config.
+//
+
+import "sort"
+
+// a label and one of its values, such as zone "us-east-1a".
+type label struct {
+  key string
+  value string
+}
+
+// a group's capacity weight in cfg.
+func (cfg *Config) weight(gid int64) int {
+  if w, ok := cfg.Weights[gid]; ok && w > 0 {
+    return w
+  }
+  return 1
+}
+
+//
+// how many of cfg's shards each group in gids should end up with,
+// given that it holds count[gid] now.
+//
+func shares(cfg *Config, gids []int64, count map[int64]int) map[int64]int {
+  nshards := len(cfg.Shards)
+  total := 0
+  for _, gid := range gids {
+    total += cfg.weight(gid)
+  }
+
+  // each group's floor, and the label values' ceilings.
+  share := make(map[int64]int, len(gids))
+  frac := make(map[int64]int, len(gids)) // of nshards*weight/total, in 1/total
+  room := make(map[label]int)            // shards a label value may still get
+  left := nshards
+  for _, gid := range gids {
+    w := cfg.weight(gid)
+    share[gid] = nshards * w / total
+    frac[gid] = nshards * w % total
+    left -= share[gid]
+    for k, v := range cfg.Labels[gid] {
+      room[label{k, v}] += w
+    }
+  }
+  for lv, w := range room {
+    room[lv] = (nshards * w + total - 1) / total
+  }
+  for _, gid := range gids {
+    for k, v := range cfg.Labels[gid] {
+      room[label{k, v}] -= share[gid]
+    }
+  }
+
+  // groups with a claim to an extra shard, best claim first.
+  var order []int64
+  for _, gid := range gids {
+    if frac[gid] > 0 {
+      order = append(order, gid)
+    }
+  }
+  sort.Slice(order, func(i, j int) bool {
+    a, b := order[i], order[j]
+    if frac[a] != frac[b] {
+      return frac[a] > frac[b]
+    }
+    if count[a] != count[b] {
+      return count[a] > count[b]
+    }
+    return a < b
+  })
+
+  fits := func(gid int64) bool {
+    for k, v := range cfg.Labels[gid] {
+      if room[label{k, v}] <= 0 {
+        return false
+      }
+    }
+    return true
+  }
+  for ; left > 0; left-- {
+    pick := 0
+    for i, gid := range order {
+      if fits(gid) {
+        pick = i
+        break
+      }
+    }
+    gid := order[pick]
+    order = append(order[:pick], order[pick+1:]...)
+    share[gid]++
+    for k, v := range cfg.Labels[gid] {
+      room[label{k, v}]--
+    }
+  }
+  return share
+}
+
+//
+// reassign cfg's shards among its groups, moving as few as
+// possible. with no groups, every shard goes to group 0.
+//
+func rebalance(cfg *Config) {
+  shards, groups := cfg.Shards, cfg.Groups
+  if len(groups) == 0 {
+    for i := range shards {
+      shards[i] = 0
+    }
+    return
+  }
+
+  gids := make([]int64, 0, len(groups))
+  for gid := range groups {
+    gids = append(gids, gid)
+  }
+  sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+
+  count := make(map[int64]int)
+  for _, gid := range shards {
+    if _, ok := groups[gid]; ok {
+      count[gid]++
+    }
+  }
+  share := shares(cfg, gids, count)
+
+  // release what nobody may keep, keeping each group's
+  // lowest-numbered shards.
+  var free []int
+  kept := make(map[int64]int)
+  for i, gid := range shards {
+    if _, ok := groups[gid]; ok && kept[gid] < share[gid] {
+      kept[gid]++
+      continue
+    }
+    free = append(free, i)
+  }
+
+  for _, gid := range gids {
+    for ; kept[gid] < share[gid]; kept[gid]++ {
+      shards[free[0]] = gid
+      free = free[1:]
+    }
+  }
+}
@@ -2,119 +2,220 @@ package shardmaster
 
 // 
 // Shardmaster clerk.
-// Please don't change this file.
+//
+// each call keeps trying forever; its Ctx form gives up with
+// ctx.Err() once ctx is done. calls go first to the server that
+// last answered, and a Query follows the Leader a follower names.
 //
 
-import "net/rpc"
+import "context"
+import "errors"
+import "sync"
 import "time"
-import "fmt"
+import "transport"
+
+// what QueryCtx returns for a Config that Compact() forgot.
+var ErrCompacted = errors.New("shardmaster: config was compacted")
 
 type Clerk struct {
+  mu sync.Mutex
   servers []string // shardmaster replicas
+  pool *transport.Pool
+  leader int // index of the server to try first
 }
 
-func MakeClerk(servers []string) *Clerk {
+func MakeClerk(servers []string, t transport.Transport) *Clerk {
   ck := new(Clerk)
   ck.servers = servers
+  ck.pool = transport.NewPool(t, transport.DefaultTimeout)
   return ck
 }
 
 //
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be a pointer
-// to a reply structure.
-//
-// the return value is true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// the reply's contents are only valid if call() returned true.
-//
-// you should assume that call() will time out and return an
-// error after a while if it doesn't get a reply from the server.
-//
-// please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
+// send an RPC to each server in turn until one answers, or
+// ctx is done.
 //
-func call(srv string, rpcname string,
-          args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-    
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
+func (ck *Clerk) call(ctx context.Context, name string, args interface{}, reply interface{}) error {
+  for {
+    // try each known server, starting with the last to answer.
+    start := ck.getLeader()
+    for k := range ck.servers {
+      i := (start + k) % len(ck.servers)
+      ok := ck.pool.CallContext(ctx, ck.servers[i], name, args, reply)
+      if ok {
+        ck.setLeader(i)
+        return nil
+      }
+    }
+    select {
+    case <-time.After(100 * time.Millisecond):
+    case <-ctx.Done():
+      return ctx.Err()
+    }
   }
+}
+
+func (ck *Clerk) getLeader() int {
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+  return ck.leader
+}
 
-  fmt.Println(err)
-  return false
+func (ck *Clerk) setLeader(i int) {
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+  ck.leader = i
 }
 
 func (ck *Clerk) Query(num int) Config {
-  for {
-    // try each known server.
-    for _, srv := range ck.servers {
-      args := &QueryArgs{}
-      args.Num = num
-      var reply QueryReply
-      ok := call(srv, "ShardMaster.Query", args, &reply)
-      if ok {
-        return reply.Config
-      }
+  config, _ := ck.QueryCtx(context.Background(), num)
+  return config
+}
+
+func (ck *Clerk) QueryCtx(ctx context.Context, num int) (Config, error) {
+  args := &QueryArgs{}
+  args.Num = num
+  var reply QueryReply
+  for redirects := 0; ; redirects++ {
+    // a fresh reply each time: gob leaves fields it didn't send alone.
+    reply = QueryReply{}
+    if err := ck.call(ctx, "ShardMaster.Query", args, &reply); err != nil {
+      return Config{}, err
+    }
+    if reply.Err != ErrNotLeader {
+      break
     }
-    time.Sleep(100 * time.Millisecond)
+    i := indexOf(ck.servers, reply.Leader)
+    if i < 0 || i == ck.getLeader() || redirects >= len(ck.servers) {
+      // a leader we can't reach, or stale hints while a new one
+      // takes over; have the server answer through the log.
+      args.NoRedirect = true
+      continue
+    }
+    ck.setLeader(i)
+  }
+  if reply.Compacted {
+    return Config{}, ErrCompacted
   }
-  return Config{}
+  return reply.Config, nil
 }
 
 func (ck *Clerk) Join(gid int64, servers []string) {
-  for {
-    // try each known server.
-    for _, srv := range ck.servers {
-      args := &JoinArgs{}
-      args.GID = gid
-      args.Servers = servers
-      var reply JoinReply
-      ok := call(srv, "ShardMaster.Join", args, &reply)
-      if ok {
-        return
-      }
-    }
-    time.Sleep(100 * time.Millisecond)
-  }
+  ck.JoinCtx(context.Background(), gid, servers)
+}
+
+func (ck *Clerk) JoinCtx(ctx context.Context, gid int64, servers []string) error {
+  return ck.JoinWeightedCtx(ctx, gid, servers, 1, nil)
+}
+
+//
+// like Join, but the group gets shards in proportion to weight,
+// and labels such as "zone" let the shardmaster spread shards
+// across zones.
+//
+func (ck *Clerk) JoinWeighted(gid int64, servers []string, weight int, labels map[string]string) {
+  ck.JoinWeightedCtx(context.Background(), gid, servers, weight, labels)
+}
+
+func (ck *Clerk) JoinWeightedCtx(ctx context.Context, gid int64, servers []string,
+    weight int, labels map[string]string) error {
+  args := &JoinArgs{}
+  args.GID = gid
+  args.Servers = servers
+  args.Weight = weight
+  args.Labels = labels
+  var reply JoinReply
+  return ck.call(ctx, "ShardMaster.Join", args, &reply)
 }
 
 func (ck *Clerk) Leave(gid int64) {
-  for {
-    // try each known server.
-    for _, srv := range ck.servers {
-      args := &LeaveArgs{}
-      args.GID = gid
-      var reply LeaveReply
-      ok := call(srv, "ShardMaster.Leave", args, &reply)
-      if ok {
-        return
+  ck.LeaveCtx(context.Background(), gid)
+}
+
+func (ck *Clerk) LeaveCtx(ctx context.Context, gid int64) error {
+  args := &LeaveArgs{}
+  args.GID = gid
+  var reply LeaveReply
+  return ck.call(ctx, "ShardMaster.Leave", args, &reply)
+}
+
+func (ck *Clerk) Move(shard int, gid int64) {
+  ck.MoveCtx(context.Background(), shard, gid)
+}
+
+func (ck *Clerk) MoveCtx(ctx context.Context, shard int, gid int64) error {
+  args := &MoveArgs{}
+  args.Shard = shard
+  args.GID = gid
+  var reply MoveReply
+  return ck.call(ctx, "ShardMaster.Move", args, &reply)
+}
+
+func (ck *Clerk) Split(shard int) {
+  ck.SplitCtx(context.Background(), shard)
+}
+
+func (ck *Clerk) SplitCtx(ctx context.Context, shard int) error {
+  args := &SplitArgs{}
+  args.Shard = shard
+  var reply SplitReply
+  return ck.call(ctx, "ShardMaster.Split", args, &reply)
+}
+
+//
+// forget the Configs before num; the latest is always kept.
+//
+func (ck *Clerk) Compact(num int) {
+  ck.CompactCtx(context.Background(), num)
+}
+
+func (ck *Clerk) CompactCtx(ctx context.Context, num int) error {
+  args := &CompactArgs{}
+  args.Num = num
+  var reply CompactReply
+  return ck.call(ctx, "ShardMaster.Compact", args, &reply)
+}
+
+//
+// wait for Configs after # from, and return them, oldest first;
+// perhaps not all of them, if there are many. asks each server in
+// turn, so one that has fallen behind doesn't hold the watcher up.
+//
+func (ck *Clerk) WatchConfigs(from int) []Config {
+  configs, _ := ck.WatchConfigsCtx(context.Background(), from)
+  return configs
+}
+
+func (ck *Clerk) WatchConfigsCtx(ctx context.Context, from int) ([]Config, error) {
+  args := &WatchConfigsArgs{}
+  args.From = from
+  for i := 0; ; i++ {
+    var reply WatchConfigsReply
+    ok := ck.pool.CallContext(ctx, ck.servers[i % len(ck.servers)], "ShardMaster.WatchConfigs", args, &reply)
+    if ok && reply.Compacted {
+      return nil, ErrCompacted
+    }
+    if ok && len(reply.Configs) > 0 {
+      return reply.Configs, nil
+    }
+    if ctx.Err() != nil {
+      return nil, ctx.Err()
+    }
+    if !ok && (i + 1) % len(ck.servers) == 0 {
+      select {
+      case <-time.After(100 * time.Millisecond):
+      case <-ctx.Done():
+        return nil, ctx.Err()
       }
     }
-    time.Sleep(100 * time.Millisecond)
   }
 }
 
-func (ck *Clerk) Move(shard int, gid int64) {
-  for {
-    // try each known server.
-    for _, srv := range ck.servers {
-      args := &MoveArgs{}
-      args.Shard = shard
-      args.GID = gid
-      var reply LeaveReply
-      ok := call(srv, "ShardMaster.Move", args, &reply)
-      if ok {
-        return
-      }
+func indexOf(servers []string, srv string) int {
+  for i, s := range servers {
+    if s == srv {
+      return i
     }
-    time.Sleep(100 * time.Millisecond)
   }
+  return -1
 }
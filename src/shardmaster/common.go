@@ -5,32 +5,121 @@ package shardmaster
 //
 // RPC interface:
 // Join(gid, servers) -- replica group gid is joining, give it some shards.
+//   JoinWeighted() also gives its capacity weight and labels; see
+//   balance.go.
 // Leave(gid) -- replica group gid is retiring, hand off all its shards.
 // Move(shard, gid) -- hand off one shard from current owner to gid.
+// Split(shard) -- cut a shard in two; see split.go.
 // Query(num) -> fetch Config # num, or latest config if num==-1.
+// Compact(num) -- forget the Configs before num; see history.go.
+// WatchConfigs(num) -> the Configs after # num, once there are any;
+//   see watch.go.
 //
 // A Config (configuration) describes a set of replica groups, and the
 // replica group responsible for each shard. Configs are numbered. Config
 // #0 is the initial configuration, with no groups and all shards
 // assigned to group 0 (the invalid group).
 //
+// A key belongs to the shard whose range of KeyHash() values holds
+// it. Config #0 has NShards shards, or as many as StartServerShards()
+// was given, with equal ranges; Split() adds more.
+//
 // A GID is a replica group ID. GIDs must be uniqe and > 0.
 // Once a GID joins, and leaves, it should never join again.
 //
-// Please don't change this file.
-//
 
+import "hash/fnv"
+
+// how many shards a cluster starts with, unless it's told otherwise.
 const NShards = 10
 
 type Config struct {
   Num int // config number
-  Shards [NShards]int64 // gid
+  Shards []int64 // gid, one per shard
+  Starts []uint32 // shard i holds hashes from Starts[i] to the next start up
   Groups map[int64][]string // gid -> servers[]
+  Weights map[int64]int // gid -> capacity weight, if not 1
+  Labels map[int64]map[string]string // gid -> labels, such as "zone"
+}
+
+//
+// where a key falls on the ring of shard ranges. FNV-1a, then
+// murmur3's finalizer, since FNV alone leaves keys that differ only
+// at the end close together in the high bits.
+//
+func KeyHash(key string) uint32 {
+  f := fnv.New32a()
+  f.Write([]byte(key))
+  h := f.Sum32()
+  h ^= h >> 16
+  h *= 0x85ebca6b
+  h ^= h >> 13
+  h *= 0xc2b2ae35
+  h ^= h >> 16
+  return h
+}
+
+//
+// the shard holding hash h, or -1 if c has no shards, as the zero
+// Config doesn't.
+//
+func (c *Config) ShardOf(h uint32) int {
+  shard := -1
+  for i, start := range c.Starts {
+    if start <= h && (shard < 0 || start > c.Starts[shard]) {
+      shard = i
+    }
+  }
+  return shard
+}
+
+func (c *Config) Shard(key string) int {
+  return c.ShardOf(KeyHash(key))
+}
+
+// the group serving key, or 0 if none is.
+func (c *Config) Owner(key string) int64 {
+  shard := c.Shard(key)
+  if shard < 0 {
+    return 0
+  }
+  return c.Shards[shard]
+}
+
+// the hashes shard holds: lo <= h < hi.
+func (c *Config) Bounds(shard int) (uint64, uint64) {
+  lo, hi := uint64(c.Starts[shard]), uint64(1) << 32
+  for _, start := range c.Starts {
+    if uint64(start) > lo && uint64(start) < hi {
+      hi = uint64(start)
+    }
+  }
+  return lo, hi
+}
+
+// a copy of c that shares nothing with it.
+func (c *Config) clone() Config {
+  n := Config{Num: c.Num, Groups: make(map[int64][]string),
+    Weights: make(map[int64]int), Labels: make(map[int64]map[string]string)}
+  n.Shards = append([]int64{}, c.Shards...)
+  n.Starts = append([]uint32{}, c.Starts...)
+  for gid, servers := range c.Groups {
+    n.Groups[gid] = servers
+  }
+  for gid, w := range c.Weights {
+    n.Weights[gid] = w
+  }
+  for gid, labels := range c.Labels {
+    n.Labels[gid] = labels
+  }
+  return n
 }
 
 type JoinArgs struct {
   GID int64       // unique replica group ID
   Servers []string // group server ports
+  Weight int // capacity; 0 means 1
+  Labels map[string]string // such as "zone" and "rack"; may be nil
 }
 
 type JoinReply struct {
@@ -51,12 +140,48 @@ type MoveArgs struct {
 type MoveReply struct {
 }
 
+type SplitArgs struct {
+  Shard int
+}
+
+type SplitReply struct {
+}
+
 type QueryArgs struct {
   Num int // desired config number
+  NoRedirect bool // answer even if not leading, through the log if need be
 }
 
+const (
+  OK = "OK"
+  // the server isn't leading, and wouldn't answer without a round
+  // of agreement; try the one in the reply's Leader, or ask again
+  // with NoRedirect.
+  ErrNotLeader = "ErrNotLeader"
+)
+type Err string
+
 type QueryReply struct {
+  Err Err
+  Leader string // the server the replier thinks leads, or ""
   Config Config
+  Compacted bool // Config # num was forgotten by Compact()
+}
+
+type WatchConfigsArgs struct {
+  From int // the latest Config the watcher has
+}
+
+type WatchConfigsReply struct {
+  Configs []Config // oldest first; empty if none came in time
+  Compacted bool // some Config after # From was forgotten
+}
+
+type CompactArgs struct {
+  Num int // the oldest Config to keep
+}
+
+type CompactReply struct {
 }
 
 //func nrand() int64 {
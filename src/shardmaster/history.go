@@ -0,0 +1,75 @@
+package shardmaster
+
+//
+// serving Query without the log, and forgetting old configs.
+//
+// a config never changes once it's made, so a Query for one this
+// server already has is answered from sm.configs. a Query for the
+// latest config is answered locally too if paxos holds a leader
+// lease (see paxos/lease.go): once this server has applied every
+// instance the lease vouches for, no later config can exist yet.
+// a follower that knows who leads replies ErrNotLeader, and the
+// clerk asks the leader instead; otherwise the Query goes through
+// the log as before.
+//
+// Compact(num) drops every config before num, on every server at
+// the same point in the log; the latest config is always kept.
+// a Query for a dropped config gets Compacted, so only compact
+// configs that no shardkv group still needs.
+//
+
+//
+// config num, or the latest if num is -1 or past it. returns false
+// if num was compacted away.
+// caller must hold sm.mu.
+//
+func (sm *ShardMaster) config(num int) (Config, bool) {
+  base := sm.configs[0].Num
+  if num < 0 || num - base >= len(sm.configs) {
+    return sm.configs[len(sm.configs)-1], true
+  }
+  if num < base {
+    return Config{}, false
+  }
+  return sm.configs[num - base], true
+}
+
+//
+// whether config num is one we have, and so can't change.
+// caller must hold sm.mu.
+//
+func (sm *ShardMaster) settled(num int) bool {
+  return num >= 0 && num <= sm.configs[len(sm.configs)-1].Num
+}
+
+//
+// bring sm up to date for a read of the latest config, without
+// a log entry. returns false if we don't hold a leader lease or
+// haven't heard of every instance it covers.
+// caller must not hold sm.mu: LeaseRead() may have to renew the
+// lease, which takes a round of RPCs.
+//
+func (sm *ShardMaster) leaseRead() bool {
+  upTo, ok := sm.px.LeaseRead()
+  if !ok {
+    return false
+  }
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+  sm.catchUp()
+  return sm.seqNum >= upTo
+}
+
+//
+// drop the configs before num, keeping the latest.
+// caller must hold sm.mu.
+//
+func (sm *ShardMaster) compact(num int) {
+  base := sm.configs[0].Num
+  drop := min(num - base, len(sm.configs) - 1)
+  if drop <= 0 {
+    return
+  }
+  // copy, so the dropped configs can be garbage collected.
+  sm.configs = append([]Config(nil), sm.configs[drop:]...)
+}
@@ -1,6 +1,7 @@
 package shardmaster
 
 import (
+  "context"
   "net"
   "strconv"
   "time"
@@ -10,10 +11,8 @@ import "net/rpc"
 import "log"
 import "paxos"
 import "sync"
-import "os"
-import "syscall"
 import "encoding/gob"
-import "math/rand"
+import "transport"
 
 type ShardMaster struct {
   mu sync.Mutex
@@ -37,6 +36,9 @@ type Op struct {
   Servers []string
   Shard int
   Pid string
+  Weight int // JoinOp only
+  Labels map[string]string // JoinOp only
+  Num int // CompactOp only
 }
 
 // added by Shusen Xu
@@ -45,23 +47,19 @@ const (
   JoinOp = "Join"
   LeaveOp = "Leave"
   MoveOp = "Move"
+  SplitOp = "Split"
   QueryOp = "Query"
+  CompactOp = "Compact"
 )
 
 
 // helper functions added by Shusen Xu
 func (sm *ShardMaster)WaitAgreement(seqNum int) Op{
-  to := 10 * time.Millisecond
-  for {
-    decided, val := sm.px.Status(seqNum)
-    if decided{
-      return val.(Op)
-    }
-    time.Sleep(to)
-    if to < 10 * time.Second{
-      to *= 2
-    }
-  }
+  // an error means paxos was killed; the empty Op is skipped,
+  // like a paxos.Reconfig.
+  val, _ := sm.px.Wait(seqNum, context.Background())
+  op, _ := val.(Op)
+  return op
 }
 
 // hints:
@@ -75,6 +73,12 @@ func (sm *ShardMaster) ProcessHelper(op Op){
     // re-duplicate, if a config has been added, does not process
     if _, exist := cfg.Groups[op.GID]; !exist {
       cfg.Groups[op.GID] = op.Servers
+      if op.Weight > 1 {
+        cfg.Weights[op.GID] = op.Weight
+      }
+      if len(op.Labels) > 0 {
+        cfg.Labels[op.GID] = op.Labels
+      }
       sm.configs = append(sm.configs, *cfg)
       sm.LoadBalance()
     }
@@ -88,22 +92,33 @@ func (sm *ShardMaster) ProcessHelper(op Op){
       }
     }
     delete(cfg.Groups, op.GID)
+    delete(cfg.Weights, op.GID)
+    delete(cfg.Labels, op.GID)
     sm.configs = append(sm.configs, *cfg)
     sm.LoadBalance()
   case MoveOp:
     cfg := sm.NewConfig()
-    cfg.Shards[op.Shard] = op.GID
+    if op.Shard >= 0 && op.Shard < len(cfg.Shards) {
+      cfg.Shards[op.Shard] = op.GID
+    }
     sm.configs = append(sm.configs, *cfg)
+  case SplitOp:
+    cfg := sm.NewConfig()
+    if split(cfg, op.Shard) {
+      sm.configs = append(sm.configs, *cfg)
+    }
+  case CompactOp:
+    sm.compact(op.Num)
   }
 
 }
 
 func (sm *ShardMaster) ProcessOp(op Op){
   var tmpOp Op
-  for{
+  for !sm.dead {
     decided, val := sm.px.Status(sm.seqNum+1)
     if decided{
-      tmpOp = val.(Op)
+      tmpOp, _ = val.(Op)
     }else{
       sm.px.Start(sm.seqNum+1, op)
       tmpOp = sm.WaitAgreement(sm.seqNum+1)
@@ -123,87 +138,15 @@ func (sm *ShardMaster) CreatePid() string {
 }
 
 func (sm *ShardMaster) NewConfig() *Config {
-  newCfg := Config{Num :len(sm.configs), Groups: make(map[int64][]string)}
-  if len(sm.configs)> 0{
-    oldCfg := sm.configs[len(sm.configs)-1]
-    // assign shards
-    for key, value := range oldCfg.Shards{
-      newCfg.Shards[key] = value
-    }
-    // assign groups
-    for gid, server := range oldCfg.Groups{
-      newCfg.Groups[gid] = server
-    }
-  }
+  newCfg := sm.configs[len(sm.configs)-1].clone()
+  newCfg.Num++
   return &newCfg
 }
 
 
 func (sm *ShardMaster) LoadBalance() {
-  // get shards and gid count info
   cfg := &sm.configs[len(sm.configs)-1]
-  counter := make(map[int64]int)
-  unassign := 0
-  for gid, _ := range cfg.Groups {
-    counter[gid] = 0
-  }
-  for _, gid := range cfg.Shards {
-    if gid <= 0 {
-      unassign++
-      continue
-    }
-    count, _ := counter[gid]
-    counter[gid] = count + 1
-  }
-  avgNum := NShards / len(cfg.Groups)
-  reminder := NShards % len(cfg.Groups)
-
-
-  if unassign == 0 {
-    // join new group, not the initialized state
-    assignNum := make(map[int64]int)
-    targetGid := int64(0)
-    for gid, count := range counter {
-      if count > avgNum {
-        if reminder > 0 {
-          count--
-          reminder--
-        }
-        if count == avgNum {
-          continue
-        }
-        assignNum[gid] = count - avgNum
-      } else if count == 0 {
-        targetGid = gid
-      }
-    }
-
-    // evenly assign
-    for idx, gid := range cfg.Shards {
-      if count, exist := assignNum[gid]; exist && count > 0 {
-        assignNum[gid] = count - 1
-        cfg.Shards[idx] = targetGid
-      }
-    }
-  } else {
-    // leave or the initialized state
-    for gid, count := range counter {
-      if count <= avgNum {
-        if reminder > 0 {
-         count--
-         reminder--
-        }
-        if avgNum == count {
-          continue
-        }
-        for i:=0; i < NShards && 0 < avgNum-count; i++ {
-          if cfg.Shards[i] <= 0 {
-            cfg.Shards[i] = gid
-          }
-        }
-      }
-    }
-  }
+  rebalance(cfg)
 }
 // the above helper functions added by Shusen Xu
 
@@ -217,7 +160,8 @@ func (sm *ShardMaster) Join(args *JoinArgs, reply *JoinReply) error {
   // added by Shusen Xu
   sm.mu.Lock()
   defer sm.mu.Unlock()
-  sm.ProcessOp(Op{"Join", args.GID, args.Servers, 0, sm.CreatePid()})
+  sm.ProcessOp(Op{Op: JoinOp, GID: args.GID, Servers: args.Servers,
+    Pid: sm.CreatePid(), Weight: args.Weight, Labels: args.Labels})
   return nil
 }
 
@@ -231,7 +175,7 @@ func (sm *ShardMaster) Leave(args *LeaveArgs, reply *LeaveReply) error {
   // added by Shusen Xu
   sm.mu.Lock()
   defer sm.mu.Unlock()
-  sm.ProcessOp(Op{"Leave", args.GID, nil, 0, sm.CreatePid()})
+  sm.ProcessOp(Op{Op: LeaveOp, GID: args.GID, Pid: sm.CreatePid()})
   return nil
 }
 
@@ -241,25 +185,54 @@ func (sm *ShardMaster) Move(args *MoveArgs, reply *MoveReply) error {
   // added by Shusen Xu
   sm.mu.Lock()
   defer sm.mu.Unlock()
-  sm.ProcessOp(Op{"Move", args.GID, nil, args.Shard, sm.CreatePid()})
+  sm.ProcessOp(Op{Op: MoveOp, GID: args.GID, Shard: args.Shard, Pid: sm.CreatePid()})
+  return nil
+}
+
+
+// cut a shard in two, leaving both halves with its group.
+func (sm *ShardMaster) Split(args *SplitArgs, reply *SplitReply) error {
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+  sm.ProcessOp(Op{Op: SplitOp, Shard: args.Shard, Pid: sm.CreatePid()})
   return nil
 }
 
 
 // If the number is -1 or bigger than the biggest known configuration number,
 // the shardmaster should reply with the latest configuration.
+// see history.go for when that takes the log.
 func (sm *ShardMaster) Query(args *QueryArgs, reply *QueryReply) error {
   // Your code here.
   // added by Shusen Xu
+  sm.mu.Lock()
+  settled := sm.settled(args.Num)
+  sm.mu.Unlock()
+  fresh := settled || sm.leaseRead()
+  if leader := sm.px.Leader(); !fresh && !args.NoRedirect && leader != "" && !sm.px.IsLeader() {
+    // the leader can answer without a log entry; we can't.
+    reply.Err = ErrNotLeader
+    reply.Leader = leader
+    return nil
+  }
+
   sm.mu.Lock()
   defer sm.mu.Unlock()
-  sm.ProcessOp(Op{"Query", 0, nil, 0, sm.CreatePid()})
-  if args.Num == -1 || args.Num >= len(sm.configs) {
-    // reply with latest configurations
-    reply.Config = sm.configs[len(sm.configs)-1]
-  } else {
-    reply.Config = sm.configs[args.Num]
+  if !fresh {
+    sm.ProcessOp(Op{Op: QueryOp, Pid: sm.CreatePid()})
   }
+  cfg, ok := sm.config(args.Num)
+  reply.Err = OK
+  reply.Config = cfg
+  reply.Compacted = !ok
+  return nil
+}
+
+// forget the configs before args.Num.
+func (sm *ShardMaster) Compact(args *CompactArgs, reply *CompactReply) error {
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+  sm.ProcessOp(Op{Op: CompactOp, Num: args.Num, Pid: sm.CreatePid()})
   return nil
 }
 
@@ -277,7 +250,15 @@ func (sm *ShardMaster) Kill() {
 // form the fault-tolerant shardmaster service.
 // me is the index of the current server in servers[].
 //
-func StartServer(servers []string, me int) *ShardMaster {
+func StartServer(servers []string, me int, t transport.Transport) *ShardMaster {
+  return StartServerShards(servers, me, t, NShards)
+}
+
+//
+// like StartServer, but Config #0 has nshards shards. every
+// server of the service must be given the same nshards.
+//
+func StartServerShards(servers []string, me int, t transport.Transport, nshards int) *ShardMaster {
   gob.Register(Op{})
 
   sm := new(ShardMaster)
@@ -285,50 +266,29 @@ func StartServer(servers []string, me int) *ShardMaster {
 
   sm.configs = make([]Config, 1)
   sm.configs[0].Groups = map[int64][]string{}
+  sm.configs[0].Shards, sm.configs[0].Starts = evenRanges(nshards)
 
   rpcs := rpc.NewServer()
   rpcs.Register(sm)
 
-  sm.px = paxos.Make(servers, me, rpcs)
+  sm.px = paxos.Make(servers, me, rpcs, t)
 
-  os.Remove(servers[me])
-  l, e := net.Listen("unix", servers[me]);
+  l, e := t.Listen(servers[me]);
   if e != nil {
     log.Fatal("listen error: ", e);
   }
   sm.l = l
 
-  // please do not change any of the following code,
-  // or do anything to subvert it.
-
-  go func() {
-    for sm.dead == false {
-      conn, err := sm.l.Accept()
-      if err == nil && sm.dead == false {
-        if sm.unreliable && (rand.Int63() % 1000) < 100 {
-          // discard the request.
-          conn.Close()
-        } else if sm.unreliable && (rand.Int63() % 1000) < 200 {
-          // process the request but force discard of reply.
-          c1 := conn.(*net.UnixConn)
-          f, _ := c1.File()
-          err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-          if err != nil {
-            fmt.Printf("shutdown: %v\n", err)
-          }
-          go rpcs.ServeConn(conn)
-        } else {
-          go rpcs.ServeConn(conn)
-        }
-      } else if err == nil {
-        conn.Close()
-      }
-      if err != nil && sm.dead == false {
-        fmt.Printf("ShardMaster(%v) accept: %v\n", me, err.Error())
-        sm.Kill()
-      }
-    }
-  }()
+  // transport.Serve() is the accept loop, and simulates the
+  // unreliable network the tests depend on; please do not
+  // subvert it.
+
+  go transport.Serve(sm.l, rpcs, transport.Hooks{
+    Name:       fmt.Sprintf("ShardMaster(%v)", me),
+    Dead:       func() bool { return sm.dead },
+    Unreliable: func() bool { return sm.unreliable },
+    Failed:     sm.Kill,
+  })
 
   return sm
 }
@@ -0,0 +1,45 @@
+package shardmaster
+
+//
+// shard ranges.
+//
+// KeyHash() values run round a ring of 1<<32, which the shards of
+// a Config cut into ranges: shard i starts at Starts[i] and runs up
+// to the next start. Config #0 cuts the ring evenly.
+//
+// Split(shard) cuts a shard's range in half. the lower half keeps
+// the shard's number and the upper half becomes a new shard, the
+// last, so no other shard is renumbered. the split is offline:
+// both halves stay with the shard's group, which already holds
+// their keys, so no data moves. the next Join or Leave spreads the
+// extra shard around like any other.
+//
+
+//
+// nshards shards with equal ranges, all in group 0.
+//
+func evenRanges(nshards int) ([]int64, []uint32) {
+  shards := make([]int64, nshards)
+  starts := make([]uint32, nshards)
+  for i := range starts {
+    starts[i] = uint32((uint64(1) << 32) * uint64(i) / uint64(nshards))
+  }
+  return shards, starts
+}
+
+//
+// cut shard in two in cfg. returns false if there's no such
+// shard or its range is too narrow to cut.
+//
+func split(cfg *Config, shard int) bool {
+  if shard < 0 || shard >= len(cfg.Shards) {
+    return false
+  }
+  lo, hi := cfg.Bounds(shard)
+  if hi - lo < 2 {
+    return false
+  }
+  cfg.Shards = append(cfg.Shards, cfg.Shards[shard])
+  cfg.Starts = append(cfg.Starts, uint32(lo + (hi - lo) / 2))
+  return true
+}
@@ -4,9 +4,12 @@ import "testing"
 import "runtime"
 import "strconv"
 import "os"
-// import "time"
+import "context"
+import "time"
 import "fmt"
+import "transport"
 import "math/rand"
+import "reflect"
 
 func port(tag string, host int) string {
   s := "/var/tmp/824-"
@@ -87,13 +90,13 @@ func TestBasic(t *testing.T) {
     kvh[i] = port("basic", i)
   }
   for i := 0; i < nservers; i++ {
-    sma[i] = StartServer(kvh, i)
+    sma[i] = StartServer(kvh, i, transport.Unix{})
   }
 
-  ck := MakeClerk(kvh)
+  ck := MakeClerk(kvh, transport.Unix{})
   var cka [nservers]*Clerk
   for i := 0; i < nservers; i++ {
-    cka[i] = MakeClerk([]string{kvh[i]})
+    cka[i] = MakeClerk([]string{kvh[i]}, transport.Unix{})
   }
 
   fmt.Printf("Test: Basic leave/join ...\n")
@@ -145,7 +148,7 @@ func TestBasic(t *testing.T) {
    if c.Num != cfa[i].Num {
      t.Fatalf("historical Num wrong")
    }
-   if c.Shards != cfa[i].Shards {
+   if !reflect.DeepEqual(c.Shards, cfa[i].Shards) {
      t.Fatalf("historical Shards wrong")
    }
    if len(c.Groups) != len(cfa[i].Groups) {
@@ -308,17 +311,17 @@ func TestUnreliable(t *testing.T) {
     kvh[i] = port("unrel", i)
   }
   for i := 0; i < nservers; i++ {
-    sma[i] = StartServer(kvh, i)
+    sma[i] = StartServer(kvh, i, transport.Unix{})
     // don't turn on unreliable because the assignment
     // doesn't require the shardmaster to detect duplicate
     // client requests.
     // sma[i].unreliable = true
   }
 
-  ck := MakeClerk(kvh)
+  ck := MakeClerk(kvh, transport.Unix{})
   var cka [nservers]*Clerk
   for i := 0; i < nservers; i++ {
-    cka[i] = MakeClerk([]string{kvh[i]})
+    cka[i] = MakeClerk([]string{kvh[i]}, transport.Unix{})
   }
 
   fmt.Printf("Test: Concurrent leave/join, failure ...\n")
@@ -359,10 +362,10 @@ func TestFreshQuery(t *testing.T) {
     kvh[i] = port("fresh", i)
   }
   for i := 0; i < nservers; i++ {
-    sma[i] = StartServer(kvh, i)
+    sma[i] = StartServer(kvh, i, transport.Unix{})
   }
 
-  ck1 := MakeClerk([]string{kvh[1]})
+  ck1 := MakeClerk([]string{kvh[1]}, transport.Unix{})
 
   fmt.Printf("Test: Query() returns latest configuration ...\n")
 
@@ -370,7 +373,7 @@ func TestFreshQuery(t *testing.T) {
   if os.Rename(kvh[0], portx) != nil {
     t.Fatalf("os.Rename() failed")
   }
-  ck0 := MakeClerk([]string{portx})
+  ck0 := MakeClerk([]string{portx}, transport.Unix{})
 
   ck1.Join(1001, []string{"a", "b", "c"})
   c := ck0.Query(-1)
@@ -382,3 +385,674 @@ func TestFreshQuery(t *testing.T) {
   fmt.Printf("  ... Passed\n")
   os.Remove(portx)
 }
+
+func TestContext(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var sma []*ShardMaster = make([]*ShardMaster, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(sma)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("ctx", i)
+  }
+  for i := 0; i < nservers; i++ {
+    sma[i] = StartServer(kvh, i, transport.Unix{})
+  }
+  ck := MakeClerk(kvh, transport.Unix{})
+
+  fmt.Printf("Test: Ctx calls give up at the deadline ...\n")
+
+  if err := ck.JoinCtx(context.Background(), 1001, []string{"a"}); err != nil {
+    t.Fatalf("JoinCtx returned %v", err)
+  }
+  c, err := ck.QueryCtx(context.Background(), -1)
+  if _, ok := c.Groups[1001]; !ok || err != nil {
+    t.Fatalf("QueryCtx returned %v, %v", c, err)
+  }
+
+  // a lone server can't get anything agreed on.
+  sma[1].Kill()
+  sma[2].Kill()
+  ck0 := MakeClerk(kvh[:1], transport.Unix{})
+  ctx, cancel := context.WithTimeout(context.Background(), 500 * time.Millisecond)
+  defer cancel()
+  t0 := time.Now()
+  if err := ck0.JoinCtx(ctx, 1002, []string{"b"}); err != context.DeadlineExceeded {
+    t.Fatalf("JoinCtx without a majority returned %v", err)
+  }
+  if _, err := ck0.QueryCtx(ctx, -1); err != context.DeadlineExceeded {
+    t.Fatalf("QueryCtx after the deadline returned %v", err)
+  }
+  if d := time.Since(t0); d > 2 * time.Second {
+    t.Fatalf("Ctx calls took %v, deadline was 500ms", d)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// the fewest shard moves that can take shards to a balanced
+// assignment over groups: each group can keep at most its share,
+// and only len(shards)%len(groups) groups get a share above the floor.
+//
+func fewestMoves(shards []int64, groups map[int64][]string) int {
+  if len(groups) == 0 {
+    n := 0
+    for _, g := range shards {
+      if g != 0 {
+        n++
+      }
+    }
+    return n
+  }
+  counts := map[int64]int{}
+  for _, g := range shards {
+    if _, ok := groups[g]; ok {
+      counts[g]++
+    }
+  }
+  avg := len(shards) / len(groups)
+  extra := len(shards) % len(groups)
+  keep := 0
+  for _, c := range counts {
+    if c > avg && extra > 0 {
+      keep += avg + 1
+      extra--
+    } else if c > avg {
+      keep += avg
+    } else {
+      keep += c
+    }
+  }
+  return len(shards) - keep
+}
+
+func TestRebalance(t *testing.T) {
+  fmt.Printf("Test: Rebalance invariants over random Join/Leave ...\n")
+
+  seed := time.Now().UnixNano()
+  r := rand.New(rand.NewSource(seed))
+
+  for trial := 0; trial < 200; trial++ {
+    shards := make([]int64, 1 + r.Intn(2 * NShards))
+    groups := map[int64][]string{}
+    nextGid := int64(1)
+    for step := 0; step < 30; step++ {
+      switch {
+      case len(groups) > 0 && r.Intn(3) == 0:
+        // leave a random group.
+        gids := []int64{}
+        for g := range groups {
+          gids = append(gids, g)
+        }
+        g := gids[r.Intn(len(gids))]
+        delete(groups, g)
+      case len(groups) > 0 && r.Intn(4) == 0:
+        // a Move, to start the next step from an unbalanced
+        // assignment.
+        for g := range groups {
+          shards[r.Intn(len(shards))] = g
+          break
+        }
+        continue
+      default:
+        groups[nextGid] = []string{"x"}
+        nextGid++
+      }
+
+      before := append([]int64{}, shards...)
+      want := fewestMoves(before, groups)
+      rebalance(&Config{Shards: shards, Groups: groups})
+
+      // the same result from a Groups map built in another order,
+      // as on another replica.
+      other := map[int64][]string{}
+      for g := nextGid; g > 0; g-- {
+        if s, ok := groups[g]; ok {
+          other[g] = s
+        }
+      }
+      again := append([]int64{}, before...)
+      rebalance(&Config{Shards: again, Groups: other})
+      if !reflect.DeepEqual(again, shards) {
+        t.Fatalf("seed %v: rebalance not deterministic: %v vs %v", seed, shards, again)
+      }
+
+      counts := map[int64]int{}
+      for s, g := range shards {
+        if _, ok := groups[g]; !ok && (len(groups) > 0 || g != 0) {
+          t.Fatalf("seed %v: shard %v -> invalid group %v", seed, s, g)
+        }
+        counts[g]++
+      }
+      min, max := len(shards), 0
+      for g := range groups {
+        if counts[g] < min {
+          min = counts[g]
+        }
+        if counts[g] > max {
+          max = counts[g]
+        }
+      }
+      if len(groups) > 0 && max > min + 1 {
+        t.Fatalf("seed %v: max %v too much larger than min %v: %v", seed, max, min, shards)
+      }
+
+      moved := 0
+      for s := range shards {
+        if shards[s] != before[s] {
+          moved++
+        }
+      }
+      if moved != want {
+        t.Fatalf("seed %v: moved %v shards from %v to %v; %v would do",
+          seed, moved, before, shards, want)
+      }
+
+      // balancing a balanced assignment moves nothing.
+      again = append([]int64{}, shards...)
+      rebalance(&Config{Shards: again, Groups: groups})
+      if !reflect.DeepEqual(again, shards) {
+        t.Fatalf("seed %v: rebalance moved shards of a balanced assignment", seed)
+      }
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Replicas agree on every Config ...\n")
+
+  npaxos := 3
+  var sma []*ShardMaster = make([]*ShardMaster, npaxos)
+  var kvh []string = make([]string, npaxos)
+  for i := 0; i < npaxos; i++ {
+    kvh[i] = port("rebalance", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    sma[i] = StartServer(kvh, i, transport.Unix{})
+  }
+  defer cleanup(sma)
+
+  ck := MakeClerk(kvh, transport.Unix{})
+  for i := int64(1); i <= 12; i++ {
+    ck.Join(i, []string{"x"})
+    if i % 3 == 0 {
+      ck.Leave(i - 1)
+    }
+  }
+  ck.Leave(1)
+  latest := ck.Query(-1)
+  check(t, []int64{3, 4, 6, 7, 9, 10, 12}, ck)
+  for i := 0; i < npaxos; i++ {
+    cki := MakeClerk([]string{kvh[i]}, transport.Unix{})
+    for n := 0; n <= latest.Num; n++ {
+      a, b := ck.Query(n), cki.Query(n)
+      if !reflect.DeepEqual(a.Shards, b.Shards) {
+        t.Fatalf("server %v has config %v as %v, not %v", i, n, b.Shards, a.Shards)
+      }
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSplit(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  npaxos := 3
+  var sma []*ShardMaster = make([]*ShardMaster, npaxos)
+  var kvh []string = make([]string, npaxos)
+  for i := 0; i < npaxos; i++ {
+    kvh[i] = port("split", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    sma[i] = StartServerShards(kvh, i, transport.Unix{}, 7)
+  }
+  defer cleanup(sma)
+
+  ck := MakeClerk(kvh, transport.Unix{})
+
+  fmt.Printf("Test: Shard count set at start ...\n")
+
+  c0 := ck.Query(0)
+  if len(c0.Shards) != 7 || len(c0.Starts) != 7 {
+    t.Fatalf("Config 0 has %v shards; wanted 7", len(c0.Shards))
+  }
+  for i := 0; i < 7; i++ {
+    lo, hi := c0.Bounds(i)
+    if lo != uint64(i) * (1 << 32) / 7 || hi != uint64(i + 1) * (1 << 32) / 7 {
+      t.Fatalf("shard %v holds [%v, %v); ranges should be even", i, lo, hi)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Keys with a common prefix spread evenly ...\n")
+
+  nkeys := 7000
+  counts := make([]int, 7)
+  for i := 0; i < nkeys; i++ {
+    counts[c0.Shard("user" + strconv.Itoa(i))]++
+  }
+  for s, n := range counts {
+    if n < nkeys / 7 * 8 / 10 || n > nkeys / 7 * 12 / 10 {
+      t.Fatalf("shard %v got %v of %v keys: %v", s, n, nkeys, counts)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Split keeps keys with their group ...\n")
+
+  ck.Join(1, []string{"x"})
+  ck.Join(2, []string{"y"})
+  c1 := ck.Query(-1)
+  ck.Split(3)
+  c2 := ck.Query(-1)
+  if c2.Num != c1.Num + 1 || len(c2.Shards) != 8 {
+    t.Fatalf("Split made Config %v with %v shards", c2.Num, len(c2.Shards))
+  }
+  if c2.Shards[7] != c1.Shards[3] {
+    t.Fatalf("new shard went to %v, not the split shard's %v", c2.Shards[7], c1.Shards[3])
+  }
+  lo1, hi1 := c1.Bounds(3)
+  lo2, mid := c2.Bounds(3)
+  mid2, hi2 := c2.Bounds(7)
+  if lo2 != lo1 || mid != mid2 || hi2 != hi1 || mid <= lo1 || mid >= hi1 {
+    t.Fatalf("split [%v, %v) into [%v, %v) and [%v, %v)", lo1, hi1, lo2, mid, mid2, hi2)
+  }
+  halves := make([]int, 8)
+  for i := 0; i < nkeys; i++ {
+    key := "user" + strconv.Itoa(i)
+    if c2.Owner(key) != c1.Owner(key) {
+      t.Fatalf("key %v moved from group %v to %v", key, c1.Owner(key), c2.Owner(key))
+    }
+    s1, s2 := c1.Shard(key), c2.Shard(key)
+    if s2 != s1 && !(s1 == 3 && s2 == 7) {
+      t.Fatalf("key %v moved from shard %v to %v", key, s1, s2)
+    }
+    halves[s2]++
+  }
+  if halves[3] == 0 || halves[7] == 0 {
+    t.Fatalf("split left shard 3 with %v keys and shard 7 with %v", halves[3], halves[7])
+  }
+
+  ck.Split(8)
+  ck.Split(-1)
+  if c := ck.Query(-1); c.Num != c2.Num {
+    t.Fatalf("Split of a missing shard made Config %v", c.Num)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Join after Split balances every shard ...\n")
+
+  ck.Join(3, []string{"z"})
+  check(t, []int64{1, 2, 3}, ck)
+  if c := ck.Query(-1); len(c.Shards) != 8 {
+    t.Fatalf("Join left %v shards; wanted 8", len(c.Shards))
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestWeights(t *testing.T) {
+  fmt.Printf("Test: Weighted rebalance invariants ...\n")
+
+  seed := time.Now().UnixNano()
+  r := rand.New(rand.NewSource(seed))
+  zones := []string{"a", "b", "c"}
+
+  for trial := 0; trial < 200; trial++ {
+    cfg := &Config{Shards: make([]int64, 1 + r.Intn(3 * NShards)),
+      Groups: map[int64][]string{}, Weights: map[int64]int{},
+      Labels: map[int64]map[string]string{}}
+    nextGid := int64(1)
+    for step := 0; step < 20; step++ {
+      if len(cfg.Groups) > 0 && r.Intn(3) == 0 {
+        for g := range cfg.Groups {
+          delete(cfg.Groups, g)
+          delete(cfg.Weights, g)
+          delete(cfg.Labels, g)
+          break
+        }
+      } else {
+        cfg.Groups[nextGid] = []string{"x"}
+        cfg.Weights[nextGid] = 1 + r.Intn(4)
+        cfg.Labels[nextGid] = map[string]string{"zone": zones[r.Intn(len(zones))],
+          "rack": strconv.Itoa(r.Intn(4))}
+        nextGid++
+      }
+
+      before := append([]int64{}, cfg.Shards...)
+      rebalance(cfg)
+
+      again := cfg.clone()
+      again.Shards = append([]int64{}, before...)
+      rebalance(&again)
+      if !reflect.DeepEqual(again.Shards, cfg.Shards) {
+        t.Fatalf("seed %v: rebalance not deterministic: %v vs %v", seed, cfg.Shards, again.Shards)
+      }
+
+      if len(cfg.Groups) == 0 {
+        continue
+      }
+      total := 0
+      for g := range cfg.Groups {
+        total += cfg.weight(g)
+      }
+      counts := map[int64]int{}
+      for s, g := range cfg.Shards {
+        if _, ok := cfg.Groups[g]; !ok {
+          t.Fatalf("seed %v: shard %v -> invalid group %v", seed, s, g)
+        }
+        counts[g]++
+      }
+      n := len(cfg.Shards)
+      for g := range cfg.Groups {
+        lo := n * cfg.weight(g) / total
+        hi := (n * cfg.weight(g) + total - 1) / total
+        if counts[g] < lo || counts[g] > hi {
+          t.Fatalf("seed %v: group %v of weight %v/%v has %v of %v shards",
+            seed, g, cfg.weight(g), total, counts[g], n)
+        }
+      }
+
+      // a group either kept all its shards or gained none.
+      old := map[int64]int{}
+      for _, g := range before {
+        old[g]++
+      }
+      for s := range cfg.Shards {
+        g, was := cfg.Shards[s], before[s]
+        if g != was && counts[was] >= old[was] && cfg.Groups[was] != nil {
+          t.Fatalf("seed %v: shard %v left group %v, which didn't shrink", seed, s, was)
+        }
+        if g != was && counts[g] <= old[g] {
+          t.Fatalf("seed %v: shard %v joined group %v, which didn't grow", seed, s, g)
+        }
+      }
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  npaxos := 3
+  var sma []*ShardMaster = make([]*ShardMaster, npaxos)
+  var kvh []string = make([]string, npaxos)
+  for i := 0; i < npaxos; i++ {
+    kvh[i] = port("weights", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    sma[i] = StartServerShards(kvh, i, transport.Unix{}, 8)
+  }
+  defer cleanup(sma)
+
+  ck := MakeClerk(kvh, transport.Unix{})
+
+  fmt.Printf("Test: JoinWeighted shares by weight ...\n")
+
+  ck.JoinWeighted(1, []string{"x"}, 1, nil)
+  ck.JoinWeighted(2, []string{"y"}, 3, nil)
+  c := ck.Query(-1)
+  counts := map[int64]int{}
+  for _, g := range c.Shards {
+    counts[g]++
+  }
+  if counts[1] != 2 || counts[2] != 6 {
+    t.Fatalf("weights 1 and 3 got %v and %v of 8 shards", counts[1], counts[2])
+  }
+  ck.Leave(1)
+  ck.Leave(2)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: No zone gets more than its share ...\n")
+
+  // five groups of equal weight: 8/5 shards each, so three get 2.
+  // zone a's share is 24/5, so no more than 5 for its three groups.
+  for g := int64(3); g <= 5; g++ {
+    ck.JoinWeighted(g, []string{"a"}, 1, map[string]string{"zone": "a"})
+  }
+  ck.JoinWeighted(6, []string{"b"}, 1, map[string]string{"zone": "b"})
+  ck.JoinWeighted(7, []string{"c"}, 1, map[string]string{"zone": "c"})
+  c = ck.Query(-1)
+  zone := map[string]int{}
+  for _, g := range c.Shards {
+    zone[c.Labels[g]["zone"]]++
+  }
+  if zone["a"] > 5 || zone["b"] > 2 || zone["c"] > 2 {
+    t.Fatalf("zones got %v shards", zone)
+  }
+  check(t, []int64{3, 4, 5, 6, 7}, ck)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestQueryHistory(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  npaxos := 3
+  var sma []*ShardMaster = make([]*ShardMaster, npaxos)
+  var kvh []string = make([]string, npaxos)
+  for i := 0; i < npaxos; i++ {
+    kvh[i] = port("history", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    sma[i] = StartServer(kvh, i, transport.Unix{})
+  }
+  defer cleanup(sma)
+
+  ck := MakeClerk(kvh, transport.Unix{})
+  for g := int64(1); g <= 5; g++ {
+    ck.Join(g, []string{"x"})
+  }
+
+  fmt.Printf("Test: Historical queries skip the log ...\n")
+
+  for i := 0; i < npaxos; i++ {
+    cki := MakeClerk([]string{kvh[i]}, transport.Unix{})
+    cki.Query(5)
+    max := sma[i].px.Max()
+    for n := 0; n <= 5; n++ {
+      if c := cki.Query(n); c.Num != n {
+        t.Fatalf("Query(%v) on server %v returned Config %v", n, i, c.Num)
+      }
+    }
+    if sma[i].px.Max() != max {
+      t.Fatalf("historical queries on server %v took log instances", i)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Leader reads the latest config without the log ...\n")
+
+  leader := -1
+  for iters := 0; leader < 0 && iters < 50; iters++ {
+    for i := 0; i < npaxos; i++ {
+      if sma[i].px.IsLeader() {
+        leader = i
+      }
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  if leader < 0 {
+    t.Fatalf("no shardmaster became leader")
+  }
+  ckl := MakeClerk([]string{kvh[leader]}, transport.Unix{})
+  ckl.Query(-1)
+  max := sma[leader].px.Max()
+  for i := 0; i < 20; i++ {
+    if c := ckl.Query(-1); c.Num != 5 {
+      t.Fatalf("Query(-1) returned Config %v; wanted 5", c.Num)
+    }
+  }
+  if sma[leader].px.Max() != max {
+    t.Fatalf("leader's Query(-1) took %v log instances", sma[leader].px.Max() - max)
+  }
+
+  // a config made through another server is seen at once.
+  other := MakeClerk([]string{kvh[(leader + 1) % npaxos]}, transport.Unix{})
+  other.Join(6, []string{"x"})
+  if c := ckl.Query(-1); c.Num != 6 {
+    t.Fatalf("Query(-1) after a Join returned Config %v; wanted 6", c.Num)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Followers send latest-config reads to the leader ...\n")
+
+  follower := (leader + 1) % npaxos
+  ckf := MakeClerk(kvh, transport.Unix{})
+  ckf.leader = follower
+  ckf.Query(-1)
+  max = sma[leader].px.Max()
+  for i := 0; i < 20; i++ {
+    ckf.leader = follower
+    if c := ckf.Query(-1); c.Num != 6 {
+      t.Fatalf("Query(-1) via a follower returned Config %v; wanted 6", c.Num)
+    }
+  }
+  if sma[leader].px.Max() != max {
+    t.Fatalf("Query(-1) via a follower took %v log instances", sma[leader].px.Max() - max)
+  }
+  if ckf.leader != leader {
+    t.Fatalf("clerk didn't follow the leader hint to %v", leader)
+  }
+
+  // a clerk that only knows the follower still gets an answer.
+  only := MakeClerk([]string{kvh[follower]}, transport.Unix{})
+  if c := only.Query(-1); c.Num != 6 {
+    t.Fatalf("Query(-1) on a lone follower returned Config %v; wanted 6", c.Num)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Compact forgets old configs ...\n")
+
+  ck.Compact(4)
+  for i := 0; i < npaxos; i++ {
+    cki := MakeClerk([]string{kvh[i]}, transport.Unix{})
+    cki.Query(-1)
+    if _, err := cki.QueryCtx(context.Background(), 3); err != ErrCompacted {
+      t.Fatalf("Query(3) on server %v after Compact(4) returned %v", i, err)
+    }
+    for n := 4; n <= 6; n++ {
+      if c, err := cki.QueryCtx(context.Background(), n); err != nil || c.Num != n {
+        t.Fatalf("Query(%v) on server %v returned Config %v, %v", n, i, c.Num, err)
+      }
+    }
+  }
+
+  ck.Compact(100)
+  if c := ck.Query(-1); c.Num != 6 {
+    t.Fatalf("Compact past the latest config left Config %v", c.Num)
+  }
+  ck.Join(7, []string{"x"})
+  if c := ck.Query(-1); c.Num != 7 {
+    t.Fatalf("Join after Compact made Config %v; wanted 7", c.Num)
+  }
+  check(t, []int64{1, 2, 3, 4, 5, 6, 7}, ck)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestWatchConfigs(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  npaxos := 3
+  var sma []*ShardMaster = make([]*ShardMaster, npaxos)
+  var kvh []string = make([]string, npaxos)
+  for i := 0; i < npaxos; i++ {
+    kvh[i] = port("watch", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    sma[i] = StartServer(kvh, i, transport.Unix{})
+  }
+  defer cleanup(sma)
+
+  ck := MakeClerk(kvh, transport.Unix{})
+  ck.Join(1, []string{"x"})
+
+  fmt.Printf("Test: WatchConfigs returns when a config is made ...\n")
+
+  for i := 0; i < npaxos; i++ {
+    // every server, including ones that didn't propose the Join.
+    cki := MakeClerk([]string{kvh[i]}, transport.Unix{})
+    latest := ck.Query(-1).Num
+    got := make(chan []Config)
+    go func() { got <- cki.WatchConfigs(latest) }()
+    time.Sleep(200 * time.Millisecond)
+    t0 := time.Now()
+    ck.Join(int64(10 + i), []string{"x"})
+    select {
+    case configs := <-got:
+      if len(configs) != 1 || configs[0].Num != latest + 1 {
+        t.Fatalf("server %v: WatchConfigs(%v) returned %v configs", i, latest, len(configs))
+      }
+      if !reflect.DeepEqual(configs[0].Shards, ck.Query(latest + 1).Shards) {
+        t.Fatalf("server %v: WatchConfigs returned the wrong Config", i)
+      }
+    case <-time.After(WatchTimeout):
+      t.Fatalf("server %v: WatchConfigs didn't return", i)
+    }
+    if d := time.Since(t0); d > time.Second {
+      t.Fatalf("server %v: WatchConfigs took %v after the Join", i, d)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: WatchConfigs batches configs ...\n")
+
+  from := ck.Query(-1).Num
+  for g := int64(20); g < 20 + MaxWatchBatch + 4; g++ {
+    ck.Join(g, []string{"x"})
+  }
+  configs := ck.WatchConfigs(from)
+  if len(configs) != MaxWatchBatch {
+    t.Fatalf("WatchConfigs returned %v configs; wanted %v", len(configs), MaxWatchBatch)
+  }
+  for i, c := range configs {
+    if c.Num != from + 1 + i {
+      t.Fatalf("WatchConfigs returned Config %v at %v", c.Num, i)
+    }
+  }
+  rest := ck.WatchConfigs(configs[len(configs)-1].Num)
+  if len(rest) != 4 || rest[3].Num != ck.Query(-1).Num {
+    t.Fatalf("second WatchConfigs returned %v configs", len(rest))
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Idle watchers don't use the log ...\n")
+
+  latest := ck.Query(-1).Num
+  for i := 0; i < npaxos; i++ {
+    MakeClerk([]string{kvh[i]}, transport.Unix{}).Query(latest)
+  }
+  maxes := make([]int, npaxos)
+  for i := 0; i < npaxos; i++ {
+    maxes[i] = sma[i].px.Max()
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), WatchTimeout + time.Second)
+  defer cancel()
+  if _, err := ck.WatchConfigsCtx(ctx, latest); err != context.DeadlineExceeded {
+    t.Fatalf("WatchConfigs with nothing new returned %v", err)
+  }
+  for i := 0; i < npaxos; i++ {
+    if sma[i].px.Max() != maxes[i] {
+      t.Fatalf("watching took log instances on server %v", i)
+    }
+  }
+
+  ck.Compact(latest)
+  if _, err := ck.WatchConfigsCtx(context.Background(), 1); err != ErrCompacted {
+    t.Fatalf("WatchConfigs from a compacted Config returned %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
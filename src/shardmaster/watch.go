@@ -0,0 +1,70 @@
+package shardmaster
+
+//
+// WatchConfigs(from) -> every Config after #from, or an empty list
+// after WatchTimeout if none has been made yet.
+//
+// a server that has none of the Configs waits for the next paxos
+// instance to be decided, applies it without proposing anything,
+// and looks again, so a watcher hears of a new Config as soon as
+// its server learns of it, and no Query goes through the log. a
+// reply holds at most MaxWatchBatch Configs, oldest first; a
+// watcher that's far behind asks again from the last one.
+//
+
+import "context"
+import "time"
+
+// how long a WatchConfigs may wait; less than transport.DefaultTimeout.
+const WatchTimeout = 2 * time.Second
+
+const MaxWatchBatch = 16
+
+func (sm *ShardMaster) WatchConfigs(args *WatchConfigsArgs, reply *WatchConfigsReply) error {
+  ctx, cancel := context.WithTimeout(context.Background(), WatchTimeout)
+  defer cancel()
+
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+  for !sm.dead {
+    sm.catchUp()
+    if sm.configs[len(sm.configs)-1].Num > args.From {
+      break
+    }
+    next := sm.seqNum + 1
+    sm.mu.Unlock()
+    _, err := sm.px.Wait(next, ctx)
+    sm.mu.Lock()
+    if err != nil {
+      break
+    }
+  }
+
+  if args.From + 1 < sm.configs[0].Num {
+    reply.Compacted = true
+    return nil
+  }
+  for _, cfg := range sm.configs {
+    if cfg.Num > args.From && len(reply.Configs) < MaxWatchBatch {
+      reply.Configs = append(reply.Configs, cfg)
+    }
+  }
+  return nil
+}
+
+//
+// apply every instance decided so far, without proposing one.
+// caller must hold sm.mu.
+//
+func (sm *ShardMaster) catchUp() {
+  for {
+    decided, val := sm.px.Status(sm.seqNum+1)
+    if !decided {
+      return
+    }
+    op, _ := val.(Op)
+    sm.ProcessHelper(op)
+    sm.seqNum += 1
+    sm.px.Done(sm.seqNum)
+  }
+}
@@ -0,0 +1,120 @@
+package transport
+
+//
+// in-process transport, for tests that don't need real sockets.
+// each Mem is a separate little network.
+//
+
+import "errors"
+import "io"
+import "net"
+import "sync"
+import "time"
+
+var ErrNoListener = errors.New("transport: nobody listening")
+var ErrNoDeadline = errors.New("transport: mem conns have no deadlines")
+
+type Mem struct {
+  mu        sync.Mutex
+  listeners map[string]*memListener
+}
+
+func NewMem() *Mem {
+  return &Mem{listeners: make(map[string]*memListener)}
+}
+
+func (m *Mem) Listen(addr string) (net.Listener, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  if _, ok := m.listeners[addr]; ok {
+    return nil, &net.OpError{Op: "listen", Net: "mem", Addr: memAddr(addr),
+      Err: errors.New("address already in use")}
+  }
+  l := &memListener{m: m, addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+  m.listeners[addr] = l
+  return l, nil
+}
+
+func (m *Mem) Dial(addr string) (net.Conn, error) {
+  m.mu.Lock()
+  l, ok := m.listeners[addr]
+  m.mu.Unlock()
+  if !ok {
+    return nil, &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr), Err: ErrNoListener}
+  }
+  // one pipe each way, so either side can CloseWrite().
+  r1, w1 := io.Pipe()
+  r2, w2 := io.Pipe()
+  client := &memConn{r: r1, w: w2, local: "client", remote: memAddr(addr)}
+  server := &memConn{r: r2, w: w1, local: memAddr(addr), remote: "client"}
+  select {
+  case l.conns <- server:
+    return client, nil
+  case <-l.done:
+    return nil, &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr), Err: ErrNoListener}
+  }
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memListener struct {
+  m     *Mem
+  addr  string
+  conns chan net.Conn
+  done  chan struct{}
+  once  sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+  select {
+  case c := <-l.conns:
+    return c, nil
+  case <-l.done:
+    return nil, &net.OpError{Op: "accept", Net: "mem", Addr: memAddr(l.addr), Err: net.ErrClosed}
+  }
+}
+
+func (l *memListener) Close() error {
+  l.once.Do(func() {
+    l.m.mu.Lock()
+    if l.m.listeners[l.addr] == l {
+      delete(l.m.listeners, l.addr)
+    }
+    l.m.mu.Unlock()
+    close(l.done)
+  })
+  return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+  return memAddr(l.addr)
+}
+
+type memConn struct {
+  r      *io.PipeReader
+  w      *io.PipeWriter
+  local  memAddr
+  remote memAddr
+}
+
+func (c *memConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *memConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func (c *memConn) Close() error {
+  c.r.Close()
+  return c.w.Close()
+}
+
+// the other side reads EOF.
+func (c *memConn) CloseWrite() error {
+  return c.w.Close()
+}
+
+func (c *memConn) LocalAddr() net.Addr                { return c.local }
+func (c *memConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *memConn) SetDeadline(t time.Time) error      { return ErrNoDeadline }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return ErrNoDeadline }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return ErrNoDeadline }
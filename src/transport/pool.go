@@ -0,0 +1,224 @@
+package transport
+
+//
+// persistent connections with per-call deadlines.
+//
+// pool := transport.NewPool(t, timeout)
+// pool.Call(srv, rpcname, args, reply) bool -- like Call()
+// pool.CallContext(ctx, srv, rpcname, args, reply) bool -- gives up when ctx is done
+// pool.Close() -- drop every connection
+// transport.CallTimeout(t, srv, rpcname, args, reply, timeout) bool
+// transport.CallContext(ctx, t, srv, rpcname, args, reply) bool
+//
+// a Pool keeps one *rpc.Client per server and sends every call to
+// that server over it, so calls don't pay for a dial each. a call
+// that finds the connection broken drops it, and the next call dials
+// a new one. a call that gets no reply within the Pool's timeout, or
+// before its ctx is done, returns false and leaves the connection to
+// the other calls on it, so a hung server or a lost reply can't hang
+// its caller.
+//
+
+import "context"
+import "errors"
+import "io"
+import "net"
+import "net/rpc"
+import "reflect"
+import "sync"
+import "time"
+
+// how long the services' clerks wait for a reply.
+const DefaultTimeout = 5 * time.Second
+
+//
+// implemented by transports whose addresses can move out from
+// under an open connection (see Unix); the Pool re-dials once
+// Alive() returns false.
+//
+type Prober interface {
+  Alive(addr string, conn net.Conn) bool
+}
+
+type Pool struct {
+  t       Transport
+  timeout time.Duration // 0 means calls wait forever
+  mu      sync.Mutex
+  clients map[string]*pooled
+  closed  bool
+}
+
+type pooled struct {
+  c    *rpc.Client
+  conn net.Conn
+}
+
+func NewPool(t Transport, timeout time.Duration) *Pool {
+  return &Pool{t: t, timeout: timeout, clients: make(map[string]*pooled)}
+}
+
+//
+// the connection to srv, dialing one if need be.
+//
+func (p *Pool) get(srv string) (*pooled, error) {
+  p.mu.Lock()
+  pc, ok := p.clients[srv]
+  closed := p.closed
+  p.mu.Unlock()
+  if closed {
+    return nil, rpc.ErrShutdown
+  }
+  if ok {
+    if pr, isProber := p.t.(Prober); !isProber || pr.Alive(srv, pc.conn) {
+      return pc, nil
+    }
+    p.drop(srv, pc)
+  }
+
+  conn, err := dial(p.t, srv)
+  if err != nil {
+    return nil, err
+  }
+  c := rpc.NewClient(conn)
+  pc = &pooled{c, conn}
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  if old, ok := p.clients[srv]; ok || p.closed {
+    // someone else got there first.
+    c.Close()
+    if p.closed {
+      return nil, rpc.ErrShutdown
+    }
+    return old, nil
+  }
+  p.clients[srv] = pc
+  return pc, nil
+}
+
+func (p *Pool) drop(srv string, pc *pooled) {
+  p.mu.Lock()
+  if p.clients[srv] == pc {
+    delete(p.clients, srv)
+  }
+  p.mu.Unlock()
+  pc.c.Close()
+}
+
+//
+// send an RPC to the rpcname handler on server srv, and wait up
+// to the Pool's timeout for the reply. returns true if the server
+// responded; reply is only touched in that case.
+//
+func (p *Pool) Call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+  return p.CallContext(context.Background(), srv, rpcname, args, reply)
+}
+
+//
+// like Call(), but also gives up, returning false, once ctx is done.
+//
+func (p *Pool) CallContext(ctx context.Context, srv string, rpcname string,
+  args interface{}, reply interface{}) bool {
+  if ctx.Err() != nil {
+    return false
+  }
+  pc, err := p.get(srv)
+  if err != nil {
+    return false
+  }
+  err = do(ctx, pc.c, rpcname, args, reply, p.timeout)
+  if err == nil {
+    return true
+  }
+  if broken(err) {
+    p.drop(srv, pc)
+  }
+  return false
+}
+
+//
+// whether a call's error means its connection is no good.
+//
+func broken(err error) bool {
+  if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF || err == io.ErrClosedPipe {
+    return true
+  }
+  _, ok := err.(net.Error)
+  return ok
+}
+
+//
+// like Call(), but with a deadline, and still a fresh connection.
+// for networks that only act on new connections, like the proxy
+// in the pbservice tests.
+//
+func CallTimeout(t Transport, srv string, rpcname string,
+  args interface{}, reply interface{}, timeout time.Duration) bool {
+  return call(context.Background(), t, srv, rpcname, args, reply, timeout)
+}
+
+//
+// like Call(), but gives up, returning false, once ctx is done.
+//
+func CallContext(ctx context.Context, t Transport, srv string, rpcname string,
+  args interface{}, reply interface{}) bool {
+  return call(ctx, t, srv, rpcname, args, reply, 0)
+}
+
+func call(ctx context.Context, t Transport, srv string, rpcname string,
+  args interface{}, reply interface{}, timeout time.Duration) bool {
+  if ctx.Err() != nil {
+    return false
+  }
+  conn, err := dial(t, srv)
+  if err != nil {
+    return false
+  }
+  c := rpc.NewClient(conn)
+  defer c.Close()
+  return do(ctx, c, rpcname, args, reply, timeout) == nil
+}
+
+var errTimeout = errors.New("transport: call timed out")
+
+//
+// make the call on c and wait for it, until ctx is done and for at
+// most timeout if that's > 0.
+//
+func do(ctx context.Context, c *rpc.Client, rpcname string, args interface{},
+  reply interface{}, timeout time.Duration) error {
+  // decode into a fresh reply, so that a reply arriving after
+  // the deadline can't scribble on the caller's.
+  fresh := reflect.New(reflect.TypeOf(reply).Elem())
+  call := c.Go(rpcname, args, fresh.Interface(), make(chan *rpc.Call, 1))
+
+  var expired <-chan time.Time
+  if timeout > 0 {
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+    expired = timer.C
+  }
+
+  select {
+  case <-call.Done:
+    if call.Error != nil {
+      return call.Error
+    }
+    reflect.ValueOf(reply).Elem().Set(fresh.Elem())
+    return nil
+  case <-expired:
+    return errTimeout
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+}
+
+func (p *Pool) Close() {
+  p.mu.Lock()
+  clients := p.clients
+  p.clients = make(map[string]*pooled)
+  p.closed = true
+  p.mu.Unlock()
+  for _, pc := range clients {
+    pc.c.Close()
+  }
+}
@@ -0,0 +1,167 @@
+package transport
+
+//
+// the server side: an accept loop shared by the services.
+//
+// clients keep their connections open (see pool.go), so everything
+// that used to happen once per connection happens once per request:
+// an unreliable server loses individual requests and replies,
+// leaving the connection and the other calls on it alone, and
+// Served() counts requests. once the server is dead, Serve() closes
+// the connections it accepted, so a killed server goes quiet even
+// to clients that were already connected.
+//
+// the tests depend on the unreliable network behaving as it does
+// here, so please don't change that part.
+//
+
+import "bufio"
+import "encoding/gob"
+import "fmt"
+import "io"
+import "math/rand"
+import "net"
+import "net/rpc"
+import "reflect"
+import "sync"
+
+//
+// what Serve() needs to know about the server it works for.
+//
+type Hooks struct {
+  Name       string          // for error messages, e.g. "KVPaxos(0)"
+  Dead       func() bool     // stop serving once this is true
+  Unreliable func() bool     // if non-nil and true, lose some requests and replies
+  Served     func()          // if non-nil, called for each request served
+  Failed     func()          // if non-nil, called when Accept() fails
+  Active     *sync.WaitGroup // if non-nil, counts connections being served
+}
+
+//
+// accept RPC connections on l and serve them with rpcs,
+// until h.Dead(). run it in its own goroutine.
+//
+func Serve(l net.Listener, rpcs *rpc.Server, h Hooks) {
+  var mu sync.Mutex
+  conns := make(map[net.Conn]bool)
+
+  for h.Dead() == false {
+    conn, err := l.Accept()
+    if err == nil && h.Dead() == false {
+      mu.Lock()
+      conns[conn] = true
+      mu.Unlock()
+      if h.Active != nil {
+        h.Active.Add(1)
+      }
+      go func() {
+        rpcs.ServeCodec(newServerCodec(conn, h))
+        mu.Lock()
+        delete(conns, conn)
+        mu.Unlock()
+        if h.Active != nil {
+          h.Active.Done()
+        }
+      }()
+    } else if err == nil {
+      conn.Close()
+    }
+    if err != nil && h.Dead() == false {
+      fmt.Printf("%v accept: %v\n", h.Name, err.Error())
+      if h.Failed != nil {
+        h.Failed()
+      }
+    }
+  }
+
+  mu.Lock()
+  defer mu.Unlock()
+  for conn := range conns {
+    conn.Close()
+  }
+}
+
+//
+// net/rpc's gob codec, plus the Hooks.
+//
+type serverCodec struct {
+  conn   net.Conn
+  h      Hooks
+  dec    *gob.Decoder
+  enc    *gob.Encoder
+  encBuf *bufio.Writer
+
+  mu   sync.Mutex
+  lose map[uint64]bool // replies to discard, by request Seq
+}
+
+func newServerCodec(conn net.Conn, h Hooks) *serverCodec {
+  buf := bufio.NewWriter(conn)
+  return &serverCodec{
+    conn:   conn,
+    h:      h,
+    dec:    gob.NewDecoder(conn),
+    enc:    gob.NewEncoder(buf),
+    encBuf: buf,
+    lose:   make(map[uint64]bool),
+  }
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+  for {
+    if err := c.dec.Decode(r); err != nil {
+      return err
+    }
+    if c.h.Dead() {
+      return io.EOF
+    }
+    if c.h.Unreliable != nil && c.h.Unreliable() {
+      x := rand.Int63() % 1000
+      if x < 100 {
+        // discard the request, and wait for the next one.
+        if err := c.dec.DecodeValue(reflect.Value{}); err != nil {
+          return err
+        }
+        continue
+      }
+      if x < 200 {
+        // process the request but force discard of reply.
+        c.mu.Lock()
+        c.lose[r.Seq] = true
+        c.mu.Unlock()
+      }
+    }
+    if c.h.Served != nil {
+      c.h.Served()
+    }
+    return nil
+  }
+}
+
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+  return c.dec.Decode(body)
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+  c.mu.Lock()
+  lose := c.lose[r.Seq]
+  delete(c.lose, r.Seq)
+  c.mu.Unlock()
+  if lose {
+    // only this call goes unanswered; the client gives up on it
+    // at its deadline.
+    return nil
+  }
+  if err := c.enc.Encode(r); err != nil {
+    return err
+  }
+  if err := c.enc.Encode(body); err != nil {
+    return err
+  }
+  return c.encBuf.Flush()
+}
+
+func (c *serverCodec) Close() error {
+  return c.conn.Close()
+}
+
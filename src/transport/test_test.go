@@ -0,0 +1,294 @@
+package transport
+
+import "context"
+import "testing"
+import "net"
+import "net/rpc"
+import "time"
+import "strconv"
+import "os"
+import "fmt"
+
+func port(tag string) string {
+  s := "/var/tmp/824-"
+  s += strconv.Itoa(os.Getuid()) + "/"
+  os.Mkdir(s, 0777)
+  s += "tr-"
+  s += strconv.Itoa(os.Getpid()) + "-"
+  s += tag
+  return s
+}
+
+type Echo struct {
+  n int
+}
+
+type EchoArgs struct {
+  X int
+}
+
+type EchoReply struct {
+  X int
+}
+
+func (e *Echo) Echo(args *EchoArgs, reply *EchoReply) error {
+  e.n++
+  reply.X = args.X
+  return nil
+}
+
+// sleep for args.X milliseconds.
+func (e *Echo) Sleep(args *EchoArgs, reply *EchoReply) error {
+  time.Sleep(time.Duration(args.X) * time.Millisecond)
+  reply.X = args.X
+  return nil
+}
+
+type server struct {
+  dead       bool
+  unreliable bool
+  served     int
+  accepted   int
+  l          net.Listener
+}
+
+type countingListener struct {
+  net.Listener
+  s *server
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+  c, err := l.Listener.Accept()
+  if err == nil {
+    l.s.accepted++
+  }
+  return c, err
+}
+
+func (s *server) kill() {
+  s.dead = true
+  s.l.Close()
+}
+
+func start(t *testing.T, tr Transport, addr string) (*server, string) {
+  l, err := tr.Listen(addr)
+  if err != nil {
+    t.Fatalf("Listen(%v): %v", addr, err)
+  }
+  rpcs := rpc.NewServer()
+  rpcs.Register(&Echo{})
+  s := &server{l: l}
+  go Serve(countingListener{l, s}, rpcs, Hooks{
+    Name:       "Echo",
+    Dead:       func() bool { return s.dead },
+    Unreliable: func() bool { return s.unreliable },
+    Served:     func() { s.served++ },
+  })
+  t.Cleanup(s.kill)
+  return s, l.Addr().String()
+}
+
+func TestBasic(t *testing.T) {
+  fmt.Printf("Test: Call over each transport ...\n")
+
+  trs := []struct {
+    name string
+    t    Transport
+    addr string
+  }{
+    {"unix", Unix{}, port("basic")},
+    {"tcp", TCP{}, "127.0.0.1:0"},
+    {"mem", NewMem(), "echo"},
+  }
+  for _, tr := range trs {
+    _, addr := start(t, tr.t, tr.addr)
+    for i := 0; i < 10; i++ {
+      reply := EchoReply{}
+      if !Call(tr.t, addr, "Echo.Echo", &EchoArgs{i}, &reply) {
+        t.Fatalf("%v: Call failed", tr.name)
+      }
+      if reply.X != i {
+        t.Fatalf("%v: wrong reply %v, expected %v", tr.name, reply.X, i)
+      }
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestNoServer(t *testing.T) {
+  fmt.Printf("Test: Call with nobody listening ...\n")
+
+  mem := NewMem()
+  if Call(mem, "nobody", "Echo.Echo", &EchoArgs{1}, &EchoReply{}) {
+    t.Fatalf("Call to nobody succeeded")
+  }
+  if Call(Unix{}, port("nobody"), "Echo.Echo", &EchoArgs{1}, &EchoReply{}) {
+    t.Fatalf("Call to nobody succeeded")
+  }
+
+  // a closed listener frees its address.
+  l, _ := mem.Listen("x")
+  l.Close()
+  if Call(mem, "x", "Echo.Echo", &EchoArgs{1}, &EchoReply{}) {
+    t.Fatalf("Call to closed listener succeeded")
+  }
+  if _, err := mem.Listen("x"); err != nil {
+    t.Fatalf("Listen after Close: %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestUnreliable(t *testing.T) {
+  fmt.Printf("Test: Serve loses requests and replies when unreliable ...\n")
+
+  mem := NewMem()
+  s, addr := start(t, mem, "echo")
+  s.unreliable = true
+  nok := 0
+  const n = 200
+  for i := 0; i < n; i++ {
+    // a lost reply leaves the call waiting, so it needs a deadline.
+    if CallTimeout(mem, addr, "Echo.Echo", &EchoArgs{i}, &EchoReply{}, 100 * time.Millisecond) {
+      nok++
+    }
+  }
+  if nok == n || nok < n/2 {
+    t.Fatalf("%v of %v calls succeeded", nok, n)
+  }
+  if s.served <= nok {
+    t.Fatalf("served %v, but only %v replies should have come back", s.served, nok)
+  }
+
+  s.unreliable = false
+  if !Call(mem, addr, "Echo.Echo", &EchoArgs{1}, &EchoReply{}) {
+    t.Fatalf("Call failed once reliable")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestPool(t *testing.T) {
+  fmt.Printf("Test: Pool reuses one connection per server ...\n")
+
+  addr := port("pool")
+  s, _ := start(t, Unix{}, addr)
+  pool := NewPool(Unix{}, time.Second)
+  defer pool.Close()
+  for i := 0; i < 20; i++ {
+    reply := EchoReply{}
+    if !pool.Call(addr, "Echo.Echo", &EchoArgs{i}, &reply) || reply.X != i {
+      t.Fatalf("Call failed")
+    }
+  }
+  if s.accepted != 1 {
+    t.Fatalf("%v connections for 20 calls", s.accepted)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Pool times out a slow server ...\n")
+
+  fast := NewPool(Unix{}, 100 * time.Millisecond)
+  defer fast.Close()
+  t0 := time.Now()
+  reply := EchoReply{}
+  if fast.Call(addr, "Echo.Sleep", &EchoArgs{1000}, &reply) {
+    t.Fatalf("Call to a slow handler succeeded")
+  }
+  if d := time.Since(t0); d > 500 * time.Millisecond {
+    t.Fatalf("Call took %v, timeout was 100ms", d)
+  }
+  if reply.X != 0 {
+    t.Fatalf("reply changed by a Call that failed")
+  }
+  if !fast.Call(addr, "Echo.Sleep", &EchoArgs{1}, &reply) {
+    t.Fatalf("Call after a timeout failed")
+  }
+  if s.accepted != 2 {
+    t.Fatalf("a timeout dropped the connection; %v connections for 2 pools", s.accepted)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Pool notices removed addresses and dead servers ...\n")
+
+  os.Rename(addr, addr + "x")
+  if pool.Call(addr, "Echo.Echo", &EchoArgs{1}, &EchoReply{}) {
+    t.Fatalf("Call to a renamed socket succeeded")
+  }
+  os.Rename(addr + "x", addr)
+  if !pool.Call(addr, "Echo.Echo", &EchoArgs{1}, &EchoReply{}) {
+    t.Fatalf("Call failed once the socket was back")
+  }
+
+  s.kill()
+  if pool.Call(addr, "Echo.Echo", &EchoArgs{1}, &EchoReply{}) {
+    t.Fatalf("Call to a dead server succeeded")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestCallContext(t *testing.T) {
+  fmt.Printf("Test: calls give up when their context is done ...\n")
+
+  addr := port("ctx")
+  start(t, Unix{}, addr)
+  pool := NewPool(Unix{}, 0)
+  defer pool.Close()
+
+  ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+  defer cancel()
+  t0 := time.Now()
+  if pool.CallContext(ctx, addr, "Echo.Sleep", &EchoArgs{1000}, &EchoReply{}) {
+    t.Fatalf("pooled Call to a slow handler succeeded")
+  }
+  if CallContext(ctx, Unix{}, addr, "Echo.Sleep", &EchoArgs{1000}, &EchoReply{}) {
+    t.Fatalf("Call to a slow handler succeeded")
+  }
+  if d := time.Since(t0); d > 500 * time.Millisecond {
+    t.Fatalf("Calls took %v, deadline was 100ms", d)
+  }
+
+  ctx, cancel = context.WithCancel(context.Background())
+  go func() {
+    time.Sleep(100 * time.Millisecond)
+    cancel()
+  }()
+  if pool.CallContext(ctx, addr, "Echo.Sleep", &EchoArgs{1000}, &EchoReply{}) {
+    t.Fatalf("cancelled Call succeeded")
+  }
+  if pool.CallContext(ctx, addr, "Echo.Echo", &EchoArgs{1}, &EchoReply{}) {
+    t.Fatalf("Call with a done context succeeded")
+  }
+  reply := EchoReply{}
+  if !pool.CallContext(context.Background(), addr, "Echo.Echo", &EchoArgs{1}, &reply) || reply.X != 1 {
+    t.Fatalf("Call after a cancelled one failed")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestPoolUnreliable(t *testing.T) {
+  fmt.Printf("Test: Serve loses requests on pooled connections ...\n")
+
+  mem := NewMem()
+  s, addr := start(t, mem, "echo")
+  pool := NewPool(mem, 100 * time.Millisecond)
+  defer pool.Close()
+  s.unreliable = true
+  nok := 0
+  const n = 200
+  for i := 0; i < n; i++ {
+    if pool.Call(addr, "Echo.Echo", &EchoArgs{i}, &EchoReply{}) {
+      nok++
+    }
+  }
+  if nok == n || nok < n/2 {
+    t.Fatalf("%v of %v calls succeeded", nok, n)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,113 @@
+package transport
+
+//
+// how the services talk to each other.
+//
+// a Transport listens on and dials addresses; what an address
+// looks like depends on the Transport:
+//
+// transport.Unix{} -- unix-domain sockets; addresses are file names
+// transport.TCP{} -- TCP; addresses are host:port
+// transport.NewMem() -- in-process pipes; addresses are any string
+//
+// every service's StartServer()/Make() and MakeClerk() takes the
+// Transport to use. the services send their RPCs through a Pool,
+// which keeps a connection open to each server and puts a deadline
+// on every call (see pool.go); one-off RPCs can use Call(). servers
+// run Serve() to accept RPC connections, which also knows how to
+// be unreliable for testing (see serve.go).
+//
+
+import "context"
+import "errors"
+import "fmt"
+import "net"
+import "os"
+import "syscall"
+
+type Transport interface {
+  Listen(addr string) (net.Listener, error)
+  Dial(addr string) (net.Conn, error)
+}
+
+type Unix struct{}
+
+func (Unix) Listen(addr string) (net.Listener, error) {
+  os.Remove(addr) // in case a dead server left it behind
+  return net.Listen("unix", addr)
+}
+
+func (Unix) Dial(addr string) (net.Conn, error) {
+  fi, _ := os.Stat(addr)
+  c, err := net.Dial("unix", addr)
+  if err != nil {
+    return nil, err
+  }
+  return &unixConn{c, fi}, nil
+}
+
+//
+// a unix socket file can be removed, renamed or replaced while we're
+// connected to it; the tests do that to cut servers off. a connection
+// is only good for as long as addr still names the file it was
+// dialed on.
+//
+type unixConn struct {
+  net.Conn
+  fi os.FileInfo
+}
+
+func (Unix) Alive(addr string, conn net.Conn) bool {
+  c, ok := conn.(*unixConn)
+  if !ok || c.fi == nil {
+    return false
+  }
+  fi, err := os.Stat(addr)
+  return err == nil && os.SameFile(c.fi, fi)
+}
+
+type TCP struct{}
+
+func (TCP) Listen(addr string) (net.Listener, error) {
+  return net.Listen("tcp", addr)
+}
+
+func (TCP) Dial(addr string) (net.Conn, error) {
+  return net.Dial("tcp", addr)
+}
+
+//
+// Call() sends an RPC to the rpcname handler on server srv
+// with arguments args, waits for the reply, and leaves the
+// reply in reply. the reply argument should be a pointer
+// to a reply structure.
+//
+// the return value is true if the server responded, and false
+// if Call() was not able to contact the server. in particular,
+// the reply's contents are only valid if Call() returned true.
+//
+// Call() dials a fresh connection and has no deadline, so it
+// suits RPCs that may legitimately take a long time; use a Pool
+// (see pool.go) for everything else. a reply lost by an unreliable
+// server (see serve.go) leaves it waiting forever.
+//
+func Call(t Transport, srv string, rpcname string,
+  args interface{}, reply interface{}) bool {
+  return CallContext(context.Background(), t, srv, rpcname, args, reply)
+}
+
+//
+// connect to srv, complaining about anything other than
+// nobody being there.
+//
+func dial(t Transport, srv string) (net.Conn, error) {
+  conn, err := t.Dial(srv)
+  if err != nil {
+    if !errors.Is(err, syscall.ENOENT) && !errors.Is(err, syscall.ECONNREFUSED) &&
+      !errors.Is(err, ErrNoListener) {
+      fmt.Printf("Dial(%v) failed: %v\n", srv, err)
+    }
+    return nil, err
+  }
+  return conn, nil
+}
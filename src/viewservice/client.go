@@ -1,7 +1,8 @@
 package viewservice
 
-import "net/rpc"
+import "context"
 import "fmt"
+import "transport"
 
 //
 // the viewservice Clerk lives in the client
@@ -10,49 +11,23 @@ import "fmt"
 type Clerk struct {
   me string      // client's name (host:port)
   server string  // viewservice's host:port
+  pool *transport.Pool
 }
 
-func MakeClerk(me string, server string) *Clerk {
+func MakeClerk(me string, server string, t transport.Transport) *Clerk {
   ck := new(Clerk)
   ck.me = me
   ck.server = server
+  ck.pool = transport.NewPool(t, transport.DefaultTimeout)
   return ck
 }
 
-//
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be a pointer
-// to a reply structure.
-//
-// the return value is true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// the reply's contents are only valid if call() returned true.
-//
-// you should assume that call() will time out and return an
-// error after a while if it doesn't get a reply from the server.
-//
-// please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
-//
-func call(srv string, rpcname string,
-          args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-    
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
-  }
-
-  fmt.Println(err)
-  return false
+func (ck *Clerk) Ping(viewnum uint) (View, error) {
+  return ck.PingCtx(context.Background(), viewnum)
 }
 
-func (ck *Clerk) Ping(viewnum uint) (View, error) {
+// like Ping(), but gives up once ctx is done.
+func (ck *Clerk) PingCtx(ctx context.Context, viewnum uint) (View, error) {
   // prepare the arguments.
   args := &PingArgs{}
   args.Me = ck.me
@@ -60,7 +35,7 @@ func (ck *Clerk) Ping(viewnum uint) (View, error) {
   var reply PingReply
 
   // send an RPC request, wait for the reply.
-  ok := call(ck.server, "ViewServer.Ping", args, &reply)
+  ok := ck.pool.CallContext(ctx, ck.server, "ViewServer.Ping", args, &reply)
   if ok == false {
     return View{}, fmt.Errorf("Ping(%v) failed", viewnum)
   }
@@ -71,7 +46,7 @@ func (ck *Clerk) Ping(viewnum uint) (View, error) {
 func (ck *Clerk) Get() (View, bool) {
   args := &GetArgs{}
   var reply GetReply
-  ok := call(ck.server, "ViewServer.Get", args, &reply)
+  ok := ck.pool.Call(ck.server, "ViewServer.Get", args, &reply)
   if ok == false {
     return View{}, false
   }
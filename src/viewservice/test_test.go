@@ -6,6 +6,7 @@ import "time"
 import "fmt"
 import "os"
 import "strconv"
+import "transport"
 
 func check(t *testing.T, ck *Clerk, p string, b string, n uint) {
   view, _ := ck.Get()
@@ -37,11 +38,11 @@ func Test1(t *testing.T) {
   runtime.GOMAXPROCS(4)
 
   vshost := port("v")
-  vs := StartServer(vshost)
+  vs := StartServer(vshost, transport.Unix{})
 
-  ck1 := MakeClerk(port("1"), vshost)
-  ck2 := MakeClerk(port("2"), vshost)
-  ck3 := MakeClerk(port("3"), vshost)
+  ck1 := MakeClerk(port("1"), vshost, transport.Unix{})
+  ck2 := MakeClerk(port("2"), vshost, transport.Unix{})
+  ck3 := MakeClerk(port("3"), vshost, transport.Unix{})
 
   //
 